@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"crypto/md5"
+)
+
+const apr1Magic = "$apr1$"
+
+const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 computes Apache's variant of the MD5-based crypt(3), which is the
+// default hash of the htpasswd command.
+func apr1(pass, salt string) string {
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+
+	p, s := []byte(pass), []byte(salt)
+
+	alt := md5.New()
+	alt.Write(p)
+	alt.Write(s)
+	alt.Write(p)
+	altSum := alt.Sum(nil)
+
+	ctx := md5.New()
+	ctx.Write(p)
+	ctx.Write([]byte(apr1Magic))
+	ctx.Write(s)
+	for i := len(p); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(altSum)
+		} else {
+			ctx.Write(altSum[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 == 1 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(p[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	// The loop is deliberately slow.
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 == 1 {
+			c.Write(p)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 == 1 {
+			c.Write(final)
+		} else {
+			c.Write(p)
+		}
+		final = c.Sum(nil)
+	}
+
+	out := make([]byte, 0, 22)
+	to64 := func(v uint, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint(final[g[0]])<<16|uint(final[g[1]])<<8|uint(final[g[2]]), 4)
+	}
+	to64(uint(final[11]), 2)
+
+	return apr1Magic + salt + "$" + string(out)
+}
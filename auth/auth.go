@@ -0,0 +1,192 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Role is the access level granted to a client. A controller can also do
+// everything a viewer can.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleController
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleController:
+		return "controller"
+	default:
+		return "none"
+	}
+}
+
+func ParseRole(s string) (Role, error) {
+	switch strings.ToLower(s) {
+	case "viewer":
+		return RoleViewer, nil
+	case "controller":
+		return RoleController, nil
+	default:
+		return RoleNone, fmt.Errorf("unknown role: %s", s)
+	}
+}
+
+type user struct {
+	hash string
+	role Role
+}
+
+// Authenticator checks bearer tokens and HTTP basic credentials.
+// When no credentials are registered, every request is allowed.
+type Authenticator struct {
+	tokens map[string]Role
+	users  map[string]user
+}
+
+func NewAuthenticator() *Authenticator {
+	return &Authenticator{
+		tokens: map[string]Role{},
+		users:  map[string]user{},
+	}
+}
+
+// Enabled reports whether any credential is registered.
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) > 0 || len(a.users) > 0
+}
+
+// AddToken registers a static bearer token.
+func (a *Authenticator) AddToken(token string, role Role) {
+	a.tokens[token] = role
+}
+
+// LoadHtpasswd registers users from a htpasswd-style file. Each line is
+// "user:hash" or "user:hash:role", where role is viewer or controller
+// (default). bcrypt ($2y$), Apache MD5 ($apr1$) and SHA-1 ({SHA}) hashes are
+// supported.
+func (a *Authenticator) LoadHtpasswd(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open htpasswd: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[0] == "" {
+			return fmt.Errorf("htpasswd line %d: malformed entry", n)
+		}
+
+		role := RoleController
+		if len(fields) == 3 {
+			role, err = ParseRole(fields[2])
+			if err != nil {
+				return fmt.Errorf("htpasswd line %d: %s", n, err)
+			}
+		}
+
+		a.users[fields[0]] = user{hash: fields[1], role: role}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("failed to read htpasswd: %s", err)
+	}
+	return nil
+}
+
+// Authenticate returns the role of the credentials in the request.
+// The token can be given as a bearer token, or as the "token" query
+// parameter for clients that can't set headers (e.g. OBS browser sources).
+func (a *Authenticator) Authenticate(r *http.Request) Role {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return a.tokenRole(token)
+	}
+
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return a.tokenRole(strings.TrimPrefix(h, "Bearer "))
+	}
+
+	name, pass, ok := r.BasicAuth()
+	if !ok {
+		return RoleNone
+	}
+
+	u, ok := a.users[name]
+	if !ok || !verifyPassword(u.hash, pass) {
+		return RoleNone
+	}
+	return u.role
+}
+
+func (a *Authenticator) tokenRole(token string) Role {
+	role := RoleNone
+	for t, r := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 && r > role {
+			role = r
+		}
+	}
+	return role
+}
+
+// Require wraps next so that it is served only to clients with at least
+// the given role.
+func (a *Authenticator) Require(role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		got := a.Authenticate(r)
+		if got == RoleNone {
+			if len(a.users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="mtplvcap"`)
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		} else if got < role {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func verifyPassword(hash, pass string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(strings.TrimPrefix(hash, "$apr1$"), "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(apr1(pass, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApr1(t *testing.T) {
+	// Generated by `openssl passwd -apr1 -salt SALT PASSWORD`.
+	for _, c := range []struct{ pass, salt, want string }{
+		{"password", "abcdefgh", "$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1"},
+		{"s3cr3t pass", "Vz3", "$apr1$Vz3$d.irJK8n2CoxcskitkkTs."},
+	} {
+		if got := apr1(c.pass, c.salt); got != c.want {
+			t.Errorf("apr1(%q, %q) = %q, want %q", c.pass, c.salt, got, c.want)
+		}
+	}
+}
+
+func TestRequire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	htpasswd := filepath.Join(dir, "htpasswd")
+	err = ioutil.WriteFile(htpasswd, []byte(
+		"# comment\n"+
+			"operator:$2a$04$t/8XgWJJJWFW48T9NbsZX.LOqf2.52xyFN/hgvIM8F0I8thZiFFIS\n"+
+			"obs:$apr1$abcdefgh$FBwExRW4dCc8aL.OvjpIE1:viewer\n"+
+			"legacy:{SHA}NLXiNY8fHj9C8Fsi4utQHCZHyKc=:viewer\n",
+	), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAuthenticator()
+	a.AddToken("ctrl-token", RoleController)
+	a.AddToken("view-token", RoleViewer)
+	if err = a.LoadHtpasswd(htpasswd); err != nil {
+		t.Fatal(err)
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	viewer := a.Require(RoleViewer, ok)
+	controller := a.Require(RoleController, ok)
+
+	for _, c := range []struct {
+		name    string
+		handler http.Handler
+		url     string
+		setup   func(r *http.Request)
+		want    int
+	}{
+		{"anonymous", viewer, "/mjpeg", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"viewer token", viewer, "/mjpeg", func(r *http.Request) { r.Header.Set("Authorization", "Bearer view-token") }, http.StatusOK},
+		{"viewer token for control", controller, "/control", func(r *http.Request) { r.Header.Set("Authorization", "Bearer view-token") }, http.StatusForbidden},
+		{"controller token in query", controller, "/control?token=ctrl-token", func(r *http.Request) {}, http.StatusOK},
+		{"wrong token", viewer, "/view?token=nope", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bcrypt user", controller, "/", func(r *http.Request) { r.SetBasicAuth("operator", "operator") }, http.StatusOK},
+		{"bcrypt wrong password", controller, "/", func(r *http.Request) { r.SetBasicAuth("operator", "guess") }, http.StatusUnauthorized},
+		{"apr1 viewer", viewer, "/view", func(r *http.Request) { r.SetBasicAuth("obs", "password") }, http.StatusOK},
+		{"apr1 viewer for control", controller, "/", func(r *http.Request) { r.SetBasicAuth("obs", "password") }, http.StatusForbidden},
+		{"sha1 viewer", viewer, "/snapshot", func(r *http.Request) { r.SetBasicAuth("legacy", "viewerpass") }, http.StatusOK},
+	} {
+		r := httptest.NewRequest("GET", c.url, nil)
+		c.setup(r)
+		w := httptest.NewRecorder()
+		c.handler.ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s: got status %d, want %d", c.name, w.Code, c.want)
+		}
+	}
+}
+
+func TestRequireDisabled(t *testing.T) {
+	a := NewAuthenticator()
+	h := a.Require(RoleController, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/control", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	p := NewOriginPolicy([]string{"https://Dashboard.example.com/"})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, c := range []struct {
+		name    string
+		method  string
+		origin  string
+		allowed bool
+		acao    string
+		want    int
+	}{
+		{"no origin", "GET", "", true, "", http.StatusOK},
+		{"same origin", "GET", "http://camera.local:42839", true, "", http.StatusOK},
+		{"listed origin", "GET", "https://dashboard.example.com", true, "https://dashboard.example.com", http.StatusOK},
+		{"unlisted origin", "GET", "https://evil.example.com", false, "", http.StatusOK},
+		{"listed preflight", "OPTIONS", "https://dashboard.example.com", true, "https://dashboard.example.com", http.StatusNoContent},
+		{"unlisted preflight", "OPTIONS", "https://evil.example.com", false, "", http.StatusForbidden},
+		{"unlisted post", "POST", "https://evil.example.com", false, "", http.StatusForbidden},
+		{"listed post", "POST", "https://dashboard.example.com", true, "https://dashboard.example.com", http.StatusOK},
+	} {
+		r := httptest.NewRequest(c.method, "http://camera.local:42839/snapshot", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if c.method == "OPTIONS" {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+
+		if got := p.Allowed(r); got != c.allowed {
+			t.Errorf("%s: Allowed() = %v, want %v", c.name, got, c.allowed)
+		}
+
+		w := httptest.NewRecorder()
+		p.CORS(next).ServeHTTP(w, r)
+		if w.Code != c.want {
+			t.Errorf("%s: got status %d, want %d", c.name, w.Code, c.want)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != c.acao {
+			t.Errorf("%s: got Access-Control-Allow-Origin %q, want %q", c.name, got, c.acao)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://camera.local/control", nil)
+	r.Header.Set("Origin", "https://anything.example.com")
+	if !NewOriginPolicy([]string{"*"}).Allowed(r) {
+		t.Error("wildcard should allow any origin")
+	}
+	w := httptest.NewRecorder()
+	NewOriginPolicy([]string{"*"}).CORS(next).ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Credentials") != "" {
+		t.Error("wildcard should not allow credentials")
+	}
+	r = httptest.NewRequest("GET", "http://camera.local/snapshot", nil)
+	r.Header.Set("Origin", "https://dashboard.example.com")
+	w = httptest.NewRecorder()
+	p.CORS(next).ServeHTTP(w, r)
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Error("listed origins should be allowed credentials")
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy decides which cross-origin pages may open WebSockets and read
+// HTTP responses. Same-origin requests and requests without Origin header
+// (non-browser clients) are always allowed.
+type OriginPolicy struct {
+	any     bool
+	origins map[string]bool
+}
+
+// NewOriginPolicy allows the given origins (e.g. "https://dashboard.example.com").
+// "*" allows any origin.
+func NewOriginPolicy(origins []string) *OriginPolicy {
+	p := &OriginPolicy{origins: map[string]bool{}}
+	for _, o := range origins {
+		o = normalizeOrigin(o)
+		if o == "" {
+			continue
+		} else if o == "*" {
+			p.any = true
+		}
+		p.origins[o] = true
+	}
+	return p
+}
+
+func normalizeOrigin(o string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(o)), "/")
+}
+
+// Allowed reports whether the request comes from an allowed origin.
+// It can be used as websocket.Upgrader.CheckOrigin.
+func (p *OriginPolicy) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || sameOrigin(r, origin) {
+		return true
+	}
+	return p.any || p.origins[normalizeOrigin(origin)]
+}
+
+func sameOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// CORS adds CORS headers for allowed cross-origin requests and answers
+// preflight requests.
+func (p *OriginPolicy) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || sameOrigin(r, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !p.Allowed(r) {
+			// Simple requests, e.g. a form POST, skip the preflight, so
+			// anything but reads is refused here.
+			if preflight || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		if p.origins[normalizeOrigin(origin)] {
+			// "*" doesn't let any site read with the user's credentials.
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "Accept-Ranges, Content-Disposition, Content-Range")
+
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Last-Event-ID, Range")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,24 +1,33 @@
 package logging
 
 import (
-	"net/http"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
 var root = &logrus.Logger{
-	Out:   os.Stdout,
-	Level: logrus.TraceLevel,
-	Formatter: &prefixed.TextFormatter{
-		DisableColors: func() bool {
-			term, ok := os.LookupEnv("TERM")
-			return term == "" || !ok
-		}(),
+	Out:       os.Stdout,
+	Level:     logrus.TraceLevel,
+	Formatter: newTextFormatter(!isTerminal()),
+}
+
+func isTerminal() bool {
+	term, ok := os.LookupEnv("TERM")
+	return term != "" && ok
+}
+
+func newTextFormatter(disableColors bool) logrus.Formatter {
+	return &prefixed.TextFormatter{
+		DisableColors:   disableColors,
 		ForceFormatting: true,
 		TimestampFormat: "2006-01-02 15:04:05",
-	},
+	}
 }
 
 type ChildLogger struct {
@@ -31,6 +40,7 @@ func NewChildLogger(parent *logrus.Logger, prefix string) *ChildLogger {
 	lc := &ChildLogger{
 		parent: parent,
 		prefix: prefix,
+		level:  logrus.InfoLevel,
 	}
 
 	return lc
@@ -40,6 +50,12 @@ func (l *ChildLogger) shouldOutput(level logrus.Level) bool {
 	return l.level >= level
 }
 
+func (l *ChildLogger) Trace(args ...interface{}) {
+	if l.shouldOutput(logrus.TraceLevel) {
+		l.parent.WithField("prefix", l.prefix).Trace(args...)
+	}
+}
+
 func (l *ChildLogger) Debug(args ...interface{}) {
 	if l.shouldOutput(logrus.DebugLevel) {
 		l.parent.WithField("prefix", l.prefix).Debug(args...)
@@ -70,6 +86,12 @@ func (l *ChildLogger) Fatal(args ...interface{}) {
 	}
 }
 
+func (l *ChildLogger) Tracef(format string, args ...interface{}) {
+	if l.shouldOutput(logrus.TraceLevel) {
+		l.parent.WithField("prefix", l.prefix).Tracef(format, args...)
+	}
+}
+
 func (l *ChildLogger) Debugf(format string, args ...interface{}) {
 	if l.shouldOutput(logrus.DebugLevel) {
 		l.parent.WithField("prefix", l.prefix).Debugf(format, args...)
@@ -100,6 +122,13 @@ func (l *ChildLogger) Fatalf(format string, args ...interface{}) {
 	}
 }
 
+// WithFields logs a message with structured fields at the given level.
+func (l *ChildLogger) WithFields(level logrus.Level, fields logrus.Fields, msg string) {
+	if l.shouldOutput(level) {
+		l.parent.WithFields(fields).WithField("prefix", l.prefix).Log(level, msg)
+	}
+}
+
 func (l *ChildLogger) IsDebug() bool {
 	return l.level >= logrus.DebugLevel
 }
@@ -112,12 +141,17 @@ func (l *ChildLogger) SetDebug(debug bool) {
 	}
 }
 
+func (l *ChildLogger) SetLevel(level logrus.Level) {
+	l.level = level
+}
+
 type Children struct {
 	Main *ChildLogger
 	USB  *ChildLogger
 	MTP  *ChildLogger
 	Data *ChildLogger
 	LV   *ChildLogger
+	HTTP *ChildLogger
 }
 
 var log = &Children{
@@ -126,25 +160,99 @@ var log = &Children{
 	MTP:  NewChildLogger(root, "mtp"),
 	Data: NewChildLogger(root, "data"),
 	LV:   NewChildLogger(root, "lv"),
+	HTTP: NewChildLogger(root, "http"),
 }
 
-func SetLogLevel(main, usb, mtp, data, lv bool) {
-	log.Main.SetDebug(main)
-	log.USB.SetDebug(usb)
-	log.MTP.SetDebug(mtp)
-	log.Data.SetDebug(data)
-	log.LV.SetDebug(lv)
+// subsystem returns the logger for a name used in command line options.
+func (c *Children) subsystem(name string) (*ChildLogger, bool) {
+	switch name {
+	case "main":
+		return c.Main, true
+	case "usb":
+		return c.USB, true
+	case "mtp":
+		return c.MTP, true
+	case "data":
+		return c.Data, true
+	case "server", "lv":
+		return c.LV, true
+	case "http":
+		return c.HTTP, true
+	}
+	return nil, false
 }
 
-func GetLogger() *Children {
-	return log
+func (c *Children) all() []*ChildLogger {
+	return []*ChildLogger{c.Main, c.USB, c.MTP, c.Data, c.LV, c.HTTP}
+}
+
+// EnableDebug raises the given subsystems to the debug level.
+// Unknown names are ignored.
+func EnableDebug(names ...string) {
+	for _, name := range names {
+		if l, ok := log.subsystem(name); ok && !l.IsDebug() {
+			l.SetDebug(true)
+		}
+	}
+}
+
+// SetLogLevels parses a spec like "info,usb=debug,mtp=trace". A bare level
+// applies to every subsystem, and subsystem=level pairs override it.
+func SetLogLevels(spec string) error {
+	var overrides []string
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		} else if strings.Contains(s, "=") {
+			overrides = append(overrides, s)
+			continue
+		}
+
+		level, err := logrus.ParseLevel(s)
+		if err != nil {
+			return err
+		}
+		for _, l := range log.all() {
+			l.SetLevel(level)
+		}
+	}
+
+	for _, s := range overrides {
+		kv := strings.SplitN(s, "=", 2)
+		l, ok := log.subsystem(strings.TrimSpace(kv[0]))
+		if !ok {
+			return fmt.Errorf("unknown subsystem: %s", kv[0])
+		}
+
+		level, err := logrus.ParseLevel(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return err
+		}
+		l.SetLevel(level)
+	}
+	return nil
+}
+
+// SetFormat switches the log format between "text" and "json".
+func SetFormat(format string) error {
+	switch format {
+	case "text":
+		_, isFile := root.Out.(*RotatingFile)
+		root.Formatter = newTextFormatter(isFile || !isTerminal())
+	case "json":
+		root.Formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	return nil
 }
 
-func HTTPLogHandler(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			root.WithField("prefix", "http").Infof("%s %s %s", r.Method, r.URL.Path, r.RemoteAddr)
-		}()
-		next.ServeHTTP(w, r)
-	})
+// SetOutput changes where the logs are written. Call it before SetFormat.
+func SetOutput(w io.Writer) {
+	root.Out = w
+}
+
+func GetLogger() *Children {
+	return log
 }
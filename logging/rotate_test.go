@@ -0,0 +1,72 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "logging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "mtplvcap.log")
+	rf, err := NewRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err = rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, want := range map[string]string{
+		"mtplvcap.log":   "fourth\n",
+		"mtplvcap.log.1": "third\n",
+		"mtplvcap.log.2": "second\n",
+	} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 backups, stat returned %v", err)
+	}
+}
+
+func TestSetLogLevels(t *testing.T) {
+	defer SetLogLevels("info")
+
+	err := SetLogLevels("warn,usb=debug,server=trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if log.Main.shouldOutput(logrus.InfoLevel) || !log.Main.shouldOutput(logrus.WarnLevel) {
+		t.Errorf("main: unexpected level %s", log.Main.level)
+	}
+	if !log.USB.IsDebug() {
+		t.Errorf("usb: unexpected level %s", log.USB.level)
+	}
+	if log.LV.level != logrus.TraceLevel {
+		t.Errorf("lv: unexpected level %s", log.LV.level)
+	}
+
+	if SetLogLevels("nope=debug") == nil {
+		t.Error("unknown subsystem should be rejected")
+	}
+}
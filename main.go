@@ -18,7 +18,9 @@ import (
 	"time"
 
 	"github.com/google/gousb"
+	"github.com/puhitaku/mtplvcap/auth"
 	"github.com/puhitaku/mtplvcap/logging"
+	"github.com/puhitaku/mtplvcap/tlscert"
 
 	"golang.org/x/sync/errgroup"
 
@@ -27,24 +29,69 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "upload" {
+		if err := runUpload(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	host := flag.String("host", "localhost", "hostname: default = localhost, specify 0.0.0.0 for public access")
 	port := flag.Int("port", 42839, "port: default = 42839")
-	backendGo := flag.Bool("backend-go", false, "use gousb as a libusb wrapper (not recommended)")
+	backend := flag.String("backend", "direct", "device backend: direct (libusb), gousb or ptpip (PTP/IP over TCP)")
+	backendGo := flag.Bool("backend-go", false, "same as -backend gousb (deprecated)")
+	addr := flag.String("addr", "", "address of the camera for -backend ptpip, e.g. 192.168.1.1:15740")
 	debug := flag.String("debug", "", "comma-separated list of debugging options: usb, data, mtp, server")
+	logLevel := flag.String("log-level", "info", "log level (trace, debug, info, warn, error) optionally followed by comma-separated overrides per subsystem, e.g. info,usb=debug,http=warn")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	logFile := flag.String("log-file", "", "write logs to the file instead of stdout")
+	logMaxSize := flag.Int64("log-max-size", 100, "rotate the log file when it exceeds the size in MB, 0 to disable")
+	logMaxBackups := flag.Int("log-max-backups", 5, "number of rotated log files to keep")
 	serverOnly := flag.Bool("server-only", false, "serve frontend without opening a DSLR (for devevelopment)")
 	vendorID := flag.String("vendor-id", "0x0", "VID of the camera to search (in hex), default=0x0 (all)")
 	productID := flag.String("product-id", "0x0", "PID of the camera to search (in hex), default=0x0 (all)")
+	ingestDir := flag.String("ingest-dir", "", "copy newly shot JPEG/NEF images into the directory")
+	ingestTemplate := flag.String("ingest-template", mtp.DefaultIngestTemplate, "path of ingested images: {date}, {time}, {serial}, {seq}, {name}, {base} and {ext} are expanded")
+	ingestDelete := flag.Bool("ingest-delete", false, "delete ingested images from the card after copying")
+	ingestWebhook := flag.String("ingest-webhook", "", "URL to POST a JSON notification to for every ingested image")
+	batteryAlerts := flag.String("battery-alerts", "20,10,5", "comma-separated battery levels in percent to warn at, empty to disable")
+	batteryWebhook := flag.String("battery-webhook", "", "URL to POST a JSON notification to when the battery level reaches -battery-alerts")
+	stackDir := flag.String("stack-dir", "stacks", "directory to save focus stacks into")
+	bracketDir := flag.String("bracket-dir", "brackets", "directory to save exposure brackets into")
 	maxResolution := flag.Bool("max-resolution", false, "change the resolution to the max (experimental)")
+	modelFile := flag.String("model-file", "", "JSON file to add or override camera models")
+	presetFile := flag.String("preset-file", "", "JSON file to load and save property presets")
+	preset := flag.String("preset", "", "name of the preset to apply whenever live view starts")
+	authToken := flag.String("auth-token", "", "bearer token that grants the controller role")
+	authViewerToken := flag.String("auth-viewer-token", "", "bearer token that grants the viewer role")
+	authHtpasswd := flag.String("auth-htpasswd", "", "htpasswd-style file for HTTP basic auth (user:hash[:viewer|controller])")
+	allowedOrigins := flag.String("allowed-origins", "", "comma-separated list of origins allowed to open WebSockets and read responses cross-origin, or * for any")
+	tlsCert := flag.String("tls-cert", "", "certificate file to serve HTTPS/WSS")
+	tlsKey := flag.String("tls-key", "", "private key file to serve HTTPS/WSS")
+	tlsSelfSigned := flag.Bool("tls-self-signed", false, "generate a self-signed certificate into -tls-cert/-tls-key if they don't exist")
 
 	flag.Parse()
 
-	debugs := map[string]bool{}
-	for _, s := range strings.Split(*debug, ",") {
-		debugs[s] = true
+	log := logging.GetLogger().Main
+
+	if *logFile != "" {
+		rf, err := logging.NewRotatingFile(*logFile, *logMaxSize*1024*1024, *logMaxBackups)
+		if err != nil {
+			log.Fatalf("failed to open log file: %s", err)
+		}
+		defer rf.Close()
+		logging.SetOutput(rf)
 	}
 
-	logging.SetLogLevel(debugs["main"], debugs["usb"], debugs["mtp"], debugs["data"], debugs["server"])
-	log := logging.GetLogger().Main
+	if err := logging.SetFormat(*logFormat); err != nil {
+		log.Fatalf("failed to set log format: %s", err)
+	}
+
+	if err := logging.SetLogLevels(*logLevel); err != nil {
+		log.Fatalf("failed to parse log level: %s", err)
+	}
+	logging.EnableDebug(strings.Split(*debug, ",")...)
 
 	vid, err := strconv.ParseInt(strings.ReplaceAll(*vendorID, "0x", ""), 16, 64)
 	if err != nil {
@@ -56,12 +103,92 @@ func main() {
 		log.Fatalf("failed to parse PID: %s", err)
 	}
 
+	if *modelFile != "" {
+		err = mtp.LoadModels(*modelFile)
+		if err != nil {
+			log.Fatalf("failed to load models: %s", err)
+		}
+	}
+
+	var thresholds []int
+	for _, t := range strings.Split(*batteryAlerts, ",") {
+		if t = strings.TrimSpace(t); t == "" {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(t, "%"))
+		if err != nil || n < 0 || n > 100 {
+			log.Fatalf("invalid battery level in -battery-alerts: %s", t)
+		}
+		thresholds = append(thresholds, n)
+	}
+
+	presets, err := mtp.LoadPresetStore(*presetFile)
+	if err != nil {
+		log.Fatalf("failed to load presets: %s", err)
+	}
+
+	if _, ok := presets.Get(*preset); *preset != "" && !ok {
+		log.Fatalf("preset %s is not found in %s", *preset, *presetFile)
+	}
+
+	authn := auth.NewAuthenticator()
+	if *authToken != "" {
+		authn.AddToken(*authToken, auth.RoleController)
+	}
+	if *authViewerToken != "" {
+		authn.AddToken(*authViewerToken, auth.RoleViewer)
+	}
+	if *authHtpasswd != "" {
+		if err = authn.LoadHtpasswd(*authHtpasswd); err != nil {
+			log.Fatalf("failed to load htpasswd: %s", err)
+		}
+	}
+	if !authn.Enabled() && *host != "localhost" {
+		log.Warning("authentication is disabled; anyone who can reach the server can control the camera")
+	}
+
+	if *tlsSelfSigned {
+		if *tlsCert == "" {
+			*tlsCert = "mtplvcap-cert.pem"
+		}
+		if *tlsKey == "" {
+			*tlsKey = "mtplvcap-key.pem"
+		}
+
+		hosts := []string{*host, "localhost", "127.0.0.1", "::1"}
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts, hostname)
+		}
+
+		generated, err := tlscert.EnsureSelfSigned(*tlsCert, *tlsKey, hosts)
+		if err != nil {
+			log.Fatalf("failed to generate a self-signed certificate: %s", err)
+		} else if generated {
+			log.Infof("generated a self-signed certificate: %s", *tlsCert)
+		}
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		log.Fatal("both -tls-cert and -tls-key must be specified")
+	}
+
+	var origins []string
+	if *allowedOrigins != "" {
+		origins = strings.Split(*allowedOrigins, ",")
+	}
+	originPolicy := auth.NewOriginPolicy(origins)
+
 	var dev mtp.Device
 
+	if *backendGo {
+		*backend = "gousb"
+	}
+
 	if *serverOnly {
 		log.Info("server-only mode is activated, skipping USB initialization")
 	} else {
-		if *backendGo {
+		switch *backend {
+		case "gousb":
 			ctx := gousb.NewContext()
 			defer ctx.Close()
 
@@ -71,13 +198,23 @@ func main() {
 			}
 			defer devGo.Close()
 			dev = devGo
-		} else {
+		case "ptpip":
+			if *addr == "" {
+				log.Fatal("-addr is required for -backend ptpip")
+			}
+
+			devIP := mtp.NewDevicePTPIP(*addr)
+			defer devIP.Close()
+			dev = devIP
+		case "direct":
 			devDirect, err := mtp.SelectDeviceDirect(uint16(vid), uint16(pid))
 			if err != nil {
 				log.Fatalf("failed to detect MTP devices: %v", err)
 			}
 			defer devDirect.Close()
 			dev = devDirect
+		default:
+			log.Fatalf("unknown backend: %s", *backend)
 		}
 
 		if err = dev.Configure(); err != nil {
@@ -101,31 +238,69 @@ func main() {
 		}
 	})
 
-	lvs := mtp.NewLVServer(ctx, dev, *maxResolution)
+	lvs := mtp.NewLVServer(ctx, dev, *maxResolution, presets, *preset, originPolicy.Allowed)
+	if *ingestDir != "" {
+		lvs.EnableIngest(mtp.IngestConfig{
+			Dir:      *ingestDir,
+			Template: *ingestTemplate,
+			Delete:   *ingestDelete,
+			Webhook:  *ingestWebhook,
+		})
+	}
+	lvs.SetStackDir(*stackDir)
+	lvs.SetBracketDir(*bracketDir)
+	lvs.SetPowerAlerts(mtp.PowerConfig{Thresholds: thresholds, Webhook: *batteryWebhook})
 	eg.Go(lvs.Run)
 
+	viewer := func(h http.Handler) http.Handler { return authn.Require(auth.RoleViewer, h) }
+	controller := func(h http.Handler) http.Handler { return authn.Require(auth.RoleController, h) }
+
 	router := http.NewServeMux()
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	router.Handle("/", controller(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		f, _ := public.Root.Open("/controller.html")
 		_, _ = io.Copy(w, f)
-	})
-	router.HandleFunc("/view", func(w http.ResponseWriter, r *http.Request) {
+	})))
+	router.Handle("/view", viewer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		f, _ := public.Root.Open("/index.html")
 		_, _ = io.Copy(w, f)
-	})
-	router.HandleFunc("/mjpeg", lvs.HandleMotionJPEG)
-	router.HandleFunc("/snapshot", lvs.HandleSnapshot)
-	router.HandleFunc("/stream", lvs.HandleStream)
-	router.HandleFunc("/control", lvs.HandleControl)
+	})))
+	router.Handle("/storage", controller(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _ := public.Root.Open("/storage.html")
+		_, _ = io.Copy(w, f)
+	})))
+	router.Handle("/mjpeg", viewer(http.HandlerFunc(lvs.HandleMotionJPEG)))
+	router.Handle("/snapshot", viewer(http.HandlerFunc(lvs.HandleSnapshot)))
+	router.Handle("/stream", viewer(http.HandlerFunc(lvs.HandleStream)))
+	router.Handle("/control", controller(http.HandlerFunc(lvs.HandleControl)))
+	router.Handle("/ingest", controller(http.HandlerFunc(lvs.HandleIngest)))
+	router.Handle("/api/status", viewer(http.HandlerFunc(lvs.HandleStatus)))
+	router.Handle("/api/events", viewer(http.HandlerFunc(lvs.HandleEvents)))
+	router.Handle(mtp.ControlSchemaPath, viewer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, _ := public.Root.Open("/schema/control.json")
+		w.Header().Set("Content-Type", "application/schema+json")
+		_, _ = io.Copy(w, f)
+	})))
+	router.Handle("/api/picture-controls", controller(http.HandlerFunc(lvs.HandlePictureControls)))
+	router.Handle("/api/picture-controls/", controller(http.HandlerFunc(lvs.HandlePictureControls)))
+	router.Handle("/api/storage", controller(http.HandlerFunc(lvs.HandleStorage)))
+	router.Handle("/api/objects", controller(http.HandlerFunc(lvs.HandleObjects)))
+	router.Handle("/api/objects/", controller(http.HandlerFunc(lvs.HandleObject)))
 	router.Handle("/assets/", http.FileServer(public.Root))
 
 	srv := http.Server{
 		Addr:    fmt.Sprintf("%s:%d", *host, *port),
-		Handler: logging.HTTPLogHandler(router),
+		Handler: logging.HTTPLogHandler(originPolicy.CORS(router)),
 	}
 
 	eg.Go(func() error {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if *tlsCert != "" {
+			log.Infof("serving HTTPS on %s", srv.Addr)
+			err = srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Errorf("http server returned an error: %s", err)
 			return err
 		}
@@ -136,7 +311,8 @@ func main() {
 		select {
 		case <-ctx.Done():
 		}
-		ctx, _ := context.WithTimeout(context.Background(), 3*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
 		return srv.Shutdown(ctx)
 	})
 
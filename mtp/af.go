@@ -0,0 +1,130 @@
+package mtp
+
+import (
+	"time"
+)
+
+// afModeInterval is the interval to read the AF mode and area, which change
+// whenever the AF switch of the body is turned.
+const afModeInterval = 2 * time.Second
+
+// Names of the values of the AF properties. Values missing here are named in
+// hex, e.g. the AF areas only newer bodies have.
+var (
+	focusModeNames = map[uint64]string{
+		0x0001: "MF",
+		0x0002: "AF",
+		0x0003: "AF macro",
+		0x8010: "AF-S",
+		0x8011: "AF-C",
+		0x8012: "AF-A",
+		0x8013: "AF-F",
+	}
+	nikonAFModeNames = map[uint64]string{
+		0: "AF-S",
+		1: "AF-C",
+		2: "AF-A",
+		3: "MF (fixed)",
+		4: "MF (selection)",
+	}
+	nikonLiveViewAFFocusNames = map[uint64]string{
+		0: "AF-S",
+		1: "AF-C",
+		2: "AF-F",
+		3: "MF (fixed)",
+		4: "MF (selection)",
+	}
+	nikonLiveViewAFAreaNames = map[uint64]string{
+		0: "face priority",
+		1: "wide area",
+		2: "normal area",
+		3: "subject tracking",
+	}
+)
+
+// afContinuous are the AF modes in which the camera keeps focusing by itself.
+// Z bodies use AF-C in live view, and D bodies AF-F.
+var afContinuous = map[string]bool{
+	"AF-C": true,
+	"AF-F": true,
+}
+
+// afModeProp returns the property which selects the AF mode, preferring the
+// one for live view. Only one of them is exposed since only one takes effect
+// in live view: bodies with DPC_NIKON_LiveViewAFFocus ignore the AF mode of
+// the viewfinder there, and DPC_FocusMode is the standard mirror of
+// DPC_NIKON_AutofocusMode on bodies having neither.
+func (s *LVServer) afModeProp() (namedProp, bool) {
+	if _, ok := s.driver.(*nikonDriver); !ok {
+		return namedProp{}, false
+	}
+
+	switch {
+	case s.caps.prop(DPC_NIKON_LiveViewAFFocus):
+		return namedProp{DPC_NIKON_LiveViewAFFocus, nikonLiveViewAFFocusNames}, true
+	case s.caps.prop(DPC_NIKON_AutofocusMode):
+		return namedProp{DPC_NIKON_AutofocusMode, nikonAFModeNames}, true
+	case s.caps.prop(DPC_FocusMode):
+		return namedProp{DPC_FocusMode, focusModeNames}, true
+	}
+	return namedProp{}, false
+}
+
+// afAreaProp returns the property which selects the AF area in live view,
+// including face priority and subject tracking.
+func (s *LVServer) afAreaProp() (namedProp, bool) {
+	_, ok := s.driver.(*nikonDriver)
+	return namedProp{DPC_NIKON_LiveViewAFArea, nikonLiveViewAFAreaNames}, ok && s.caps.prop(DPC_NIKON_LiveViewAFArea)
+}
+
+// refreshAF reads the AF mode and area into InfoPayload.
+func (s *LVServer) refreshAF(prio Priority) {
+	var modes, areas []string
+	var mode, area string
+
+	if s.dummy {
+		modes, mode = []string{"AF-S", "AF-C", "AF-F"}, "AF-S"
+		areas, area = []string{"face priority", "wide area", "normal area"}, "wide area"
+	}
+
+	var err error
+	if p, ok := s.afModeProp(); ok && !s.dummy {
+		modes, mode, _, err = s.getNamedProp(prio, p)
+		if err != nil {
+			log.LV.Warningf("failed to get the AF mode: %s", err)
+		}
+	}
+	if p, ok := s.afAreaProp(); ok && !s.dummy {
+		areas, area, _, err = s.getNamedProp(prio, p)
+		if err != nil {
+			log.LV.Warningf("failed to get the AF area: %s", err)
+		}
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.info.AFMode, s.info.AFModes = mode, modes
+	s.info.AFArea, s.info.AFAreas = area, areas
+}
+
+// continuousAF reports whether the camera focuses by itself, which makes the
+// periodic AF needless.
+func (s *LVServer) continuousAF() bool {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	return afContinuous[s.info.AFMode]
+}
+
+func (s *LVServer) workerAFMode() error {
+	tick := time.NewTicker(afModeInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+		s.refreshAF(PriorityBackground)
+	}
+}
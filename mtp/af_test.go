@@ -0,0 +1,60 @@
+package mtp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestAF(t *testing.T) {
+	// The live view AF properties of a D-series body.
+	dev := &propDevice{props: map[uint16]*fakeProp{
+		DPC_NIKON_LiveViewAFFocus: {dataType: DTC_UINT8, settable: true, values: []uint64{0, 2, 4}, current: 0},
+		DPC_NIKON_LiveViewAFArea:  {dataType: DTC_UINT8, settable: true, values: []uint64{0, 1, 2, 3, 7}, current: 1},
+	}}
+	s := &LVServer{
+		dev:    dev,
+		driver: &nikonDriver{dev: dev, props: newPropAccessor(dev)},
+		caps:   capabilities{props: map[uint16]bool{DPC_NIKON_LiveViewAFFocus: true, DPC_NIKON_LiveViewAFArea: true}},
+		sched:  NewScheduler(),
+		ctx:    context.Background(),
+	}
+
+	s.refreshAF(PriorityUser)
+	if expected := []string{"AF-S", "AF-F", "MF (selection)"}; s.info.AFMode != "AF-S" || !reflect.DeepEqual(s.info.AFModes, expected) {
+		t.Errorf("got %s of %v, expected AF-S of %v", s.info.AFMode, s.info.AFModes, expected)
+	}
+	if expected := []string{"face priority", "wide area", "normal area", "subject tracking", "0x7"}; s.info.AFArea != "wide area" || !reflect.DeepEqual(s.info.AFAreas, expected) {
+		t.Errorf("got %s of %v, expected wide area of %v", s.info.AFArea, s.info.AFAreas, expected)
+	}
+	if s.continuousAF() {
+		t.Error("AF-S is not continuous")
+	}
+
+	mode, _ := s.afModeProp()
+	err := s.setNamedProp(s.sched.Enqueue(PriorityUser, "af_mode"), mode, "AF-F")
+	if err != nil || dev.props[DPC_NIKON_LiveViewAFFocus].current != 2 {
+		t.Errorf("got %d, %v", dev.props[DPC_NIKON_LiveViewAFFocus].current, err)
+	}
+	area, _ := s.afAreaProp()
+	err = s.setNamedProp(s.sched.Enqueue(PriorityUser, "af_area"), area, "face priority")
+	if err != nil || dev.props[DPC_NIKON_LiveViewAFArea].current != 0 {
+		t.Errorf("got %d, %v", dev.props[DPC_NIKON_LiveViewAFArea].current, err)
+	}
+	err = s.setNamedProp(s.sched.Enqueue(PriorityUser, "af_mode"), mode, "AF-C")
+	if err == nil {
+		t.Error("AF-C is not available")
+	}
+
+	s.refreshAF(PriorityUser)
+	if s.info.AFMode != "AF-F" || s.info.AFArea != "face priority" || !s.continuousAF() {
+		t.Errorf("got %s, %s", s.info.AFMode, s.info.AFArea)
+	}
+
+	// Z bodies keep focusing in AF-C, which is set on the body.
+	dev.props[DPC_NIKON_LiveViewAFFocus].current = 1
+	s.refreshAF(PriorityBackground)
+	if s.info.AFMode != "AF-C" || !s.continuousAF() {
+		t.Errorf("got %s", s.info.AFMode)
+	}
+}
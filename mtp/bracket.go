@@ -0,0 +1,381 @@
+package mtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// maxBracketShots is the largest number of shots in a bracket.
+	maxBracketShots = 9
+	// fuseMaxSize is the longest side of the merged preview.
+	fuseMaxSize = 2048
+	// fuseSigma is the spread of the well-exposedness weight.
+	fuseSigma = 0.2
+)
+
+// BracketRequest starts an exposure bracket. Shots frames are taken around
+// the current exposure compensation, Step EV apart.
+type BracketRequest struct {
+	Shots int     `json:"shots"`
+	Step  float64 `json:"step"`
+	// Merge saves preview.jpg blended from the JPEG frames.
+	Merge bool `json:"merge,omitempty"`
+}
+
+// BracketFrame is a shot of a bracket.
+type BracketFrame struct {
+	Index    int       `json:"index"`
+	Bias     float64   `json:"bias"`
+	Files    []string  `json:"files"`
+	Captured time.Time `json:"captured"`
+}
+
+// BracketSet is saved as bracket.json next to the frames.
+type BracketSet struct {
+	Camera   string         `json:"camera"`
+	Request  BracketRequest `json:"request"`
+	Started  time.Time      `json:"started"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Frames   []BracketFrame `json:"frames"`
+	Preview  string         `json:"preview,omitempty"`
+}
+
+// BracketProgress is the progress of the running or the last bracket.
+type BracketProgress struct {
+	// State is one of running, done, failed and canceled.
+	State   string   `json:"state"`
+	Shot    int      `json:"shot"`
+	Shots   int      `json:"shots"`
+	Bias    float64  `json:"bias"`
+	Dir     string   `json:"dir,omitempty"`
+	Files   []string `json:"files,omitempty"`
+	Preview string   `json:"preview,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// SetBracketDir sets the directory to save brackets into.
+func (s *LVServer) SetBracketDir(dir string) {
+	s.bracketDir = dir
+}
+
+// plan returns the exposure compensation of each shot in 1/1000 EV, picking
+// the nearest of the allowed values around base.
+func (r BracketRequest) plan(base int, allowed []int) ([]int, error) {
+	if r.Shots < 2 || r.Shots > maxBracketShots {
+		return nil, fmt.Errorf("shots must be between 2 and %d", maxBracketShots)
+	}
+	if r.Step <= 0 {
+		return nil, errors.New("the step must be positive")
+	}
+	if len(allowed) == 0 {
+		return nil, errors.New("the camera reports no exposure compensation")
+	}
+
+	biases := make([]int, r.Shots)
+	for i := range biases {
+		target := base + int(math.Round((float64(i)-float64(r.Shots-1)/2)*r.Step*1000))
+		if target < allowed[0] || target > allowed[len(allowed)-1] {
+			return nil, fmt.Errorf("%+.1f EV is out of the exposure compensation range", float64(target)/1000)
+		}
+
+		nearest := allowed[0]
+		for _, v := range allowed {
+			if abs(v-target) < abs(nearest-target) {
+				nearest = v
+			}
+		}
+		if i > 0 && nearest == biases[i-1] {
+			return nil, fmt.Errorf("the step %.2f EV is finer than the camera allows", r.Step)
+		}
+		biases[i] = nearest
+	}
+	return biases, nil
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// exposureBiases returns the available exposure compensations in 1/1000 EV
+// and the current one.
+func (n *nikonDriver) exposureBiases(ctx context.Context) ([]int, int, error) {
+	desc := DevicePropDesc{}
+	err := n.dev.GetDevicePropDescContext(ctx, DPC_ExposureBiasCompensation, &desc)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get exposure compensation: %s", err)
+	}
+
+	// The property is INT16.
+	toInt := func(v interface{}) int {
+		u, _ := propUint(v)
+		return int(int16(u))
+	}
+
+	var values []int
+	switch f := desc.Form.(type) {
+	case *PropDescEnumForm:
+		for _, v := range f.Values {
+			values = append(values, toInt(v))
+		}
+	case *PropDescRangeForm:
+		min, max, step := toInt(f.MinimumValue), toInt(f.MaximumValue), toInt(f.StepSize)
+		if step <= 0 {
+			return nil, 0, fmt.Errorf("invalid step of exposure compensation: %d", step)
+		}
+		for v := min; v <= max; v += step {
+			values = append(values, v)
+		}
+	default:
+		return nil, 0, errors.New("unexpected form of exposure compensation")
+	}
+	sort.Ints(values)
+	return values, toInt(desc.CurrentValue), nil
+}
+
+// compensates reports whether the exposure compensation changes the
+// exposure, which it doesn't in M without auto ISO.
+func (n *nikonDriver) compensates(ctx context.Context) (bool, error) {
+	if !n.caps.prop(DPC_ExposureProgramMode) {
+		return true, nil
+	}
+	program, err := n.props.getUint(ctx, DPC_ExposureProgramMode)
+	if err != nil {
+		return false, err
+	} else if exposureProgramNames[program] != "M" {
+		return true, nil
+	}
+
+	for _, code := range []uint16{DPC_NIKON_ISO_Auto, DPC_NIKON_ISOAuto} {
+		if n.caps.prop(code) {
+			auto, err := n.props.getUint(ctx, code)
+			return auto != 0, err
+		}
+	}
+	return false, nil
+}
+
+func (s *LVServer) setBracket(p BracketProgress) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.info.Bracket = &p
+}
+
+// startBracket starts an exposure bracket in the background.
+func (s *LVServer) startBracket(req BracketRequest) error {
+	n, ok := s.captureDriver()
+	if !ok || !s.caps.prop(DPC_ExposureBiasCompensation) {
+		return errors.New("the camera doesn't support bracketing")
+	}
+
+	var allowed []int
+	var base int
+	var compensates bool
+	err := s.withDevice(PriorityUser, func() (err error) {
+		compensates, err = n.compensates(s.ctx)
+		if err == nil {
+			allowed, base, err = n.exposureBiases(s.ctx)
+		}
+		return
+	})
+	if err != nil {
+		return err
+	} else if !compensates {
+		return errors.New("exposure compensation has no effect in M without auto ISO")
+	}
+	biases, err := req.plan(base, allowed)
+	if err != nil {
+		return err
+	}
+
+	ctx, err := s.seq.begin(s.ctx, seqBracket)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.bracketDir, time.Now().Format("bracket-20060102-150405"))
+	s.setBracket(BracketProgress{State: "running", Shots: req.Shots, Dir: dir})
+	go func() {
+		defer s.seq.end()
+		set, err := s.runBracket(ctx, n, req, biases, dir)
+
+		// Restore the exposure even if the bracket is canceled.
+		rerr := s.withDevice(PriorityUser, func() error {
+			return n.props.setUint(s.ctx, DPC_ExposureBiasCompensation, uint64(base))
+		})
+		if rerr != nil {
+			log.LV.Warningf("bracket: failed to restore the exposure compensation: %s", rerr)
+		}
+
+		s.infoLock.Lock()
+		p := *s.info.Bracket
+		s.infoLock.Unlock()
+		p.Files, p.Preview = nil, set.Preview
+		for _, f := range set.Frames {
+			p.Files = append(p.Files, f.Files...)
+		}
+		if ctx.Err() != nil {
+			p.State = "canceled"
+		} else if err != nil {
+			p.State, p.Error = "failed", err.Error()
+			log.LV.Errorf("bracket: %s", err)
+		} else {
+			p.State = "done"
+			log.LV.Infof("bracket: saved %d shots to %s", req.Shots, dir)
+		}
+		s.setBracket(p)
+	}()
+	return nil
+}
+
+func (s *LVServer) runBracket(ctx context.Context, n *nikonDriver, req BracketRequest, biases []int, dir string) (BracketSet, error) {
+	set := BracketSet{
+		Camera:  n.Name(),
+		Request: req,
+		Started: time.Now(),
+		Frames:  []BracketFrame{},
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return set, err
+	}
+
+	for i, b := range biases {
+		bias := float64(b) / 1000
+		s.setBracket(BracketProgress{State: "running", Shot: i, Shots: len(biases), Bias: bias, Dir: dir})
+
+		err = s.withDevice(PriorityUser, func() error {
+			return n.props.setUint(ctx, DPC_ExposureBiasCompensation, uint64(b))
+		})
+		if err != nil {
+			return set, err
+		}
+
+		frame := BracketFrame{Index: i + 1, Bias: bias, Captured: time.Now()}
+		frame.Files, err = s.captureStill(ctx, n, dir, fmt.Sprintf("%04d_", frame.Index))
+		if err != nil {
+			return set, err
+		}
+
+		set.Frames = append(set.Frames, frame)
+		err = writeSetJSON(dir, "bracket.json", set)
+		if err != nil {
+			return set, err
+		}
+	}
+	s.setBracket(BracketProgress{State: "running", Shot: len(biases), Shots: len(biases), Dir: dir})
+
+	if req.Merge {
+		err = mergeBracket(dir, set.Frames)
+		if err != nil {
+			log.LV.Warningf("bracket: failed to merge the shots: %s", err)
+		} else {
+			set.Preview = "preview.jpg"
+		}
+	}
+
+	finished := time.Now()
+	set.Finished = &finished
+	return set, writeSetJSON(dir, "bracket.json", set)
+}
+
+// mergeBracket blends the JPEG of each frame into preview.jpg.
+func mergeBracket(dir string, frames []BracketFrame) error {
+	var images []image.Image
+	for _, f := range frames {
+		for _, name := range f.Files {
+			ext := strings.ToLower(filepath.Ext(name))
+			if ext != ".jpg" && ext != ".jpeg" {
+				continue
+			}
+
+			img, err := readJPEG(filepath.Join(dir, name))
+			if err != nil {
+				return fmt.Errorf("failed to decode %s: %s", name, err)
+			}
+			images = append(images, img)
+			break
+		}
+	}
+	if len(images) < 2 {
+		return errors.New("JPEG images are required, set the image quality to JPEG or RAW+JPEG")
+	}
+
+	fused, err := fuseExposures(images)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, "preview.jpg"))
+	if err != nil {
+		return err
+	}
+	err = jpeg.Encode(f, fused, &jpeg.Options{Quality: 90})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func readJPEG(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+// fuseExposures blends the images weighting each pixel by how close it is to
+// the middle gray, a simplified exposure fusion. The result is downscaled so
+// that the long side is at most fuseMaxSize.
+func fuseExposures(images []image.Image) (*image.RGBA, error) {
+	b := images[0].Bounds()
+	for _, img := range images[1:] {
+		if img.Bounds().Size() != b.Size() {
+			return nil, errors.New("the images differ in size")
+		}
+	}
+
+	scale := 1
+	for b.Dx()/scale > fuseMaxSize || b.Dy()/scale > fuseMaxSize {
+		scale++
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, b.Dx()/scale, b.Dy()/scale))
+	for y := 0; y < out.Rect.Dy(); y++ {
+		for x := 0; x < out.Rect.Dx(); x++ {
+			var r, g, bl, sum float64
+			for _, img := range images {
+				ib := img.Bounds()
+				cr, cg, cb, _ := img.At(ib.Min.X+x*scale, ib.Min.Y+y*scale).RGBA()
+				fr, fg, fb := float64(cr)/0xFFFF, float64(cg)/0xFFFF, float64(cb)/0xFFFF
+
+				l := 0.299*fr + 0.587*fg + 0.114*fb
+				w := math.Exp(-(l-0.5)*(l-0.5)/(2*fuseSigma*fuseSigma)) + 1e-6
+				r, g, bl, sum = r+w*fr, g+w*fg, bl+w*fb, sum+w
+			}
+			out.SetRGBA(x, y, color.RGBA{
+				R: uint8(r/sum*255 + 0.5),
+				G: uint8(g/sum*255 + 0.5),
+				B: uint8(bl/sum*255 + 0.5),
+				A: 0xFF,
+			})
+		}
+	}
+	return out, nil
+}
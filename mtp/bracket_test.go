@@ -0,0 +1,98 @@
+package mtp
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestBracketPlan(t *testing.T) {
+	// -1 to +1 EV in 1/3 EV.
+	allowed := []int{-1000, -666, -333, 0, 333, 666, 1000}
+
+	biases, err := BracketRequest{Shots: 3, Step: 1}.plan(0, allowed)
+	if expected := []int{-1000, 0, 1000}; err != nil || !reflect.DeepEqual(biases, expected) {
+		t.Errorf("got %v, %v, expected %v", biases, err, expected)
+	}
+
+	biases, err = BracketRequest{Shots: 2, Step: 2.0 / 3}.plan(-333, allowed)
+	if expected := []int{-666, 0}; err != nil || !reflect.DeepEqual(biases, expected) {
+		t.Errorf("got %v, %v, expected %v", biases, err, expected)
+	}
+
+	for _, r := range []BracketRequest{
+		{Shots: 1, Step: 1},
+		{Shots: 3, Step: 0},
+		{Shots: 5, Step: 1},
+		{Shots: 3, Step: 0.1},
+	} {
+		if biases, err := r.plan(0, allowed); err == nil {
+			t.Errorf("%+v should be rejected, got %v", r, biases)
+		}
+	}
+}
+
+func TestCompensates(t *testing.T) {
+	dev := &propDevice{props: map[uint16]*fakeProp{
+		DPC_ExposureProgramMode: {dataType: DTC_UINT16},
+		DPC_NIKON_ISO_Auto:      {dataType: DTC_UINT8},
+	}}
+	n := &nikonDriver{
+		dev:   dev,
+		props: newPropAccessor(dev),
+		caps:  capabilities{props: map[uint16]bool{DPC_ExposureProgramMode: true, DPC_NIKON_ISO_Auto: true}},
+	}
+
+	for _, tc := range []struct {
+		program, auto uint64
+		expected      bool
+	}{
+		{3, 0, true},      // A
+		{0x8010, 0, true}, // auto
+		{1, 0, false},     // M
+		{1, 1, true},      // M with auto ISO
+	} {
+		dev.props[DPC_ExposureProgramMode].current = tc.program
+		dev.props[DPC_NIKON_ISO_Auto].current = tc.auto
+		ok, err := n.compensates(context.Background())
+		if err != nil || ok != tc.expected {
+			t.Errorf("program 0x%X, auto ISO %d: got %v, %v", tc.program, tc.auto, ok, err)
+		}
+	}
+}
+
+func TestFuseExposures(t *testing.T) {
+	fill := func(w, h int, v uint8) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				img.SetRGBA(x, y, color.RGBA{v, v, v, 0xFF})
+			}
+		}
+		return img
+	}
+
+	fused, err := fuseExposures([]image.Image{fill(8, 6, 10), fill(8, 6, 128), fill(8, 6, 250)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fused.Rect.Dx() != 8 || fused.Rect.Dy() != 6 {
+		t.Errorf("got size %v", fused.Rect)
+	}
+	// The well exposed frame dominates.
+	if v := fused.RGBAAt(3, 3).R; v < 110 || v > 140 {
+		t.Errorf("got %d", v)
+	}
+
+	fused, err = fuseExposures([]image.Image{fill(4100, 10, 0), fill(4100, 10, 0)})
+	if err != nil || fused.Rect.Dx() > fuseMaxSize {
+		t.Errorf("got %v, %v", fused.Rect, err)
+	}
+
+	_, err = fuseExposures([]image.Image{fill(8, 6, 0), fill(6, 8, 0)})
+	if err == nil {
+		t.Error("images of different sizes should be rejected")
+	}
+}
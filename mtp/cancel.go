@@ -0,0 +1,136 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Still Image Class requests (PIMA 15740 USB transport, section 5.2)
+const (
+	usbReqTypeClassOut    = 0x21 // host to device, class, interface
+	usbReqTypeClassIn     = 0xA1 // device to host, class, interface
+	usbReqCancel          = 0x64
+	usbReqGetDeviceStatus = 0x67
+)
+
+// DefaultOpTimeout is the timeout of operations missing in opTimeouts.
+const DefaultOpTimeout = 5 * time.Second
+
+// cancelTimeout bounds the time to wait for the device to be ready after
+// cancelling a transaction.
+const cancelTimeout = 3 * time.Second
+
+// liveViewTimeout bounds fetching a live view frame with GetObject, which
+// otherwise has the long timeout for files.
+const liveViewTimeout = 3 * time.Second
+
+var opTimeouts = map[uint16]time.Duration{
+	OC_GetObject:                5 * time.Minute,
+	OC_GetPartialObject:         time.Minute,
+	OC_MTP_GetPartialObject64:   time.Minute,
+	OC_SendObject:               5 * time.Minute,
+	OC_DeleteObject:             30 * time.Second,
+	OC_FormatStore:              2 * time.Minute,
+	OC_InitiateCapture:          30 * time.Second,
+	OC_NIKON_AfDrive:            10 * time.Second,
+	OC_NIKON_StartLiveView:      10 * time.Second,
+	OC_NIKON_EndLiveView:        10 * time.Second,
+	OC_NIKON_GetLiveViewImg:     3 * time.Second,
+	OC_NIKON_GetPartialObjectEx: time.Minute,
+
+	OC_CANON_EOS_DoAf:               10 * time.Second,
+	OC_CANON_EOS_GetViewFinderData:  3 * time.Second,
+	OC_CANON_EOS_GetPartialObject64: time.Minute,
+}
+
+// DefaultTimeout returns the time an operation is allowed to take when the
+// context passed to the device has no deadline.
+func DefaultTimeout(code uint16) time.Duration {
+	if t, ok := opTimeouts[code]; ok {
+		return t
+	}
+	return DefaultOpTimeout
+}
+
+// withOpTimeout applies the default timeout of the operation unless ctx
+// already has a deadline.
+func withOpTimeout(ctx context.Context, code uint16) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, DefaultTimeout(code))
+}
+
+func logAborted(code uint16, err error) {
+	if err == context.DeadlineExceeded {
+		log.MTP.Warningf("%s timed out, cancelling", getName(OC_names, int(code)))
+	} else {
+		log.MTP.Debugf("%s aborted: %s, cancelling", getName(OC_names, int(code)), err)
+	}
+}
+
+// cancelRequestData is the data stage of the Cancel class request.
+func cancelRequestData(tid uint32) []byte {
+	data := make([]byte, 6)
+	byteOrder.PutUint16(data, EC_CancelTransaction)
+	byteOrder.PutUint32(data[2:], tid)
+	return data
+}
+
+// deviceStatus is the response of the GetDeviceStatus class request.
+// Params holds the endpoints to be cleared by the host, if any.
+type deviceStatus struct {
+	Code   uint16
+	Params []uint32
+}
+
+func decodeDeviceStatus(buf []byte) (deviceStatus, error) {
+	if len(buf) < 4 {
+		return deviceStatus{}, fmt.Errorf("short device status: %d bytes", len(buf))
+	}
+
+	length := int(byteOrder.Uint16(buf))
+	if length < 4 || length > len(buf) {
+		return deviceStatus{}, fmt.Errorf("invalid device status length: %d", length)
+	}
+
+	st := deviceStatus{Code: byteOrder.Uint16(buf[2:])}
+	for i := 4; i+4 <= length; i += 4 {
+		st.Params = append(st.Params, byteOrder.Uint32(buf[i:]))
+	}
+	return st, nil
+}
+
+// waitDeviceReady polls the device status after a cancellation until the
+// device reports OK. Endpoints reported in the status are passed to
+// clearHalt before polling again.
+func waitDeviceReady(getStatus func() (deviceStatus, error), clearHalt func(ep byte) error) error {
+	deadline := time.Now().Add(cancelTimeout)
+
+	for {
+		st, err := getStatus()
+		if err != nil {
+			return fmt.Errorf("failed to get device status: %s", err)
+		}
+
+		if st.Code == RC_OK {
+			return nil
+		}
+
+		log.MTP.Debugf("device status %s %v", getName(RC_names, int(st.Code)), st.Params)
+		for _, ep := range st.Params {
+			err = clearHalt(byte(ep))
+			if err != nil {
+				return fmt.Errorf("failed to clear halt of endpoint 0x%x: %s", ep, err)
+			}
+		}
+
+		if st.Code != RC_DeviceBusy && st.Code != RC_TransactionCanceled {
+			return RCError(st.Code)
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("device is still busy after cancellation")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,128 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hanwen/usb"
+)
+
+func TestCancelRequestData(t *testing.T) {
+	got := cancelRequestData(0x12345678)
+	want := []byte{0x01, 0x40, 0x78, 0x56, 0x34, 0x12}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+}
+
+func TestDecodeDeviceStatus(t *testing.T) {
+	st, err := decodeDeviceStatus([]byte{0x0c, 0x00, 0x1f, 0x20, 0x81, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00, 0xff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := deviceStatus{Code: RC_TransactionCanceled, Params: []uint32{0x81, 0x02}}
+	if !reflect.DeepEqual(st, want) {
+		t.Errorf("got %#v, want %#v", st, want)
+	}
+
+	if _, err = decodeDeviceStatus([]byte{0x08, 0x00, 0x01, 0x20}); err == nil {
+		t.Error("length beyond the buffer should be rejected")
+	}
+}
+
+func TestWaitDeviceReady(t *testing.T) {
+	statuses := []deviceStatus{
+		{Code: RC_TransactionCanceled, Params: []uint32{0x81}},
+		{Code: RC_DeviceBusy},
+		{Code: RC_OK},
+	}
+	var cleared []byte
+
+	err := waitDeviceReady(func() (deviceStatus, error) {
+		st := statuses[0]
+		statuses = statuses[1:]
+		return st, nil
+	}, func(ep byte) error {
+		cleared = append(cleared, ep)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 0 || !bytes.Equal(cleared, []byte{0x81}) {
+		t.Errorf("unexpected polling: %d statuses left, cleared % x", len(statuses), cleared)
+	}
+
+	err = waitDeviceReady(func() (deviceStatus, error) {
+		return deviceStatus{Code: RC_GeneralError}, nil
+	}, nil)
+	if err != RCError(RC_GeneralError) {
+		t.Errorf("got %v, want %v", err, RCError(RC_GeneralError))
+	}
+}
+
+func TestWithOpTimeout(t *testing.T) {
+	ctx, cancel := withOpTimeout(context.Background(), OC_NIKON_GetLiveViewImg)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > DefaultTimeout(OC_NIKON_GetLiveViewImg) {
+		t.Errorf("unexpected deadline %v", deadline)
+	}
+
+	parent, cancelParent := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelParent()
+	ctx, cancel = withOpTimeout(parent, OC_NIKON_GetLiveViewImg)
+	defer cancel()
+	if d, _ := ctx.Deadline(); time.Until(d) < time.Minute {
+		t.Errorf("deadline of the parent should be kept, got %v", d)
+	}
+}
+
+func TestSliceTransfer(t *testing.T) {
+	// The device sends 3 bytes, pauses for longer than a slice and sends the
+	// rest in a short packet.
+	type result struct {
+		data []byte
+		err  error
+	}
+	timedOut := result{nil, usb.ERROR_TIMEOUT}
+	results := []result{{[]byte{1, 2, 3}, usb.ERROR_TIMEOUT}, timedOut, timedOut, {[]byte{4, 5}, nil}}
+	var timeouts []int
+	transfer := func(b []byte, timeout int) (int, error) {
+		timeouts = append(timeouts, timeout)
+		r := timedOut
+		if len(results) > 0 {
+			r, results = results[0], results[1:]
+		}
+		return copy(b, r.data), r.err
+	}
+
+	buf := make([]byte, 8)
+	n, err := sliceTransfer(context.Background(), 2000, buf, transfer)
+	if err != nil || !bytes.Equal(buf[:n], []byte{1, 2, 3, 4, 5}) {
+		t.Errorf("got % x, %v", buf[:n], err)
+	}
+	if !reflect.DeepEqual(timeouts, []int{200, 200, 200, 200}) {
+		t.Errorf("got timeouts %v", timeouts)
+	}
+
+	// A partial transfer is returned when the device stops.
+	results, timeouts = []result{{[]byte{1, 2, 3}, usb.ERROR_TIMEOUT}}, nil
+	n, err = sliceTransfer(context.Background(), 500, buf, transfer)
+	if err != nil || n != 3 {
+		t.Errorf("got %d, %v", n, err)
+	}
+	if !reflect.DeepEqual(timeouts, []int{200, 200, 200, 100}) {
+		t.Errorf("got timeouts %v", timeouts)
+	}
+
+	// Nothing transferred is a timeout.
+	results = nil
+	n, err = sliceTransfer(context.Background(), 500, buf, transfer)
+	if err != usb.ERROR_TIMEOUT || n != 0 {
+		t.Errorf("got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,249 @@
+package mtp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Parameters of OC_NIKON_InitiateCaptureRecInMedia which shoot to the card
+// without AF, so that the focus stays where it is.
+const (
+	captureNoAF      = 0xFFFFFFFE
+	captureMediaCard = 0
+)
+
+const (
+	// readyTimeout bounds waiting for the lens or a shot to finish.
+	readyTimeout = 10 * time.Second
+	// captureObjectTimeout bounds waiting for a shot to appear on the card.
+	captureObjectTimeout = 10 * time.Second
+)
+
+// Kinds of capture sequences.
+const (
+	seqStack   = "focus stack"
+	seqBracket = "bracket"
+)
+
+// sequence lets one capture sequence, a focus stack or a bracket, run at a
+// time.
+type sequence struct {
+	kind   string
+	cancel context.CancelFunc
+	// claimed holds the objects the sequences shot, which ingest leaves
+	// alone, until ingest has released them.
+	claimed map[uint32]bool
+	lock    sync.Mutex
+}
+
+// begin returns the context of a new sequence of the kind, or fails if one
+// is running.
+func (q *sequence) begin(parent context.Context, kind string) (context.Context, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.cancel != nil {
+		return nil, fmt.Errorf("a %s is already running", q.kind)
+	}
+
+	ctx, cancel := context.WithCancel(parent)
+	q.kind, q.cancel = kind, cancel
+	return ctx, nil
+}
+
+// claim marks the objects shot by the running sequence.
+func (q *sequence) claim(handles []uint32) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.claimed == nil {
+		q.claimed = map[uint32]bool{}
+	}
+	for _, h := range handles {
+		q.claimed[h] = true
+	}
+}
+
+// release reports whether the object was shot by a sequence, and forgets it.
+func (q *sequence) release(handle uint32) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	owned := q.claimed[handle]
+	delete(q.claimed, handle)
+	return owned
+}
+
+// end marks the running sequence finished.
+func (q *sequence) end() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.cancel = nil
+}
+
+// running reports whether a sequence is running.
+func (q *sequence) running() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.cancel != nil
+}
+
+// stop cancels the running sequence if it is of the kind.
+func (q *sequence) stop(kind string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.cancel != nil && q.kind == kind {
+		q.cancel()
+	}
+}
+
+// waitReady polls DeviceReady until the camera finishes the last operation.
+func (n *nikonDriver) waitReady(ctx context.Context) error {
+	if !n.caps.op(OC_NIKON_DeviceReady) {
+		return nil
+	}
+
+	deadline := time.Now().Add(readyTimeout)
+	for {
+		err := n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_DeviceReady)
+		if err != RCError(RC_DeviceBusy) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the camera is busy for %s", readyTimeout)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// captureNoAF shoots a still to the card without AF.
+func (n *nikonDriver) captureNoAF(ctx context.Context) error {
+	var req, rep Container
+	req.Code = OC_NIKON_InitiateCaptureRecInMedia
+	req.Param = []uint32{captureNoAF, captureMediaCard}
+	err := n.dev.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
+	if err == nil {
+		err = n.waitReady(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to capture: %s", err)
+	}
+	return nil
+}
+
+// captureDriver returns the driver if the camera shoots without AF.
+func (s *LVServer) captureDriver() (*nikonDriver, bool) {
+	n, ok := s.driver.(*nikonDriver)
+	return n, ok && s.caps.op(OC_NIKON_InitiateCaptureRecInMedia)
+}
+
+// writeSetJSON saves the metadata of a sequence next to its frames.
+func writeSetJSON(dir, name string, v interface{}) error {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), j, 0644)
+}
+
+// captureStill shoots a still and copies the images it recorded to the card
+// into dir, prefixing their names.
+func (s *LVServer) captureStill(ctx context.Context, n *nikonDriver, dir, prefix string) ([]string, error) {
+	list := func() (map[uint32]bool, error) {
+		var handles []uint32
+		err := s.withDevice(PriorityUser, func() (err error) {
+			handles, err = getObjectHandles(ctx, s.dev, allStorages, 0)
+			return
+		})
+		known := make(map[uint32]bool, len(handles))
+		for _, h := range handles {
+			known[h] = true
+		}
+		return known, err
+	}
+
+	before, err := list()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %s", err)
+	}
+
+	err = s.withDevice(PriorityUser, func() error {
+		return n.captureNoAF(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The images appear once they are written to the card. JPEG+RAW shots
+	// add two of them, so wait once more after the first one.
+	var added []uint32
+	deadline := time.Now().Add(captureObjectTimeout)
+	for found := false; ; {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		after, err := list()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %s", err)
+		}
+		prev := len(added)
+		added = added[:0]
+		for h := range after {
+			if !before[h] {
+				added = append(added, h)
+			}
+		}
+
+		if found && len(added) == prev {
+			break
+		} else if len(added) > 0 {
+			found = true
+		} else if time.Now().After(deadline) {
+			return nil, fmt.Errorf("the shot didn't appear on the card in %s", captureObjectTimeout)
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool { return added[i] < added[j] })
+	if s.ingest != nil {
+		// Only ingest releases the claims.
+		s.seq.claim(added)
+	}
+
+	var files []string
+	for _, h := range added {
+		var info ObjectInfo
+		err = s.withDevice(PriorityUser, func() (err error) {
+			info, err = getObjectInfo(ctx, s.dev, h)
+			return
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get object info: %s", err)
+		}
+		if info.ObjectFormat == OFC_Association {
+			continue
+		}
+
+		name := prefix + info.Filename
+		_, err = s.copyObject(h, filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %s", info.Filename, err)
+		}
+		files = append(files, name)
+	}
+	s.events.publish(EventCapture, CaptureEvent{Source: "still", Dir: dir, Files: files})
+	return files, nil
+}
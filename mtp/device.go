@@ -1,6 +1,7 @@
 package mtp
 
 import (
+	"context"
 	"fmt"
 	"io"
 )
@@ -12,7 +13,17 @@ type Device interface {
 	GetDevicePropDesc(propCode uint16, info *DevicePropDesc) error
 	GetDevicePropValue(propCode uint32, dest interface{}) error
 	SetDevicePropValue(propCode uint32, src interface{}) error
+	GetDeviceInfo(info *DeviceInfo) error
 	ID() (ID, error)
+
+	// The Context variants abort the transaction when ctx is done, cancel it
+	// on the device and return ctx.Err(). DefaultTimeout applies when ctx
+	// has no deadline.
+	RunTransactionWithNoParamsContext(ctx context.Context, code uint16) error
+	RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error
+	GetDevicePropDescContext(ctx context.Context, propCode uint16, info *DevicePropDesc) error
+	GetDevicePropValueContext(ctx context.Context, propCode uint32, dest interface{}) error
+	SetDevicePropValueContext(ctx context.Context, propCode uint32, src interface{}) error
 }
 
 type sessionData struct {
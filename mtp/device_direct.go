@@ -2,6 +2,7 @@ package mtp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -28,7 +29,8 @@ type DeviceDirect struct {
 	eventEP     byte
 	configValue byte
 
-	// In milliseconds. Defaults to 2 seconds.
+	// Timeout of a single USB transfer in milliseconds. Defaults to 2
+	// seconds. The whole transaction is bounded by the context instead.
 	Timeout int
 
 	Debug DebugFlags
@@ -58,7 +60,9 @@ func (d *DeviceDirect) Close() error {
 		req.Code = OC_CloseSession
 		// RunTransaction runs close, so can't use CloseSession().
 
-		if err := d.runTransaction(&req, &rep, nil, nil, 0); err != nil {
+		ctx, cancel := withOpTimeout(context.Background(), req.Code)
+		defer cancel()
+		if err := d.runTransaction(ctx, &req, &rep, nil, nil, 0); err != nil {
 			err := d.h.Reset()
 			if d.Debug.USB {
 				log.USB.Debugf("reset, err: %v", err)
@@ -190,7 +194,7 @@ func (d *DeviceDirect) ID() (ID, error) {
 	return ID{Manufacturer: m, Product: p, SerialNumber: s}, nil
 }
 
-func (d *DeviceDirect) sendReq(req *Container) error {
+func (d *DeviceDirect) sendReq(ctx context.Context, req *Container) error {
 	c := usbBulkContainer{
 		usbBulkHeader: usbBulkHeader{
 			Length:        uint32(usbHdrLen + 4*len(req.Param)),
@@ -212,7 +216,7 @@ func (d *DeviceDirect) sendReq(req *Container) error {
 	}
 
 	d.dataPrint(d.sendEP, buf.Bytes())
-	_, err := d.h.BulkTransfer(d.sendEP, buf.Bytes(), d.Timeout)
+	_, err := d.bulkTransfer(ctx, d.sendEP, buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -221,8 +225,8 @@ func (d *DeviceDirect) sendReq(req *Container) error {
 
 // Fetches one USB packet. The header is split off, and the remainder is returned.
 // dest should be at least 512bytes.
-func (d *DeviceDirect) fetchPacket(dest []byte, header *usbBulkHeader) (rest []byte, err error) {
-	n, err := d.h.BulkTransfer(d.fetchEP, dest[:d.fetchMaxPacketSize()], d.Timeout)
+func (d *DeviceDirect) fetchPacket(ctx context.Context, dest []byte, header *usbBulkHeader) (rest []byte, err error) {
+	n, err := d.bulkTransfer(ctx, d.fetchEP, dest[:d.fetchMaxPacketSize()])
 	if n > 0 {
 		d.dataPrint(d.fetchEP, dest[:n])
 	}
@@ -263,10 +267,14 @@ func (d *DeviceDirect) decodeRep(h *usbBulkHeader, rest []byte, rep *Container)
 }
 
 func (d *DeviceDirect) RunTransactionWithNoParams(code uint16) error {
+	return d.RunTransactionWithNoParamsContext(context.Background(), code)
+}
+
+func (d *DeviceDirect) RunTransactionWithNoParamsContext(ctx context.Context, code uint16) error {
 	var req, rep Container
 	req.Code = code
 	req.Param = []uint32{}
-	return d.RunTransaction(&req, &rep, nil, nil, 0)
+	return d.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
 }
 
 // Runs a single MTP transaction. dest and src cannot be specified at
@@ -280,12 +288,32 @@ func (d *DeviceDirect) RunTransactionWithNoParams(code uint16) error {
 // IDs, USB errors (BUSY, IO, ACCESS etc.), and receiving data for
 // operations that expect no data.
 func (d *DeviceDirect) RunTransaction(req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	return d.RunTransactionContext(context.Background(), req, rep, dest, src, writeSize)
+}
+
+// RunTransactionContext is like RunTransaction, but the transaction is
+// cancelled on the device when ctx is done before it completes.
+func (d *DeviceDirect) RunTransactionContext(ctx context.Context, req *Container, rep *Container,
 	dest io.Writer, src io.Reader, writeSize int64) error {
 	if d.h == nil {
 		return fmt.Errorf("mtp: cannot run operation %v, device is not open",
 			OC_names[int(req.Code)])
 	}
-	if err := d.runTransaction(req, rep, dest, src, writeSize); err != nil {
+
+	opCtx, cancel := withOpTimeout(ctx, req.Code)
+	defer cancel()
+
+	if err := d.runTransaction(opCtx, req, rep, dest, src, writeSize); err != nil {
+		if opCtx.Err() != nil {
+			logAborted(req.Code, opCtx.Err())
+			if err := d.cancelTransaction(req.TransactionID); err != nil {
+				log.MTP.Errorf("failed to cancel transaction: %s; closing connection.", err)
+				d.Close()
+			}
+			return opCtx.Err()
+		}
+
 		_, ok2 := err.(SyncError)
 		_, ok1 := err.(usb.Error)
 		if ok1 || ok2 {
@@ -299,7 +327,7 @@ func (d *DeviceDirect) RunTransaction(req *Container, rep *Container,
 
 // runTransaction is like RunTransaction, but without sanity checking
 // before and after the call.
-func (d *DeviceDirect) runTransaction(req *Container, rep *Container,
+func (d *DeviceDirect) runTransaction(ctx context.Context, req *Container, rep *Container,
 	dest io.Writer, src io.Reader, writeSize int64) error {
 	var finalPacket []byte
 	if d.session != nil {
@@ -312,7 +340,7 @@ func (d *DeviceDirect) runTransaction(req *Container, rep *Container,
 		log.MTP.Debugf("request %s %v\n", OC_names[int(req.Code)], req.Param)
 	}
 
-	if err := d.sendReq(req); err != nil {
+	if err := d.sendReq(ctx, req); err != nil {
 		if d.Debug.MTP {
 			log.MTP.Debugf("sendreq failed: %v\n", err)
 		}
@@ -327,7 +355,7 @@ func (d *DeviceDirect) runTransaction(req *Container, rep *Container,
 			TransactionID: req.TransactionID,
 		}
 
-		_, err := d.bulkWrite(&hdr, src, writeSize)
+		_, err := d.bulkWrite(ctx, &hdr, src, writeSize)
 		if err != nil {
 			return err
 		}
@@ -335,7 +363,7 @@ func (d *DeviceDirect) runTransaction(req *Container, rep *Container,
 	fetchPacketSize := d.fetchMaxPacketSize()
 	data := make([]byte, fetchPacketSize)
 	h := &usbBulkHeader{}
-	rest, err := d.fetchPacket(data[:], h)
+	rest, err := d.fetchPacket(ctx, data[:], h)
 	if err != nil {
 		return err
 	}
@@ -357,7 +385,7 @@ func (d *DeviceDirect) runTransaction(req *Container, rep *Container,
 		if len(rest)+usbHdrLen == fetchPacketSize {
 			// If this was a full packet, read until we
 			// have a short read.
-			_, finalPacket, err = d.bulkRead(dest)
+			_, finalPacket, err = d.bulkRead(ctx, dest)
 			if err != nil {
 				return err
 			}
@@ -372,7 +400,7 @@ func (d *DeviceDirect) runTransaction(req *Container, rep *Container,
 			finalBuf := bytes.NewBuffer(finalPacket[:len(finalPacket)])
 			err = binary.Read(finalBuf, binary.LittleEndian, h)
 		} else {
-			rest, err = d.fetchPacket(data[:], h)
+			rest, err = d.fetchPacket(ctx, data[:], h)
 		}
 	}
 
@@ -409,7 +437,7 @@ func (d *DeviceDirect) dataPrint(ep byte, data []byte) {
 }
 
 // bulkWrite returns the number of non-header bytes written.
-func (d *DeviceDirect) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n int64, err error) {
+func (d *DeviceDirect) bulkWrite(ctx context.Context, hdr *usbBulkHeader, r io.Reader, size int64) (n int64, err error) {
 	packetSize := d.sendMaxPacketSize()
 	if hdr != nil {
 		if size+usbHdrLen > 0xFFFFFFFF {
@@ -435,7 +463,7 @@ func (d *DeviceDirect) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n
 
 		_, err = io.CopyN(buf, r, cpSize)
 		d.dataPrint(d.sendEP, buf.Bytes())
-		_, err = d.h.BulkTransfer(d.sendEP, buf.Bytes(), d.Timeout)
+		_, err = d.bulkTransfer(ctx, d.sendEP, buf.Bytes())
 		if err != nil {
 			return cpSize, err
 		}
@@ -459,7 +487,7 @@ func (d *DeviceDirect) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n
 		size -= int64(m)
 
 		d.dataPrint(d.sendEP, buf[:m])
-		lastTransfer, err = d.h.BulkTransfer(d.sendEP, buf[:m], d.Timeout)
+		lastTransfer, err = d.bulkTransfer(ctx, d.sendEP, buf[:m])
 		n += int64(lastTransfer)
 
 		if err != nil || lastTransfer == 0 {
@@ -468,30 +496,30 @@ func (d *DeviceDirect) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n
 	}
 	if lastTransfer%packetSize == 0 {
 		// write a short packet just to be sure.
-		d.h.BulkTransfer(d.sendEP, buf[:0], d.Timeout)
+		d.bulkTransfer(ctx, d.sendEP, buf[:0])
 	}
 
 	return n, err
 }
 
-func (d *DeviceDirect) bulkRead(w io.Writer) (n int64, lastPacket []byte, err error) {
+func (d *DeviceDirect) bulkRead(ctx context.Context, w io.Writer) (n int64, lastPacket []byte, err error) {
 	var buf [rwBufSize]byte
 	var lastRead int
 	for {
 		toread := buf[:]
-		lastRead, err = d.h.BulkTransfer(d.fetchEP, toread, d.Timeout)
-		if err != nil {
-			break
-		}
+		lastRead, err = d.bulkTransfer(ctx, d.fetchEP, toread)
 		if lastRead > 0 {
 			d.dataPrint(d.fetchEP, buf[:lastRead])
 
-			w, err := w.Write(buf[:lastRead])
+			w, werr := w.Write(buf[:lastRead])
 			n += int64(w)
-			if err != nil {
-				break
+			if werr != nil && err == nil {
+				err = werr
 			}
 		}
+		if err != nil {
+			break
+		}
 		if d.Debug.MTP {
 			log.MTP.Debugf("bulk read 0x%x bytes.", lastRead)
 		}
@@ -506,7 +534,7 @@ func (d *DeviceDirect) bulkRead(w io.Writer) (n int64, lastPacket []byte, err er
 		// CONTAINER_OK instead. To be liberal with the XHCI behavior, return
 		// the final packet and inspect it in the calling function.
 		var nullReadSize int
-		nullReadSize, err = d.h.BulkTransfer(d.fetchEP, buf[:], d.Timeout)
+		nullReadSize, err = d.bulkTransfer(ctx, d.fetchEP, buf[:])
 		if d.Debug.MTP {
 			log.MTP.Debugf("expected null packet, read %d bytes", nullReadSize)
 		}
@@ -515,6 +543,83 @@ func (d *DeviceDirect) bulkRead(w io.Writer) (n int64, lastPacket []byte, err er
 	return n, buf[:0], err
 }
 
+// bulkTransfer runs a synchronous USB transfer. libusb can't interrupt it, so
+// it is split into short transfers by sliceTransfer.
+func (d *DeviceDirect) bulkTransfer(ctx context.Context, ep byte, buf []byte) (int, error) {
+	return sliceTransfer(ctx, d.Timeout, buf, func(b []byte, timeout int) (int, error) {
+		return d.h.BulkTransfer(ep, b, timeout)
+	})
+}
+
+// sliceTransfer runs transfer in slices of 200ms until buf is done, ctx is
+// canceled or the device pauses for longer than timeout (ms). libusb may
+// time out after a part of buf, so the rest is retried and the part is
+// returned without an error unless ctx is canceled.
+func sliceTransfer(ctx context.Context, timeout int, buf []byte, transfer func(b []byte, timeout int) (int, error)) (int, error) {
+	const slice = 200 // ms
+
+	var n int
+	remain := timeout
+	for {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+
+		t := remain
+		if t > slice {
+			t = slice
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			if until := int(time.Until(deadline)/time.Millisecond) + 1; until < t {
+				t = until
+			}
+		}
+
+		m, err := transfer(buf[n:], t)
+		n += m
+		if err != usb.ERROR_TIMEOUT {
+			return n, err
+		}
+
+		remain -= t
+		if m > 0 {
+			// The device is still sending; wait as long again for the rest.
+			remain = timeout
+		}
+		if n == len(buf) {
+			return n, nil
+		} else if remain <= 0 {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+	}
+}
+
+// cancelTransaction sends the Cancel class request for the transaction and
+// waits until the device is ready for the next one.
+func (d *DeviceDirect) cancelTransaction(tid uint32) error {
+	if d.h == nil {
+		return nil
+	}
+
+	iface := uint16(d.ifaceDescr.InterfaceNumber)
+	err := d.h.ControlTransfer(usbReqTypeClassOut, usbReqCancel, 0, iface, cancelRequestData(tid), d.Timeout)
+	if err != nil {
+		return fmt.Errorf("cancel request failed: %s", err)
+	}
+
+	return waitDeviceReady(func() (deviceStatus, error) {
+		var buf [32]byte
+		err := d.h.ControlTransfer(usbReqTypeClassIn, usbReqGetDeviceStatus, 0, iface, buf[:], d.Timeout)
+		if err != nil {
+			return deviceStatus{}, err
+		}
+		return decodeDeviceStatus(buf[:])
+	}, d.h.ClearHalt)
+}
+
 // Configure is a robust version of OpenSession. On failure, it resets
 // the device and reopens the device and the session.
 func (d *DeviceDirect) Configure() error {
@@ -2,6 +2,7 @@ package mtp
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -53,7 +54,9 @@ func (d *DeviceGoUSB) Close() error {
 		req.Code = OC_CloseSession
 		// RunTransaction runs close, so can't use CloseSession().
 
-		err := d.runTransaction(&req, &rep, nil, nil, 0)
+		ctx, cancel := withOpTimeout(context.Background(), req.Code)
+		defer cancel()
+		err := d.runTransaction(ctx, &req, &rep, nil, nil, 0)
 		if err != nil {
 			log.USB.Errorf("failed to close session")
 		}
@@ -162,7 +165,7 @@ func (d *DeviceGoUSB) ID() (ID, error) {
 	return ID{Manufacturer: m, Product: p, SerialNumber: s}, nil
 }
 
-func (d *DeviceGoUSB) sendReq(req *Container) error {
+func (d *DeviceGoUSB) sendReq(ctx context.Context, req *Container) error {
 	c := usbBulkContainer{
 		usbBulkHeader: usbBulkHeader{
 			Length:        uint32(usbHdrLen + 4*len(req.Param)),
@@ -184,7 +187,7 @@ func (d *DeviceGoUSB) sendReq(req *Container) error {
 	}
 
 	d.dataPrint(d.sendEPDesc, buf.Bytes())
-	_, err := d.bulkTransferOut(d.sendEP, buf.Bytes())
+	_, err := d.bulkTransferOut(ctx, d.sendEP, buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -193,8 +196,8 @@ func (d *DeviceGoUSB) sendReq(req *Container) error {
 
 // Fetches one USB packet. The header is split off, and the remainder is returned.
 // dest should be at least 512bytes.
-func (d *DeviceGoUSB) fetchPacket(dest []byte, header *usbBulkHeader) (rest []byte, err error) {
-	n, err := d.bulkTransferIn(d.fetchEP, dest[:d.fetchEPDesc.MaxPacketSize])
+func (d *DeviceGoUSB) fetchPacket(ctx context.Context, dest []byte, header *usbBulkHeader) (rest []byte, err error) {
+	n, err := d.bulkTransferIn(ctx, d.fetchEP, dest[:d.fetchEPDesc.MaxPacketSize])
 	if n > 0 {
 		d.dataPrint(d.fetchEPDesc, dest[:n])
 	}
@@ -235,10 +238,14 @@ func (d *DeviceGoUSB) decodeRep(h *usbBulkHeader, rest []byte, rep *Container) e
 }
 
 func (d *DeviceGoUSB) RunTransactionWithNoParams(code uint16) error {
+	return d.RunTransactionWithNoParamsContext(context.Background(), code)
+}
+
+func (d *DeviceGoUSB) RunTransactionWithNoParamsContext(ctx context.Context, code uint16) error {
 	var req, rep Container
 	req.Code = code
 	req.Param = []uint32{}
-	return d.RunTransaction(&req, &rep, nil, nil, 0)
+	return d.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
 }
 
 // Runs a single MTP transaction. dest and src cannot be specified at
@@ -253,7 +260,25 @@ func (d *DeviceGoUSB) RunTransactionWithNoParams(code uint16) error {
 // operations that expect no data.
 func (d *DeviceGoUSB) RunTransaction(req *Container, rep *Container,
 	dest io.Writer, src io.Reader, writeSize int64) error {
-	if err := d.runTransaction(req, rep, dest, src, writeSize); err != nil {
+	return d.RunTransactionContext(context.Background(), req, rep, dest, src, writeSize)
+}
+
+// RunTransactionContext is like RunTransaction, but the transaction is
+// cancelled on the device when ctx is done before it completes.
+func (d *DeviceGoUSB) RunTransactionContext(ctx context.Context, req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	opCtx, cancel := withOpTimeout(ctx, req.Code)
+	defer cancel()
+
+	if err := d.runTransaction(opCtx, req, rep, dest, src, writeSize); err != nil {
+		if opCtx.Err() != nil {
+			logAborted(req.Code, opCtx.Err())
+			if err := d.cancelTransaction(req.TransactionID); err != nil {
+				return Catastrophic(fmt.Sprintf("failed to cancel transaction: %s", err))
+			}
+			return opCtx.Err()
+		}
+
 		_, ok2 := err.(SyncError)
 		_, ok1 := err.(usb.Error)
 		if ok1 || ok2 {
@@ -266,7 +291,7 @@ func (d *DeviceGoUSB) RunTransaction(req *Container, rep *Container,
 
 // runTransaction is like RunTransaction, but without sanity checking
 // before and after the call.
-func (d *DeviceGoUSB) runTransaction(req *Container, rep *Container,
+func (d *DeviceGoUSB) runTransaction(ctx context.Context, req *Container, rep *Container,
 	dest io.Writer, src io.Reader, writeSize int64) error {
 	var finalPacket []byte
 	if d.session != nil {
@@ -277,7 +302,7 @@ func (d *DeviceGoUSB) runTransaction(req *Container, rep *Container,
 
 	log.MTP.Debugf("request %s %v\n", OC_names[int(req.Code)], req.Param)
 
-	if err := d.sendReq(req); err != nil {
+	if err := d.sendReq(ctx, req); err != nil {
 		log.MTP.Debugf("sendreq failed: %v\n", err)
 		return err
 	}
@@ -290,7 +315,7 @@ func (d *DeviceGoUSB) runTransaction(req *Container, rep *Container,
 			TransactionID: req.TransactionID,
 		}
 
-		_, err := d.bulkWrite(&hdr, src, writeSize)
+		_, err := d.bulkWrite(ctx, &hdr, src, writeSize)
 		if err != nil {
 			return err
 		}
@@ -298,7 +323,7 @@ func (d *DeviceGoUSB) runTransaction(req *Container, rep *Container,
 	fetchPacketSize := d.fetchEPDesc.MaxPacketSize
 	data := make([]byte, fetchPacketSize)
 	h := &usbBulkHeader{}
-	rest, err := d.fetchPacket(data[:], h)
+	rest, err := d.fetchPacket(ctx, data[:], h)
 	if err != nil {
 		return err
 	}
@@ -316,7 +341,7 @@ func (d *DeviceGoUSB) runTransaction(req *Container, rep *Container,
 		if len(rest)+usbHdrLen == fetchPacketSize {
 			// If this was a full packet, read until we
 			// have a short read.
-			_, finalPacket, err = d.bulkRead(dest)
+			_, finalPacket, err = d.bulkRead(ctx, dest)
 			if err != nil {
 				return err
 			}
@@ -329,7 +354,7 @@ func (d *DeviceGoUSB) runTransaction(req *Container, rep *Container,
 			finalBuf := bytes.NewBuffer(finalPacket[:len(finalPacket)])
 			err = binary.Read(finalBuf, binary.LittleEndian, h)
 		} else {
-			rest, err = d.fetchPacket(data[:], h)
+			rest, err = d.fetchPacket(ctx, data[:], h)
 		}
 	}
 
@@ -365,7 +390,7 @@ func (d *DeviceGoUSB) dataPrint(epDesc gousb.EndpointDesc, data []byte) {
 }
 
 // bulkWrite returns the number of non-header bytes written.
-func (d *DeviceGoUSB) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n int64, err error) {
+func (d *DeviceGoUSB) bulkWrite(ctx context.Context, hdr *usbBulkHeader, r io.Reader, size int64) (n int64, err error) {
 	packetSize := d.sendEPDesc.MaxPacketSize
 	if hdr != nil {
 		if size+usbHdrLen > 0xFFFFFFFF {
@@ -387,7 +412,7 @@ func (d *DeviceGoUSB) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n
 
 		_, err = io.CopyN(buf, r, cpSize)
 		d.dataPrint(d.sendEPDesc, buf.Bytes())
-		_, err = d.bulkTransferOut(d.sendEP, buf.Bytes())
+		_, err = d.bulkTransferOut(ctx, d.sendEP, buf.Bytes())
 		if err != nil {
 			return cpSize, err
 		}
@@ -411,7 +436,7 @@ func (d *DeviceGoUSB) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n
 		size -= int64(m)
 
 		d.dataPrint(d.sendEPDesc, buf[:m])
-		lastTransfer, err = d.bulkTransferOut(d.sendEP, buf[:m])
+		lastTransfer, err = d.bulkTransferOut(ctx, d.sendEP, buf[:m])
 		n += int64(lastTransfer)
 
 		if err != nil || lastTransfer == 0 {
@@ -420,18 +445,18 @@ func (d *DeviceGoUSB) bulkWrite(hdr *usbBulkHeader, r io.Reader, size int64) (n
 	}
 	if lastTransfer%packetSize == 0 {
 		// write a short packet just to be sure.
-		d.bulkTransferOut(d.sendEP, buf[:0])
+		d.bulkTransferOut(ctx, d.sendEP, buf[:0])
 	}
 
 	return n, err
 }
 
-func (d *DeviceGoUSB) bulkRead(w io.Writer) (n int64, lastPacket []byte, err error) {
+func (d *DeviceGoUSB) bulkRead(ctx context.Context, w io.Writer) (n int64, lastPacket []byte, err error) {
 	var buf [rwBufSize]byte
 	var lastRead int
 	for {
 		toread := buf[:]
-		lastRead, err = d.bulkTransferIn(d.fetchEP, toread)
+		lastRead, err = d.bulkTransferIn(ctx, d.fetchEP, toread)
 		if err != nil {
 			break
 		}
@@ -456,19 +481,42 @@ func (d *DeviceGoUSB) bulkRead(w io.Writer) (n int64, lastPacket []byte, err err
 		// CONTAINER_OK instead. To be liberal with the XHCI behavior, return
 		// the final packet and inspect it in the calling function.
 		var nullReadSize int
-		nullReadSize, err = d.bulkTransferIn(d.fetchEP, buf[:])
+		nullReadSize, err = d.bulkTransferIn(ctx, d.fetchEP, buf[:])
 		log.MTP.Debugf("expected null packet, read %d bytes", nullReadSize)
 		return n, buf[:nullReadSize], err
 	}
 	return n, buf[:0], err
 }
 
-func (d *DeviceGoUSB) bulkTransferIn(ep *gousb.InEndpoint, buf []byte) (int, error) {
-	return ep.Read(buf)
+func (d *DeviceGoUSB) bulkTransferIn(ctx context.Context, ep *gousb.InEndpoint, buf []byte) (int, error) {
+	return ep.ReadContext(ctx, buf)
 }
 
-func (d *DeviceGoUSB) bulkTransferOut(ep *gousb.OutEndpoint, buf []byte) (int, error) {
-	return ep.Write(buf)
+func (d *DeviceGoUSB) bulkTransferOut(ctx context.Context, ep *gousb.OutEndpoint, buf []byte) (int, error) {
+	return ep.WriteContext(ctx, buf)
+}
+
+// cancelTransaction sends the Cancel class request for the transaction and
+// waits until the device is ready for the next one.
+func (d *DeviceGoUSB) cancelTransaction(tid uint32) error {
+	iface := uint16(d.ifaceDesc.Number)
+	_, err := d.dev.Control(usbReqTypeClassOut, usbReqCancel, 0, iface, cancelRequestData(tid))
+	if err != nil {
+		return fmt.Errorf("cancel request failed: %s", err)
+	}
+
+	return waitDeviceReady(func() (deviceStatus, error) {
+		var buf [32]byte
+		n, err := d.dev.Control(usbReqTypeClassIn, usbReqGetDeviceStatus, 0, iface, buf[:])
+		if err != nil {
+			return deviceStatus{}, err
+		}
+		return decodeDeviceStatus(buf[:n])
+	}, func(ep byte) error {
+		// CLEAR_FEATURE(ENDPOINT_HALT)
+		_, err := d.dev.Control(0x02, 0x01, 0, uint16(ep), nil)
+		return err
+	})
 }
 
 // Configure is a robust version of OpenSession. On failure, it resets
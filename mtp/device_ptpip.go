@@ -0,0 +1,675 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf16"
+)
+
+// PTP/IP packet types (CIPA DC-005)
+const (
+	ptpipInitCommandRequest = 1
+	ptpipInitCommandAck     = 2
+	ptpipInitEventRequest   = 3
+	ptpipInitEventAck       = 4
+	ptpipInitFail           = 5
+	ptpipOperationRequest   = 6
+	ptpipOperationResponse  = 7
+	ptpipEvent              = 8
+	ptpipStartData          = 9
+	ptpipData               = 10
+	ptpipCancel             = 11
+	ptpipEndData            = 12
+	ptpipProbeRequest       = 13
+	ptpipProbeResponse      = 14
+)
+
+// Data phase info of Operation Request packets
+const (
+	ptpipDataPhaseIn  = 1 // no data phase or data from the responder
+	ptpipDataPhaseOut = 2 // data to the responder
+)
+
+const (
+	PTPIPPort            = 15740
+	ptpipProtocolVersion = 0x00010000
+	ptpipHdrLen          = 8
+
+	// Payloads of non-data packets are read into memory, so limit them.
+	ptpipMaxPayload = 1 << 20
+
+	// ptpipReconnectAttempts bounds reconnecting after the connection broke.
+	ptpipReconnectAttempts = 3
+)
+
+// ptpipConn frames PTP/IP packets on a TCP connection. A connection
+// interrupted in the middle of a packet is out of sync and can't be used
+// anymore.
+type ptpipConn struct {
+	conn   net.Conn
+	remain int64 // unread bytes of the current packet
+	broken bool
+	wlock  sync.Mutex
+}
+
+// next skips the rest of the current packet and reads the header of the
+// next one. The payload is read through Read.
+func (c *ptpipConn) next() (typ uint32, err error) {
+	if c.remain > 0 {
+		_, err = io.Copy(ioutil.Discard, c)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var hdr [ptpipHdrLen]byte
+	n, err := io.ReadFull(c.conn, hdr[:])
+	if err != nil {
+		if n > 0 {
+			c.broken = true
+		}
+		return 0, err
+	}
+
+	length := byteOrder.Uint32(hdr[:])
+	if length < ptpipHdrLen {
+		c.broken = true
+		return 0, SyncError(fmt.Sprintf("invalid PTP/IP packet length %d", length))
+	}
+	c.remain = int64(length) - ptpipHdrLen
+	return byteOrder.Uint32(hdr[4:]), nil
+}
+
+// Read reads the payload of the current packet and returns io.EOF at its end.
+func (c *ptpipConn) Read(p []byte) (int, error) {
+	if c.remain == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > c.remain {
+		p = p[:c.remain]
+	}
+
+	n, err := c.conn.Read(p)
+	c.remain -= int64(n)
+	if err != nil {
+		c.broken = true
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// payload reads the rest of the current packet into memory.
+func (c *ptpipConn) payload() ([]byte, error) {
+	if c.remain > ptpipMaxPayload {
+		return nil, fmt.Errorf("PTP/IP packet is too large: 0x%x bytes", c.remain)
+	}
+	buf := make([]byte, c.remain)
+	_, err := io.ReadFull(c, buf)
+	return buf, err
+}
+
+func (c *ptpipConn) write(typ uint32, payload ...[]byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	length := ptpipHdrLen
+	for _, p := range payload {
+		length += len(p)
+	}
+
+	buf := make([]byte, ptpipHdrLen, length)
+	byteOrder.PutUint32(buf, uint32(length))
+	byteOrder.PutUint32(buf[4:], typ)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+
+	n, err := c.conn.Write(buf)
+	if err != nil && n > 0 {
+		c.broken = true
+	}
+	return err
+}
+
+// interruptOnDone unblocks the I/O of c when ctx is done. Call the returned
+// function when the I/O is finished.
+func (c *ptpipConn) interruptOnDone(ctx context.Context) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+func (c *ptpipConn) Close() error {
+	return c.conn.Close()
+}
+
+func ptpipUint32(v uint32) []byte {
+	var b [4]byte
+	byteOrder.PutUint32(b[:], v)
+	return b[:]
+}
+
+// ptpipString encodes a null-terminated UTF-16LE string.
+func ptpipString(s string) []byte {
+	codes := utf16.Encode([]rune(s))
+	buf := make([]byte, 2*len(codes)+2)
+	for i, c := range codes {
+		byteOrder.PutUint16(buf[2*i:], c)
+	}
+	return buf
+}
+
+// decodePTPIPString decodes a null-terminated UTF-16LE string and returns the
+// bytes after it.
+func decodePTPIPString(buf []byte) (string, []byte, error) {
+	var codes []uint16
+	for i := 0; i+1 < len(buf); i += 2 {
+		c := byteOrder.Uint16(buf[i:])
+		if c == 0 {
+			return string(utf16.Decode(codes)), buf[i+2:], nil
+		}
+		codes = append(codes, c)
+	}
+	return "", nil, fmt.Errorf("unterminated string")
+}
+
+// DevicePTPIP implements mtp.Device.
+// It speaks PTP/IP over a pair of TCP connections for commands and events.
+type DevicePTPIP struct {
+	Addr string
+
+	// GUID and FriendlyName identify the initiator. Cameras ask to pair
+	// with an unknown initiator, so keep the GUID stable.
+	GUID         [16]byte
+	FriendlyName string
+
+	DialTimeout time.Duration
+
+	cmd        *ptpipConn
+	event      *ptpipConn
+	eventDone  chan struct{}
+	connNumber uint32
+
+	responderName string
+
+	session *sessionData
+}
+
+// NewDevicePTPIP returns an unopened PTP/IP device. The port defaults to
+// 15740 and the GUID is derived from the hostname.
+func NewDevicePTPIP(addr string) *DevicePTPIP {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, fmt.Sprint(PTPIPPort))
+	}
+
+	hostname, _ := os.Hostname()
+
+	return &DevicePTPIP{
+		Addr:         addr,
+		GUID:         md5.Sum([]byte("mtplvcap:" + hostname)),
+		FriendlyName: "mtplvcap",
+		DialTimeout:  5 * time.Second,
+	}
+}
+
+func (d *DevicePTPIP) connected() bool {
+	return d.cmd != nil
+}
+
+// Open connects to the responder and initializes the command and event
+// connections.
+func (d *DevicePTPIP) Open() error {
+	if d.connected() {
+		return fmt.Errorf("already open")
+	}
+
+	conn, err := net.DialTimeout("tcp", d.Addr, d.DialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %s", d.Addr, err)
+	}
+	cmd := &ptpipConn{conn: conn}
+
+	conn.SetDeadline(time.Now().Add(d.DialTimeout))
+	err = cmd.write(ptpipInitCommandRequest, d.GUID[:], ptpipString(d.FriendlyName), ptpipUint32(ptpipProtocolVersion))
+	if err != nil {
+		cmd.Close()
+		return fmt.Errorf("failed to send Init Command Request: %s", err)
+	}
+
+	ack, err := d.readInitAck(cmd, ptpipInitCommandAck)
+	if err != nil {
+		cmd.Close()
+		return fmt.Errorf("failed to initialize the command connection: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	if len(ack) < 4+16 {
+		cmd.Close()
+		return fmt.Errorf("short Init Command Ack")
+	}
+	d.connNumber = byteOrder.Uint32(ack)
+	d.responderName, _, _ = decodePTPIPString(ack[4+16:])
+	log.MTP.Debugf("PTP/IP connection %d to %s (%s)", d.connNumber, d.Addr, d.responderName)
+
+	conn, err = net.DialTimeout("tcp", d.Addr, d.DialTimeout)
+	if err != nil {
+		cmd.Close()
+		return fmt.Errorf("failed to connect to %s: %s", d.Addr, err)
+	}
+	event := &ptpipConn{conn: conn}
+
+	conn.SetDeadline(time.Now().Add(d.DialTimeout))
+	err = event.write(ptpipInitEventRequest, ptpipUint32(d.connNumber))
+	if err == nil {
+		_, err = d.readInitAck(event, ptpipInitEventAck)
+	}
+	if err != nil {
+		cmd.Close()
+		event.Close()
+		return fmt.Errorf("failed to initialize the event connection: %s", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	d.cmd = cmd
+	d.event = event
+	d.eventDone = make(chan struct{})
+	go d.readEvents(event, d.eventDone)
+	return nil
+}
+
+func (d *DevicePTPIP) readInitAck(c *ptpipConn, want uint32) ([]byte, error) {
+	typ, err := c.next()
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := c.payload()
+	if err != nil {
+		return nil, err
+	}
+
+	switch typ {
+	case want:
+		return payload, nil
+	case ptpipInitFail:
+		if len(payload) >= 4 {
+			return nil, fmt.Errorf("rejected by the responder (reason 0x%x); accept the connection on the camera", byteOrder.Uint32(payload))
+		}
+		return nil, fmt.Errorf("rejected by the responder")
+	}
+	return nil, fmt.Errorf("got packet type %d, want %d", typ, want)
+}
+
+// readEvents answers probes and logs events until the connection is closed.
+func (d *DevicePTPIP) readEvents(c *ptpipConn, done chan struct{}) {
+	defer close(done)
+
+	for {
+		typ, err := c.next()
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case ptpipEvent:
+			payload, err := c.payload()
+			if err == nil && len(payload) >= 2 {
+				log.MTP.Debugf("event %s %x", getName(EC_names, int(byteOrder.Uint16(payload))), payload[2:])
+			}
+		case ptpipProbeRequest:
+			_ = c.write(ptpipProbeResponse)
+		default:
+			log.MTP.Debugf("ignoring packet type %d on the event connection", typ)
+		}
+	}
+}
+
+// Close closes the session and the connections.
+func (d *DevicePTPIP) Close() error {
+	if !d.connected() {
+		return nil
+	}
+
+	if d.session != nil && !d.cmd.broken {
+		var req, rep Container
+		req.Code = OC_CloseSession
+		// RunTransaction runs close, so can't use CloseSession().
+
+		ctx, cancel := withOpTimeout(context.Background(), req.Code)
+		defer cancel()
+		err := d.runTransaction(ctx, &req, &rep, nil, nil, 0)
+		if err != nil {
+			log.MTP.Debugf("failed to close session: %s", err)
+		}
+		d.session = nil
+	}
+
+	err := d.cmd.Close()
+	d.event.Close()
+	<-d.eventDone
+
+	d.cmd = nil
+	d.event = nil
+	return err
+}
+
+// ID is the manufacturer + model + serial
+func (d *DevicePTPIP) ID() (ID, error) {
+	if !d.connected() {
+		return ID{}, fmt.Errorf("mtp: ID: device not open")
+	}
+
+	info := DeviceInfo{}
+	err := d.GetDeviceInfo(&info)
+	if err != nil {
+		return ID{}, err
+	}
+	return ID{Manufacturer: info.Manufacturer, Product: info.Model, SerialNumber: info.SerialNumber}, nil
+}
+
+func (d *DevicePTPIP) RunTransactionWithNoParams(code uint16) error {
+	return d.RunTransactionWithNoParamsContext(context.Background(), code)
+}
+
+func (d *DevicePTPIP) RunTransactionWithNoParamsContext(ctx context.Context, code uint16) error {
+	var req, rep Container
+	req.Code = code
+	req.Param = []uint32{}
+	return d.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
+}
+
+// Runs a single PTP transaction. See DeviceDirect.RunTransaction.
+// Errors of the connection lead to closing it.
+func (d *DevicePTPIP) RunTransaction(req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	return d.RunTransactionContext(context.Background(), req, rep, dest, src, writeSize)
+}
+
+// RunTransactionContext is like RunTransaction, but the transaction is
+// cancelled on the device when ctx is done before it completes.
+func (d *DevicePTPIP) RunTransactionContext(ctx context.Context, req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	if !d.connected() {
+		return fmt.Errorf("mtp: cannot run operation %v, device is not open",
+			OC_names[int(req.Code)])
+	}
+
+	opCtx, cancel := withOpTimeout(ctx, req.Code)
+	defer cancel()
+
+	err := d.runTransaction(opCtx, req, rep, dest, src, writeSize)
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := err.(RCError); !ok && opCtx.Err() != nil {
+		logAborted(req.Code, opCtx.Err())
+		if err := d.cancelTransaction(req.TransactionID); err != nil {
+			log.MTP.Warningf("failed to cancel transaction: %s; reconnecting.", err)
+			return d.reconnect(opCtx.Err())
+		}
+		return opCtx.Err()
+	}
+
+	_, ok1 := err.(SyncError)
+	_, ok2 := err.(net.Error)
+	if ok1 || ok2 || err == io.EOF || err == io.ErrUnexpectedEOF {
+		log.MTP.Warningf("fatal error %v; reconnecting.", err)
+		return d.reconnect(err)
+	}
+	return err
+}
+
+// reconnect replaces the connections, which are out of sync e.g. after a
+// Wi-Fi stall, and opens the session again. It returns cause if the device
+// is usable again, as PTP/IP can't be reset like USB.
+func (d *DevicePTPIP) reconnect(cause error) error {
+	// The session is gone with the connection, so don't close it.
+	d.session = nil
+	d.Close()
+
+	var err error
+	for i := 0; i < ptpipReconnectAttempts; i++ {
+		err = d.Configure()
+		if err == nil {
+			log.MTP.Infof("reconnected to %s", d.Addr)
+			return cause
+		}
+		log.MTP.Warningf("failed to reconnect: %s", err)
+		d.Close()
+		time.Sleep(time.Second)
+	}
+	return Catastrophic(fmt.Sprintf("failed to reconnect after %s: %s", cause, err))
+}
+
+// runTransaction is like RunTransaction, but without sanity checking
+// before and after the call.
+func (d *DevicePTPIP) runTransaction(ctx context.Context, req *Container, rep *Container,
+	dest io.Writer, src io.Reader, writeSize int64) error {
+	if d.session != nil {
+		req.SessionID = d.session.sid
+		req.TransactionID = d.session.tid
+		d.session.tid++
+	}
+
+	stop := d.cmd.interruptOnDone(ctx)
+	defer stop()
+
+	log.MTP.Debugf("request %s %v", OC_names[int(req.Code)], req.Param)
+
+	phase := uint32(ptpipDataPhaseIn)
+	if src != nil {
+		phase = ptpipDataPhaseOut
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, 10+4*len(req.Param)))
+	buf.Write(ptpipUint32(phase))
+	buf.Write([]byte{byte(req.Code), byte(req.Code >> 8)})
+	buf.Write(ptpipUint32(req.TransactionID))
+	for _, p := range req.Param {
+		buf.Write(ptpipUint32(p))
+	}
+
+	err := d.cmd.write(ptpipOperationRequest, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	if src != nil {
+		err = d.sendData(req.TransactionID, src, writeSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	var unexpectedData bool
+	for {
+		typ, err := d.cmd.next()
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case ptpipStartData:
+			if dest == nil {
+				dest = &NullWriter{}
+				unexpectedData = true
+			}
+			payload, err := d.cmd.payload()
+			if err != nil {
+				return err
+			} else if len(payload) >= 12 {
+				log.MTP.Debugf("data 0x%x bytes", byteOrder.Uint64(payload[4:]))
+			}
+		case ptpipData, ptpipEndData:
+			if dest == nil {
+				return SyncError("got data before Start Data")
+			}
+			var tid [4]byte
+			if _, err = io.ReadFull(d.cmd, tid[:]); err != nil {
+				return err
+			}
+			if _, err = io.Copy(dest, d.cmd); err != nil {
+				return err
+			}
+		case ptpipOperationResponse:
+			payload, err := d.cmd.payload()
+			if err != nil {
+				return err
+			} else if len(payload) < 6 {
+				return SyncError("short Operation Response")
+			}
+
+			rep.Code = byteOrder.Uint16(payload)
+			rep.TransactionID = byteOrder.Uint32(payload[2:])
+			for i := 6; i+4 <= len(payload); i += 4 {
+				rep.Param = append(rep.Param, byteOrder.Uint32(payload[i:]))
+			}
+			log.MTP.Debugf("response %s %v", getName(RC_names, int(rep.Code)), rep.Param)
+
+			if unexpectedData {
+				return SyncError(fmt.Sprintf("unexpected data for code %s", getName(OC_names, int(req.Code))))
+			}
+			if rep.Code != RC_OK {
+				return RCError(rep.Code)
+			}
+			if d.session != nil && rep.TransactionID != req.TransactionID {
+				return SyncError(fmt.Sprintf("transaction ID mismatch got %x want %x",
+					rep.TransactionID, req.TransactionID))
+			}
+			rep.SessionID = req.SessionID
+			return nil
+		default:
+			return SyncError(fmt.Sprintf("got packet type %d in a transaction", typ))
+		}
+	}
+}
+
+// sendData sends the data phase as Start Data, Data and End Data packets.
+func (d *DevicePTPIP) sendData(tid uint32, src io.Reader, size int64) error {
+	var total [8]byte
+	byteOrder.PutUint64(total[:], uint64(size))
+	err := d.cmd.write(ptpipStartData, ptpipUint32(tid), total[:])
+	if err != nil {
+		return err
+	}
+
+	var buf [rwBufSize]byte
+	for {
+		n := int64(len(buf))
+		if n > size {
+			n = size
+		}
+
+		_, err = io.ReadFull(src, buf[:n])
+		if err != nil {
+			return err
+		}
+		size -= n
+
+		typ := uint32(ptpipData)
+		if size == 0 {
+			typ = ptpipEndData
+		}
+		err = d.cmd.write(typ, ptpipUint32(tid), buf[:n])
+		if err != nil || typ == ptpipEndData {
+			return err
+		}
+	}
+}
+
+// cancelTransaction cancels the transaction on the responder and waits for
+// its response, discarding the rest of the data phase.
+func (d *DevicePTPIP) cancelTransaction(tid uint32) error {
+	if d.cmd.broken {
+		return fmt.Errorf("the command connection is out of sync")
+	}
+
+	d.cmd.conn.SetDeadline(time.Now().Add(cancelTimeout))
+	defer d.cmd.conn.SetDeadline(time.Time{})
+
+	var code [2]byte
+	byteOrder.PutUint16(code[:], EC_CancelTransaction)
+	err := d.event.write(ptpipEvent, code[:], ptpipUint32(tid))
+	if err != nil {
+		return fmt.Errorf("failed to send CancelTransaction event: %s", err)
+	}
+
+	err = d.cmd.write(ptpipCancel, ptpipUint32(tid))
+	if err != nil {
+		return fmt.Errorf("failed to send Cancel packet: %s", err)
+	}
+
+	for {
+		typ, err := d.cmd.next()
+		if err != nil {
+			return err
+		}
+		if typ != ptpipOperationResponse {
+			continue
+		}
+
+		payload, err := d.cmd.payload()
+		if err != nil {
+			return err
+		}
+		if len(payload) >= 6 && byteOrder.Uint32(payload[2:]) == tid {
+			log.MTP.Debugf("transaction %d is cancelled: %s", tid, getName(RC_names, int(byteOrder.Uint16(payload))))
+			return nil
+		}
+	}
+}
+
+// Configure opens the connections and the session. On failure, it reconnects
+// and opens the session again.
+func (d *DevicePTPIP) Configure() error {
+	if !d.connected() {
+		if err := d.Open(); err != nil {
+			return err
+		}
+	}
+
+	err := d.OpenSession()
+	if err == RCError(RC_SessionAlreadyOpened) {
+		d.CloseSession()
+		err = d.OpenSession()
+	}
+
+	if err != nil {
+		log.MTP.Warningf("failed to open session: %v, attempting to reconnect", err)
+		d.Close()
+
+		// Give the device some rest.
+		time.Sleep(1000 * time.Millisecond)
+		if err := d.Open(); err != nil {
+			return fmt.Errorf("opening after reconnect: %v", err)
+		}
+		if err := d.OpenSession(); err != nil {
+			return fmt.Errorf("openSession after reconnect: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// standInResponder is a minimal PTP/IP camera serving an initiator at a
+// time.
+type standInResponder struct {
+	t   *testing.T
+	ln  net.Listener
+	iso uint16
+	// sessions counts the opened sessions.
+	sessions int32
+
+	cancelled chan uint32 // transaction IDs of Cancel packets
+	events    chan uint16 // codes of events sent by the initiator
+}
+
+func newStandInResponder(t *testing.T) *standInResponder {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &standInResponder{
+		t:         t,
+		ln:        ln,
+		iso:       800,
+		cancelled: make(chan uint32, 1),
+		events:    make(chan uint16, 1),
+	}
+	go r.serve()
+	return r
+}
+
+func (r *standInResponder) accept(wantType uint32) (*ptpipConn, []byte) {
+	conn, err := r.ln.Accept()
+	if err != nil {
+		return nil, nil
+	}
+	c := &ptpipConn{conn: conn}
+
+	typ, err := c.next()
+	if err != nil || typ != wantType {
+		r.t.Errorf("got packet type %d (err: %v), want %d", typ, err, wantType)
+		return nil, nil
+	}
+	payload, _ := c.payload()
+	return c, payload
+}
+
+func (r *standInResponder) serve() {
+	for r.serveConn() {
+	}
+}
+
+// serveConn serves a pair of connections and returns false once the listener
+// is closed.
+func (r *standInResponder) serveConn() bool {
+	cmd, _ := r.accept(ptpipInitCommandRequest)
+	if cmd == nil {
+		return false
+	}
+	defer cmd.Close()
+	var guid [16]byte
+	cmd.write(ptpipInitCommandAck, ptpipUint32(1), guid[:], ptpipString("Stand-in"), ptpipUint32(ptpipProtocolVersion))
+
+	event, payload := r.accept(ptpipInitEventRequest)
+	if event == nil {
+		return false
+	}
+	defer event.Close()
+	if byteOrder.Uint32(payload) != 1 {
+		r.t.Errorf("got connection number %d, want 1", byteOrder.Uint32(payload))
+	}
+	event.write(ptpipInitEventAck)
+
+	go func() {
+		for {
+			typ, err := event.next()
+			if err != nil {
+				return
+			}
+			payload, _ := event.payload()
+			if typ == ptpipEvent {
+				r.events <- byteOrder.Uint16(payload)
+			}
+		}
+	}()
+
+	for {
+		typ, err := cmd.next()
+		if err != nil {
+			return true
+		}
+		payload, _ := cmd.payload()
+		if typ != ptpipOperationRequest {
+			r.t.Errorf("got packet type %d, want Operation Request", typ)
+			return true
+		}
+
+		code := byteOrder.Uint16(payload[4:])
+		tid := byteOrder.Uint32(payload[6:])
+
+		switch code {
+		case OC_OpenSession:
+			atomic.AddInt32(&r.sessions, 1)
+			r.respond(cmd, RC_OK, tid)
+		case OC_CloseSession:
+			r.respond(cmd, RC_OK, tid)
+		case OC_GetObject:
+			// Stall in the middle of a Data packet like a dropped Wi-Fi
+			// link, until the initiator gives up the connection.
+			var total [8]byte
+			byteOrder.PutUint64(total[:], 1000)
+			cmd.write(ptpipStartData, ptpipUint32(tid), total[:])
+			var hdr [ptpipHdrLen]byte
+			byteOrder.PutUint32(hdr[:], ptpipHdrLen+4+1000)
+			byteOrder.PutUint32(hdr[4:], ptpipData)
+			cmd.conn.Write(append(hdr[:], ptpipUint32(tid)...))
+			cmd.conn.Write(make([]byte, 10))
+			cmd.next()
+			return true
+		case OC_GetDeviceInfo:
+			var buf bytes.Buffer
+			Encode(&buf, &DeviceInfo{Manufacturer: "Nikon Corporation", Model: "Z 6", SerialNumber: "1234567"})
+			r.sendData(cmd, tid, buf.Bytes())
+			r.respond(cmd, RC_OK, tid)
+		case OC_GetDevicePropValue:
+			var buf bytes.Buffer
+			Encode(&buf, &struct{ Value uint16 }{r.iso})
+			r.sendData(cmd, tid, buf.Bytes())
+			r.respond(cmd, RC_OK, tid)
+		case OC_SetDevicePropValue:
+			data := r.receiveData(cmd)
+			r.iso = byteOrder.Uint16(data)
+			r.respond(cmd, RC_OK, tid)
+		case OC_NIKON_AfDrive:
+			// Hang until the initiator cancels the transaction.
+			typ, _ := cmd.next()
+			payload, _ := cmd.payload()
+			if typ != ptpipCancel {
+				r.t.Errorf("got packet type %d, want Cancel", typ)
+				return true
+			}
+			r.cancelled <- byteOrder.Uint32(payload)
+			r.respond(cmd, RC_TransactionCanceled, tid)
+		default:
+			r.respond(cmd, RC_OperationNotSupported, tid)
+		}
+	}
+}
+
+func (r *standInResponder) respond(c *ptpipConn, code uint16, tid uint32) {
+	c.write(ptpipOperationResponse, []byte{byte(code), byte(code >> 8)}, ptpipUint32(tid))
+}
+
+// sendData splits data into a Data and an End Data packet.
+func (r *standInResponder) sendData(c *ptpipConn, tid uint32, data []byte) {
+	var total [8]byte
+	byteOrder.PutUint64(total[:], uint64(len(data)))
+	c.write(ptpipStartData, ptpipUint32(tid), total[:])
+	c.write(ptpipData, ptpipUint32(tid), data[:len(data)/2])
+	c.write(ptpipEndData, ptpipUint32(tid), data[len(data)/2:])
+}
+
+func (r *standInResponder) receiveData(c *ptpipConn) []byte {
+	var data []byte
+	for {
+		typ, _ := c.next()
+		payload, _ := c.payload()
+		switch typ {
+		case ptpipData:
+			data = append(data, payload[4:]...)
+		case ptpipEndData:
+			return append(data, payload[4:]...)
+		}
+	}
+}
+
+func TestDevicePTPIP(t *testing.T) {
+	r := newStandInResponder(t)
+	defer r.ln.Close()
+
+	dev := NewDevicePTPIP(r.ln.Addr().String())
+	if err := dev.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	if dev.responderName != "Stand-in" {
+		t.Errorf("got responder name %q", dev.responderName)
+	}
+
+	id, err := dev.ID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Product != "Z 6" || id.SerialNumber != "1234567" {
+		t.Errorf("unexpected ID: %+v", id)
+	}
+
+	err = dev.SetDevicePropValue(DPC_ExposureIndex, &struct{ Value uint16 }{3200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val := struct{ Value uint16 }{}
+	err = dev.GetDevicePropValue(DPC_ExposureIndex, &val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.Value != 3200 {
+		t.Errorf("got ISO %d, want 3200", val.Value)
+	}
+
+	err = dev.RunTransactionWithNoParams(OC_FormatStore)
+	if err != RCError(RC_OperationNotSupported) {
+		t.Errorf("got %v, want OperationNotSupported", err)
+	}
+}
+
+func TestDevicePTPIPCancel(t *testing.T) {
+	r := newStandInResponder(t)
+	defer r.ln.Close()
+
+	dev := NewDevicePTPIP(r.ln.Addr().String())
+	if err := dev.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_AfDrive)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("cancellation took %s", elapsed)
+	}
+
+	if code := <-r.events; code != EC_CancelTransaction {
+		t.Errorf("got event %s, want CancelTransaction", getName(EC_names, int(code)))
+	}
+	if tid := <-r.cancelled; tid != 1 {
+		t.Errorf("got cancelled transaction %d, want 1", tid)
+	}
+
+	// The connection is still usable.
+	val := struct{ Value uint16 }{}
+	if err = dev.GetDevicePropValue(DPC_ExposureIndex, &val); err != nil {
+		t.Fatal(err)
+	}
+	if val.Value != 800 {
+		t.Errorf("got ISO %d, want 800", val.Value)
+	}
+}
+
+func TestDevicePTPIPReconnect(t *testing.T) {
+	r := newStandInResponder(t)
+	defer r.ln.Close()
+
+	dev := NewDevicePTPIP(r.ln.Addr().String())
+	if err := dev.Configure(); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var buf bytes.Buffer
+	var req, rep Container
+	req.Code = OC_GetObject
+	req.Param = []uint32{1}
+	err := dev.RunTransactionContext(ctx, &req, &rep, &buf, nil, 0)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n := atomic.LoadInt32(&r.sessions); n != 2 {
+		t.Errorf("got %d sessions, want 2", n)
+	}
+
+	// The new connections are usable.
+	val := struct{ Value uint16 }{}
+	if err = dev.GetDevicePropValue(DPC_ExposureIndex, &val); err != nil {
+		t.Fatal(err)
+	}
+	if val.Value != 800 {
+		t.Errorf("got ISO %d, want 800", val.Value)
+	}
+}
+
+func TestPTPIPString(t *testing.T) {
+	enc := ptpipString("カメラ")
+	s, rest, err := decodePTPIPString(append(enc, 0xff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != "カメラ" || !bytes.Equal(rest, []byte{0xff}) {
+		t.Errorf("got %q and rest % x", s, rest)
+	}
+
+	if _, _, err = decodePTPIPString([]byte{0x41, 0x00}); err == nil {
+		t.Error("unterminated string should be rejected")
+	}
+}
@@ -107,7 +107,7 @@ func TestDeviceProperties(t *testing.T) {
 			t.Errorf("getObjectPropDesc(%s) failed: %v\n", name, err)
 		} else {
 			t.Logf("GetObjectPropDesc(%s) value: %#v %T\n", name, objPropDesc,
-				InstantiateType(objPropDesc.DataType).Interface())
+				InstantiateType(DecodeHints{Selector: objPropDesc.DataType}).Interface())
 		}
 	}
 
@@ -0,0 +1,135 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"strings"
+	"time"
+)
+
+// Driver implements live view and exposure control in the vendor specific
+// dialect of a camera. LVServer calls the methods with the device locked by
+// its scheduler, so drivers don't need their own locking.
+type Driver interface {
+	Name() string
+
+	StartLiveView(ctx context.Context) error
+	EndLiveView(ctx context.Context) error
+	LiveViewStatus(ctx context.Context) (bool, error)
+	LiveViewImg(ctx context.Context) (LiveView, error)
+	AutoFocus(ctx context.Context) error
+
+	// ISOs returns the available ISO values and the current one.
+	ISOs(ctx context.Context) ([]int, int, error)
+	SetISO(ctx context.Context, iso int) error
+	// FNs returns the available f-numbers and the current one.
+	FNs(ctx context.Context) ([]string, string, error)
+	SetFN(ctx context.Context, fn string) error
+
+	// GetPropUint and SetPropUint access an integer property by its standard
+	// or Nikon code, in the raw encoding of the camera.
+	GetPropUint(ctx context.Context, code uint16) (uint64, error)
+	SetPropUint(ctx context.Context, code uint16, v uint64) error
+}
+
+// errLiveViewInactive is returned by LiveViewImg when live view is off.
+var errLiveViewInactive = errors.New("failed to obtain an image: live view is not activated")
+
+// NewDriver returns the driver for the vendor of the device.
+func NewDriver(dev Device, id ID, info DeviceInfo, maxResolution bool) Driver {
+	switch detectVendor(id, info) {
+	case VENDOR_CANON:
+		return newCanonDriver(dev)
+	case VENDOR_SONY:
+		return newSonyDriver(dev)
+	case VENDOR_FUJI:
+		return newFujiDriver(dev)
+	}
+	return newNikonDriver(dev, id, info, maxResolution)
+}
+
+// detectVendor identifies the vendor by the extension ID in DeviceInfo. As
+// cameras in MTP mode report the Microsoft extension instead, it falls back
+// to the manufacturer name, then to Nikon which mtplvcap started with.
+func detectVendor(id ID, info DeviceInfo) uint32 {
+	switch info.MTPVendorExtensionID {
+	case VENDOR_NIKON, VENDOR_CANON, VENDOR_SONY, VENDOR_FUJI:
+		return info.MTPVendorExtensionID
+	}
+
+	m := strings.ToLower(info.Manufacturer + " " + id.Manufacturer)
+	switch {
+	case strings.Contains(m, "canon"):
+		return VENDOR_CANON
+	case strings.Contains(m, "sony"):
+		return VENDOR_SONY
+	case strings.Contains(m, "fuji"):
+		return VENDOR_FUJI
+	}
+	return VENDOR_NIKON
+}
+
+// propsMaxAge is how long the drivers which read all properties at once, Sony
+// and Canon, reuse them. frameCaptor reads ISO and f-number every frame.
+const propsMaxAge = 500 * time.Millisecond
+
+// capabilities is the set of operations and properties a device reports in
+// DeviceInfo. Everything is assumed supported if DeviceInfo is unavailable.
+type capabilities struct {
+	ops   map[uint16]bool
+	props map[uint16]bool
+}
+
+func newCapabilities(info DeviceInfo) capabilities {
+	if len(info.OperationsSupported) == 0 {
+		return capabilities{}
+	}
+
+	c := capabilities{
+		ops:   map[uint16]bool{},
+		props: map[uint16]bool{},
+	}
+	for _, code := range info.OperationsSupported {
+		c.ops[code] = true
+	}
+	for _, code := range info.DevicePropertiesSupported {
+		c.props[code] = true
+	}
+	return c
+}
+
+func (c capabilities) op(code uint16) bool {
+	return c.ops == nil || c.ops[code]
+}
+
+func (c capabilities) prop(code uint16) bool {
+	return c.props == nil || c.props[code]
+}
+
+// extractJPEG returns the JPEG image in data, skipping the header and the
+// trailer some vendors put around live view frames.
+func extractJPEG(data []byte) ([]byte, error) {
+	start := bytes.Index(data, []byte{0xff, 0xd8})
+	end := bytes.LastIndex(data, []byte{0xff, 0xd9})
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("the data has no JPEG image")
+	}
+	return data[start : end+2], nil
+}
+
+// liveViewFromJPEG makes a LiveView of a bare JPEG image.
+func liveViewFromJPEG(img []byte) (LiveView, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return LiveView{}, fmt.Errorf("failed to decode the image: %s", err)
+	}
+
+	return LiveView{
+		LVWidth:  int16(cfg.Width),
+		LVHeight: int16(cfg.Height),
+		JPEG:     img,
+	}, nil
+}
@@ -0,0 +1,359 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Canon EOS values of DPC_CANON_EOS_EVFOutputDevice
+const (
+	canonEVFOutputTFT = 1
+	canonEVFOutputPC  = 2
+)
+
+// canonViewFinderRecordJPEG is the record type of the image in the data of
+// GetViewFinderData.
+const canonViewFinderRecordJPEG = 1
+
+// canonISOs maps the EOS encoding of ISO speeds to the values. 0 is Auto.
+var canonISOs = map[uint32]int{
+	0x00: 0, 0x28: 6, 0x30: 12, 0x38: 25, 0x40: 50, 0x43: 64, 0x45: 80,
+	0x48: 100, 0x4b: 125, 0x4d: 160, 0x50: 200, 0x53: 250, 0x55: 320,
+	0x58: 400, 0x5b: 500, 0x5d: 640, 0x60: 800, 0x63: 1000, 0x65: 1250,
+	0x68: 1600, 0x6b: 2000, 0x6d: 2500, 0x70: 3200, 0x73: 4000, 0x75: 5000,
+	0x78: 6400, 0x7b: 8000, 0x7d: 10000, 0x80: 12800, 0x83: 16000, 0x85: 20000,
+	0x88: 25600, 0x8b: 32000, 0x8d: 40000, 0x90: 51200, 0x93: 64000, 0x95: 80000,
+	0x98: 102400, 0xa0: 204800, 0xa8: 409600, 0xb0: 819200,
+}
+
+// canonApertures maps the EOS encoding of f-numbers to the values. Some
+// values appear twice since lenses use either 1/3 or 1/2 stops.
+var canonApertures = map[uint32]string{
+	0x08: "1", 0x0b: "1.1", 0x0c: "1.2", 0x0d: "1.2", 0x10: "1.4", 0x13: "1.6",
+	0x14: "1.8", 0x15: "1.8", 0x18: "2", 0x1b: "2.2", 0x1c: "2.5", 0x1d: "2.5",
+	0x20: "2.8", 0x23: "3.2", 0x24: "3.5", 0x25: "3.5", 0x28: "4", 0x2b: "4.5",
+	0x2c: "4.5", 0x2d: "5", 0x30: "5.6", 0x33: "6.3", 0x34: "6.7", 0x35: "7.1",
+	0x38: "8", 0x3b: "9", 0x3c: "9.5", 0x3d: "10", 0x40: "11", 0x43: "13",
+	0x44: "13", 0x45: "14", 0x48: "16", 0x4b: "18", 0x4c: "19", 0x4d: "20",
+	0x50: "22", 0x53: "25", 0x54: "27", 0x55: "29", 0x58: "32", 0x5b: "36",
+	0x5c: "38", 0x5d: "40", 0x60: "45", 0x63: "51", 0x64: "54", 0x65: "57",
+	0x68: "64", 0x6b: "72", 0x6c: "76", 0x6d: "80", 0x70: "91",
+}
+
+// canonPropCodes maps the standard property codes to the EOS ones.
+var canonPropCodes = map[uint16]uint16{
+	DPC_ExposureIndex:       DPC_CANON_EOS_ISOSpeed,
+	DPC_FNumber:             DPC_CANON_EOS_Aperture,
+	DPC_ExposureTime:        DPC_CANON_EOS_ShutterSpeed,
+	DPC_WhiteBalance:        DPC_CANON_EOS_WhiteBalance,
+	DPC_FocusMode:           DPC_CANON_EOS_FocusMode,
+	DPC_ExposureProgramMode: DPC_CANON_EOS_AutoExposureMode,
+}
+
+// canonProps holds the properties reported by GetEvent. EOS bodies don't
+// support GetDevicePropDesc; they push the values and the available choices
+// as events instead.
+type canonProps struct {
+	values map[uint16]uint32
+	avail  map[uint16][]uint32
+}
+
+func newCanonProps() *canonProps {
+	return &canonProps{
+		values: map[uint16]uint32{},
+		avail:  map[uint16][]uint32{},
+	}
+}
+
+// update applies the records in the data of GetEvent. Each record starts
+// with its size and type, and a record of type 0 terminates the list.
+func (cp *canonProps) update(data []byte) error {
+	for len(data) >= 8 {
+		size := byteOrder.Uint32(data)
+		typ := byteOrder.Uint32(data[4:])
+		if typ == 0 {
+			return nil
+		} else if size < 8 || uint64(size) > uint64(len(data)) {
+			return fmt.Errorf("invalid event record size: %d", size)
+		}
+		rec := data[8:size]
+		data = data[size:]
+
+		switch typ {
+		case EC_CANON_EOS_PropValueChanged:
+			if len(rec) < 8 {
+				// Values other than integers, e.g. strings, are not used.
+				continue
+			}
+			code := uint16(byteOrder.Uint32(rec))
+			cp.values[code] = byteOrder.Uint32(rec[4:])
+		case EC_CANON_EOS_AvailListChanged:
+			if len(rec) < 12 {
+				return fmt.Errorf("short AvailListChanged record: %d bytes", len(rec))
+			}
+			code := uint16(byteOrder.Uint32(rec))
+			count := byteOrder.Uint32(rec[8:])
+			if uint64(count)*4 > uint64(len(rec)-12) {
+				return fmt.Errorf("AvailListChanged record of %s has only %d bytes for %d values", getName(DPC_names, int(code)), len(rec), count)
+			}
+			avail := make([]uint32, count)
+			for i := range avail {
+				avail[i] = byteOrder.Uint32(rec[12+4*i:])
+			}
+			cp.avail[code] = avail
+		default:
+			log.LV.Tracef("Canon event %s", getName(EC_names, int(typ)))
+		}
+	}
+	return nil
+}
+
+// canonDriver drives Canon EOS cameras with the EOS extensions.
+type canonDriver struct {
+	dev    Device
+	props  *canonProps
+	remote bool
+	// synced is when the events were fetched last.
+	synced time.Time
+}
+
+func newCanonDriver(dev Device) *canonDriver {
+	return &canonDriver{
+		dev:   dev,
+		props: newCanonProps(),
+	}
+}
+
+func (c *canonDriver) Name() string {
+	return "Canon EOS"
+}
+
+// sync enables the remote mode once, then fetches the pending property
+// changes unless they were fetched recently.
+func (c *canonDriver) sync(ctx context.Context) error {
+	if !c.remote {
+		err := c.run(ctx, OC_CANON_EOS_SetRemoteMode, 1)
+		if err != nil {
+			return fmt.Errorf("failed to enable the remote mode: %s", err)
+		}
+		err = c.run(ctx, OC_CANON_EOS_SetEventMode, 1)
+		if err != nil {
+			return fmt.Errorf("failed to enable the event mode: %s", err)
+		}
+		c.remote = true
+	}
+	if time.Since(c.synced) < propsMaxAge {
+		return nil
+	}
+
+	var req, rep Container
+	buf := bytes.NewBuffer([]byte{})
+
+	req.Code = OC_CANON_EOS_GetEvent
+	req.Param = []uint32{}
+	err := c.dev.RunTransactionContext(ctx, &req, &rep, buf, nil, 0)
+	if err != nil {
+		return fmt.Errorf("failed to get events: %s", err)
+	}
+	c.synced = time.Now()
+	return c.props.update(buf.Bytes())
+}
+
+func (c *canonDriver) run(ctx context.Context, code uint16, params ...uint32) error {
+	var req, rep Container
+	req.Code = code
+	req.Param = params
+	return c.dev.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
+}
+
+func (c *canonDriver) setProp(ctx context.Context, code uint16, v uint32) error {
+	data := make([]byte, 12)
+	byteOrder.PutUint32(data, uint32(len(data)))
+	byteOrder.PutUint32(data[4:], uint32(code))
+	byteOrder.PutUint32(data[8:], v)
+
+	var req, rep Container
+	req.Code = OC_CANON_EOS_SetDevicePropValueEx
+	req.Param = []uint32{}
+	err := c.dev.RunTransactionContext(ctx, &req, &rep, nil, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", getName(DPC_names, int(code)), err)
+	}
+	c.props.values[code] = v
+	return nil
+}
+
+func (c *canonDriver) StartLiveView(ctx context.Context) error {
+	err := c.sync(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start live view: %s", err)
+	}
+
+	// Only some bodies have EVFMode; the others enable live view with the
+	// output device alone.
+	err = c.setProp(ctx, DPC_CANON_EOS_EVFMode, 1)
+	if err != nil {
+		log.LV.Debugf("failed to enable EVF mode: %s", err)
+	}
+
+	err = c.setProp(ctx, DPC_CANON_EOS_EVFOutputDevice, canonEVFOutputPC)
+	if err != nil {
+		return fmt.Errorf("failed to start live view: %s", err)
+	}
+	return nil
+}
+
+func (c *canonDriver) EndLiveView(ctx context.Context) error {
+	if !c.remote {
+		return nil
+	}
+
+	err := c.setProp(ctx, DPC_CANON_EOS_EVFOutputDevice, canonEVFOutputTFT)
+	if err != nil {
+		return fmt.Errorf("failed to end live view: %s", err)
+	}
+	return nil
+}
+
+func (c *canonDriver) LiveViewStatus(ctx context.Context) (bool, error) {
+	err := c.sync(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get live view status: %s", err)
+	}
+	return c.props.values[DPC_CANON_EOS_EVFOutputDevice]&canonEVFOutputPC != 0, nil
+}
+
+func (c *canonDriver) LiveViewImg(ctx context.Context) (LiveView, error) {
+	var req, rep Container
+	buf := bytes.NewBuffer([]byte{})
+
+	req.Code = OC_CANON_EOS_GetViewFinderData
+	req.Param = []uint32{0x00200000, 0, 0}
+	err := c.dev.RunTransactionContext(ctx, &req, &rep, buf, nil, 0)
+	if err != nil {
+		if casted, ok := err.(RCError); ok && uint16(casted) == RC_CANON_NOT_READY {
+			return LiveView{}, errLiveViewInactive
+		}
+		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
+	}
+
+	img, err := canonViewFinderJPEG(buf.Bytes())
+	if err != nil {
+		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
+	}
+
+	return liveViewFromJPEG(img)
+}
+
+// canonViewFinderJPEG extracts the image from the records in the data of
+// GetViewFinderData. The other records hold the zoom and histogram data.
+func canonViewFinderJPEG(data []byte) ([]byte, error) {
+	for len(data) >= 8 {
+		size := byteOrder.Uint32(data)
+		typ := byteOrder.Uint32(data[4:])
+		if size < 8 || uint64(size) > uint64(len(data)) {
+			return nil, fmt.Errorf("invalid record size: %d", size)
+		}
+		if typ == canonViewFinderRecordJPEG {
+			return data[8:size], nil
+		}
+		data = data[size:]
+	}
+	return nil, fmt.Errorf("the data has no image")
+}
+
+func (c *canonDriver) AutoFocus(ctx context.Context) error {
+	err := c.run(ctx, OC_CANON_EOS_DoAf)
+	if err != nil {
+		return fmt.Errorf("failed to do auto focus: %s", err)
+	}
+	return nil
+}
+
+func (c *canonDriver) ISOs(ctx context.Context) ([]int, int, error) {
+	err := c.sync(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	isos := make([]int, 0)
+	for _, v := range c.props.avail[DPC_CANON_EOS_ISOSpeed] {
+		if iso, ok := canonISOs[v]; ok {
+			isos = append(isos, iso)
+		}
+	}
+	return isos, canonISOs[c.props.values[DPC_CANON_EOS_ISOSpeed]], nil
+}
+
+func (c *canonDriver) SetISO(ctx context.Context, iso int) error {
+	for _, v := range c.props.avail[DPC_CANON_EOS_ISOSpeed] {
+		if i, ok := canonISOs[v]; ok && i == iso {
+			return c.setProp(ctx, DPC_CANON_EOS_ISOSpeed, v)
+		}
+	}
+	return fmt.Errorf("failed to set ISO: %d is not available", iso)
+}
+
+func (c *canonDriver) FNs(ctx context.Context) ([]string, string, error) {
+	err := c.sync(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fns := make([]string, 0)
+	for _, v := range c.props.avail[DPC_CANON_EOS_Aperture] {
+		if fn, ok := canonApertures[v]; ok {
+			fns = append(fns, fn)
+		}
+	}
+
+	current, ok := canonApertures[c.props.values[DPC_CANON_EOS_Aperture]]
+	if !ok {
+		current = "0"
+	}
+	return fns, current, nil
+}
+
+func (c *canonDriver) SetFN(ctx context.Context, fn string) error {
+	fnf, err := strconv.ParseFloat(fn, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse f-number: %s", err)
+	}
+
+	for _, v := range c.props.avail[DPC_CANON_EOS_Aperture] {
+		f, _ := strconv.ParseFloat(canonApertures[v], 64)
+		if f == fnf {
+			return c.setProp(ctx, DPC_CANON_EOS_Aperture, v)
+		}
+	}
+	return fmt.Errorf("failed to set f-number: %s is not available", fn)
+}
+
+func (c *canonDriver) GetPropUint(ctx context.Context, code uint16) (uint64, error) {
+	eos, ok := canonPropCodes[code]
+	if !ok {
+		return 0, fmt.Errorf("%s is not supported by Canon EOS", getName(DPC_names, int(code)))
+	}
+
+	err := c.sync(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	v, ok := c.props.values[eos]
+	if !ok {
+		return 0, fmt.Errorf("%s is not reported by the camera", getName(DPC_names, int(eos)))
+	}
+	return uint64(v), nil
+}
+
+func (c *canonDriver) SetPropUint(ctx context.Context, code uint16, v uint64) error {
+	eos, ok := canonPropCodes[code]
+	if !ok {
+		return fmt.Errorf("%s is not supported by Canon EOS", getName(DPC_names, int(code)))
+	}
+	return c.setProp(ctx, eos, uint32(v))
+}
@@ -0,0 +1,64 @@
+package mtp
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func canonRecord(typ uint32, words ...uint32) []byte {
+	rec := make([]byte, 8+4*len(words))
+	byteOrder.PutUint32(rec, uint32(len(rec)))
+	byteOrder.PutUint32(rec[4:], typ)
+	for i, w := range words {
+		byteOrder.PutUint32(rec[8+4*i:], w)
+	}
+	return rec
+}
+
+func TestCanonPropsUpdate(t *testing.T) {
+	var data []byte
+	data = append(data, canonRecord(EC_CANON_EOS_AvailListChanged, DPC_CANON_EOS_ISOSpeed, 3, 3, 0x48, 0x50, 0x58)...)
+	data = append(data, canonRecord(EC_CANON_EOS_PropValueChanged, DPC_CANON_EOS_ISOSpeed, 0x50)...)
+	data = append(data, canonRecord(EC_CANON_EOS_ObjectAddedEx, 0x1234)...)
+	data = append(data, canonRecord(0)...)
+	data = append(data, 0xff, 0xff)
+
+	cp := newCanonProps()
+	if err := cp.update(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []uint32{0x48, 0x50, 0x58}; !reflect.DeepEqual(cp.avail[DPC_CANON_EOS_ISOSpeed], want) {
+		t.Errorf("got avail %v, want %v", cp.avail[DPC_CANON_EOS_ISOSpeed], want)
+	}
+	if v := cp.values[DPC_CANON_EOS_ISOSpeed]; canonISOs[v] != 200 {
+		t.Errorf("got ISO 0x%x, want ISO 200", v)
+	}
+
+	bad := canonRecord(EC_CANON_EOS_AvailListChanged, DPC_CANON_EOS_Aperture, 3, 10, 0x20)
+	if err := cp.update(bad); err == nil {
+		t.Error("count beyond the record should be rejected")
+	}
+}
+
+func TestCanonViewFinderJPEG(t *testing.T) {
+	img := []byte{0xff, 0xd8, 0xff, 0xd9}
+
+	var data []byte
+	data = append(data, canonRecord(0x0b, 1, 2)...)
+	data = append(data, 12, 0, 0, 0, canonViewFinderRecordJPEG, 0, 0, 0)
+	data = append(data, img...)
+
+	got, err := canonViewFinderJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, img) {
+		t.Errorf("got % x, want % x", got, img)
+	}
+
+	if _, err = canonViewFinderJPEG(canonRecord(0x0b, 1)); err == nil {
+		t.Error("data without an image should be rejected")
+	}
+}
@@ -0,0 +1,228 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Fujifilm PTP extensions
+
+const (
+	DPC_FUJI_ExposureIndex  = 0xD02A
+	DPC_FUJI_PriorityMode   = 0xD207
+	DPC_FUJI_CaptureControl = 0xD208
+	DPC_FUJI_AFStatus       = 0xD209
+)
+
+// fujiLiveViewHandle is the object handle of the live view frame while an
+// open capture is in progress.
+const fujiLiveViewHandle = 0x80000001
+
+const (
+	fujiPriorityPC       = 2
+	fujiCaptureControlAF = 0x0200
+
+	fujiAFStatusBusy = 1
+	fujiAFStatusOK   = 2
+)
+
+// Fujifilm ISO values have flags in the upper 16 bits, e.g. for extended
+// ISOs, and the Auto ISO presets are negative.
+const (
+	fujiISOMask = 0x0000FFFF
+	fujiISOAuto = 0xFFFF0000
+)
+
+// fujiDriver drives Fujifilm X cameras in the USB tethering mode.
+type fujiDriver struct {
+	dev   Device
+	props *propAccessor
+
+	open    bool
+	openTID uint32
+}
+
+func newFujiDriver(dev Device) *fujiDriver {
+	return &fujiDriver{
+		dev:   dev,
+		props: newPropAccessor(dev),
+	}
+}
+
+func (f *fujiDriver) Name() string {
+	return "Fujifilm"
+}
+
+func (f *fujiDriver) run(ctx context.Context, dest io.Writer, code uint16, params ...uint32) (Container, error) {
+	var req, rep Container
+	req.Code = code
+	req.Param = params
+	err := f.dev.RunTransactionContext(ctx, &req, &rep, dest, nil, 0)
+	return rep, err
+}
+
+func (f *fujiDriver) StartLiveView(ctx context.Context) error {
+	// Let the camera take commands from the PC rather than its own buttons.
+	err := f.props.setUint(ctx, DPC_FUJI_PriorityMode, fujiPriorityPC)
+	if err != nil {
+		log.LV.Debugf("failed to set the priority mode: %s", err)
+	}
+
+	rep, err := f.run(ctx, nil, OC_InitiateOpenCapture, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to start live view: %s", err)
+	}
+	f.open, f.openTID = true, rep.TransactionID
+	return nil
+}
+
+func (f *fujiDriver) EndLiveView(ctx context.Context) error {
+	if !f.open {
+		return nil
+	}
+
+	_, err := f.run(ctx, nil, OC_TerminateOpenCapture, f.openTID)
+	f.open = false
+	if err != nil {
+		return fmt.Errorf("failed to end live view: %s", err)
+	}
+	return nil
+}
+
+func (f *fujiDriver) LiveViewStatus(ctx context.Context) (bool, error) {
+	return f.open, nil
+}
+
+func (f *fujiDriver) LiveViewImg(ctx context.Context) (LiveView, error) {
+	if !f.open {
+		return LiveView{}, errLiveViewInactive
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, liveViewTimeout)
+	defer cancel()
+
+	buf := &bytes.Buffer{}
+	_, err := f.run(ctx, buf, OC_GetObject, fujiLiveViewHandle)
+	if err != nil {
+		if casted, ok := err.(RCError); ok && uint16(casted) == RC_InvalidObjectHandle {
+			// The camera ended the open capture by itself.
+			f.open = false
+			return LiveView{}, errLiveViewInactive
+		}
+		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
+	}
+
+	img, err := extractJPEG(buf.Bytes())
+	if err != nil {
+		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
+	}
+	return liveViewFromJPEG(img)
+}
+
+func (f *fujiDriver) AutoFocus(ctx context.Context) error {
+	err := f.props.setUint(ctx, DPC_FUJI_CaptureControl, fujiCaptureControlAF)
+	if err != nil {
+		return fmt.Errorf("failed to do auto focus: %s", err)
+	}
+
+	_, err = f.run(ctx, nil, OC_InitiateCapture, 0, 0)
+	if err != nil {
+		return fmt.Errorf("failed to do auto focus: %s", err)
+	}
+
+	for {
+		status, err := f.props.getUint(ctx, DPC_FUJI_AFStatus)
+		if err != nil {
+			return fmt.Errorf("failed to do auto focus: %s", err)
+		} else if status == fujiAFStatusOK {
+			return nil
+		} else if status != fujiAFStatusBusy {
+			return fmt.Errorf("failed to do auto focus: the camera couldn't focus")
+		}
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func fujiISO(v uint64) int {
+	if v&fujiISOAuto == fujiISOAuto {
+		return 0
+	}
+	return int(v & fujiISOMask)
+}
+
+func (f *fujiDriver) ISOs(ctx context.Context) ([]int, int, error) {
+	e, err := f.props.enum(ctx, DPC_FUJI_ExposureIndex)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	isos := make([]int, 0)
+	seen := map[int]bool{}
+	for _, v := range e.values {
+		iso := fujiISO(v)
+		if !seen[iso] {
+			isos = append(isos, iso)
+			seen[iso] = true
+		}
+	}
+	return isos, fujiISO(e.current), nil
+}
+
+func (f *fujiDriver) SetISO(ctx context.Context, iso int) error {
+	e, err := f.props.enum(ctx, DPC_FUJI_ExposureIndex)
+	if err != nil {
+		return fmt.Errorf("failed to set ISO: %w", err)
+	}
+
+	for _, v := range e.values {
+		if fujiISO(v) == iso {
+			return f.props.setUint(ctx, DPC_FUJI_ExposureIndex, v)
+		}
+	}
+	return fmt.Errorf("failed to set ISO: %d is not available", iso)
+}
+
+func (f *fujiDriver) FNs(ctx context.Context) ([]string, string, error) {
+	e, err := f.props.enum(ctx, DPC_FNumber)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fns := make([]string, 0)
+	for _, v := range e.values {
+		fns = append(fns, strconv.FormatFloat(float64(v)/100, 'f', -1, 64))
+	}
+	return fns, strconv.FormatFloat(float64(e.current)/100, 'f', -1, 64), nil
+}
+
+func (f *fujiDriver) SetFN(ctx context.Context, fn string) error {
+	fnf, err := strconv.ParseFloat(fn, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse f-number: %s", err)
+	}
+	return f.props.setUint(ctx, DPC_FNumber, uint64(math.Round(fnf*100)))
+}
+
+func (f *fujiDriver) GetPropUint(ctx context.Context, code uint16) (uint64, error) {
+	if code == DPC_ExposureIndex {
+		code = DPC_FUJI_ExposureIndex
+	}
+	return f.props.getUint(ctx, code)
+}
+
+func (f *fujiDriver) SetPropUint(ctx context.Context, code uint16, v uint64) error {
+	if code == DPC_ExposureIndex {
+		code = DPC_FUJI_ExposureIndex
+	}
+	return f.props.setUint(ctx, code, v)
+}
@@ -0,0 +1,513 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// nikonDriver drives Nikon DSLRs and mirrorless cameras with the Nikon MTP
+// extensions.
+type nikonDriver struct {
+	dev           Device
+	model         Model
+	caps          capabilities
+	maxResolution bool
+	props         *propAccessor
+}
+
+func newNikonDriver(dev Device, id ID, info DeviceInfo, maxResolution bool) *nikonDriver {
+	product := info.Model
+	if product == "" {
+		product = id.Product
+	}
+
+	model, ok := models.Match(product)
+	if ok {
+		log.LV.Debugf("model matched: %s", model.Name)
+	} else {
+		model = models.Generic()
+		log.LV.Debugf("model didn't match, falling back to the generic model %s", model.Name)
+	}
+
+	caps := newCapabilities(info)
+	if !caps.op(OC_NIKON_StartLiveView) || !caps.op(OC_NIKON_GetLiveViewImg) {
+		log.LV.Warningf("%s doesn't report the live view operations, live view may not work", product)
+	}
+
+	return &nikonDriver{
+		dev:           dev,
+		model:         model,
+		caps:          caps,
+		maxResolution: maxResolution,
+		props:         newPropAccessor(dev),
+	}
+}
+
+func (n *nikonDriver) Name() string {
+	return "Nikon " + n.model.Name
+}
+
+func (n *nikonDriver) StartLiveView(ctx context.Context) error {
+	if n.caps.op(OC_NIKON_DeviceReady) {
+		err := n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_DeviceReady)
+		if err != nil {
+			return fmt.Errorf("failed to start live view: the camera is not ready")
+		}
+	}
+
+	var err error
+	if n.model.QuirkSwitchMedia && n.caps.prop(DPC_NIKON_RecordingMedia) {
+		err = n.switchRecordMedia(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to switch recording media: %s", err)
+		}
+	}
+
+	if n.maxResolution && !n.caps.prop(DPC_NIKON_Resolution) {
+		log.LV.Warningf("the camera doesn't support changing the image resolution")
+	} else if n.maxResolution {
+		err = n.changeResolution(ctx)
+		if err != nil {
+			log.LV.Warningf("failed to change the image resolution (%s); if it affects capturing frames, consider disabling `-max-resolution`", err)
+		}
+	}
+
+	err = n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_StartLiveView)
+	if err == RCError(RC_NIKON_InvalidStatus) && n.probeSwitchMedia(ctx) {
+		err = n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_StartLiveView)
+	}
+	if err != nil {
+		if casted, ok := err.(RCError); ok && uint16(casted) == RC_NIKON_InvalidStatus {
+			log.LV.Error("failed to start live view (InvalidStatus). Investigating the reason...")
+			cond, err := n.liveViewProhibitCondition(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to start live view and failed to investigate the reason: %s", err)
+			}
+			return fmt.Errorf("failed to start live view, reason: %s", prohibitReason(cond))
+		}
+		return fmt.Errorf("failed to start live view: %s", err)
+	}
+	return nil
+}
+
+// probeSwitchMedia detects bodies which refuse live view while recording to
+// the card, and switches the recording media of them. It returns true if the
+// media is switched and starting live view is worth retrying.
+func (n *nikonDriver) probeSwitchMedia(ctx context.Context) bool {
+	if n.model.QuirkSwitchMedia || !n.caps.prop(DPC_NIKON_RecordingMedia) {
+		return false
+	}
+
+	cond, err := n.liveViewProhibitCondition(ctx)
+	if err != nil || cond&1 == 0 {
+		return false
+	}
+
+	log.LV.Info("the camera refuses live view while recording to the card, switching to the SDRAM")
+	err = n.switchRecordMedia(ctx)
+	if err != nil {
+		log.LV.Warningf("failed to switch recording media: %s", err)
+		return false
+	}
+	n.model.QuirkSwitchMedia = true
+	return true
+}
+
+func (n *nikonDriver) switchRecordMedia(ctx context.Context) error {
+	desc := DevicePropDesc{}
+	err := n.dev.GetDevicePropDescContext(ctx, DPC_NIKON_RecordingMedia, &desc)
+	if err != nil {
+		return fmt.Errorf("failed to get recording media: %s", err)
+	}
+
+	if currentMedia, ok := desc.CurrentValue.(int8); ok {
+		if currentMedia == int8(RecordingMediaCard) {
+			log.LV.Debug("current recording media: card")
+			log.LV.Debug("the recording media is the card. Switching it to the SDRAM.")
+			payload := struct {
+				Media RecordingMedia
+			}{
+				Media: RecordingMediaSDRAM,
+			}
+			err = n.dev.SetDevicePropValueContext(ctx, DPC_NIKON_RecordingMedia, &payload)
+			if err != nil {
+				return fmt.Errorf("failed to SetDevicePropValue: %s", err)
+			}
+		} else {
+			log.LV.Debug("current recording media: SDRAM")
+		}
+	} else {
+		log.LV.Warning("unexpected format of the RecordingMedia property")
+	}
+	return nil
+}
+
+func (n *nikonDriver) changeResolution(ctx context.Context) error {
+	log.LV.Infof("getting available resolutions")
+	desc := DevicePropDesc{}
+	err := n.dev.GetDevicePropDescContext(ctx, DPC_NIKON_Resolution, &desc)
+	if err != nil {
+		return fmt.Errorf("failed to get recording media: %s", err)
+	}
+
+	values, ok := desc.Form.(*PropDescEnumForm)
+	if !ok {
+		return fmt.Errorf("failed to assert returned value (DPC_NIKON_Resolution)")
+	}
+
+	var choices []uint64
+	for _, iface := range values.Values {
+		v, ok := propUint(iface)
+		if !ok {
+			return fmt.Errorf("failed to assert a value in the array as integer")
+		}
+		choices = append(choices, v)
+	}
+
+	log.LV.Infof("available resolutions (higher is larger): %v", choices)
+	log.LV.Infof("automatically use the largest choice: %d", choices[len(choices)-1])
+
+	// The width of the property differs by body, so write it as described.
+	return n.props.setUint(ctx, DPC_NIKON_Resolution, choices[len(choices)-1])
+}
+
+func (n *nikonDriver) liveViewProhibitCondition(ctx context.Context) (uint32, error) {
+	var reasonRaw Uint32Value
+	err := n.dev.GetDevicePropValueContext(ctx, DPC_NIKON_LiveViewProhibitCondition, &reasonRaw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read LiveViewProhibitCondition: %s", err)
+	}
+	return reasonRaw.Value, nil
+}
+
+// ProhibitReason is a reason why the camera refuses to start live view, with
+// a hint to resolve it.
+type ProhibitReason struct {
+	Bit    int    `json:"bit"`
+	Reason string `json:"reason"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// prohibitReasons maps the bits of DPC_NIKON_LiveViewProhibitCondition.
+var prohibitReasons = map[int]ProhibitReason{
+	0:  {Reason: "recording destination is the card", Hint: "set the recording destination to the SDRAM"},
+	2:  {Reason: "sequence error", Hint: "wait for the camera to finish the current operation"},
+	4:  {Reason: "button is fully pressed", Hint: "release the shutter button"},
+	5:  {Reason: "aperture value is set by the lens", Hint: "lock the aperture ring of the lens at the minimum aperture"},
+	6:  {Reason: "bulb error", Hint: "change the shutter speed from Bulb or Time"},
+	7:  {Reason: "during cleaning", Hint: "wait for the image sensor cleaning to finish"},
+	8:  {Reason: "insufficient battery", Hint: "charge or replace the battery, or connect an AC adapter"},
+	9:  {Reason: "TTL error", Hint: "check the flash unit and its TTL setting"},
+	11: {Reason: "non-CPU lens is mounted and the mode is not M", Hint: "switch the exposure mode to M or mount a CPU lens"},
+	12: {Reason: "there are images which are recorded in SDRAM", Hint: "wait for the camera to finish writing the images"},
+	13: {Reason: "the release mode is mirror-up", Hint: "switch the release mode dial from Mup"},
+	14: {Reason: "no card inserted", Hint: "insert a memory card, or set the slot empty release lock to enable release"},
+	15: {Reason: "shot command is being processed", Hint: "wait for the shot to finish"},
+	16: {Reason: "shooting in progress", Hint: "wait for the shooting to finish"},
+	17: {Reason: "overheated", Hint: "turn the camera off and let it cool down"},
+	18: {Reason: "card is protected", Hint: "slide the write-protect switch of the card to unlock it"},
+	19: {Reason: "card error", Hint: "reinsert or replace the memory card"},
+	20: {Reason: "card is not formatted", Hint: "format the memory card in the camera"},
+	21: {Reason: "bulb error", Hint: "change the shutter speed from Bulb or Time"},
+	22: {Reason: "the release mode is mirror-up and it is being processed", Hint: "switch the release mode dial from Mup"},
+	24: {Reason: "the lens is not extended", Hint: "extend the retractable lens with its zoom ring"},
+}
+
+// decodeProhibitCondition returns the reasons of every bit set in cond.
+func decodeProhibitCondition(cond uint32) []ProhibitReason {
+	var reasons []ProhibitReason
+	for i := 0; i < 32; i++ {
+		if cond&(1<<uint(i)) == 0 {
+			continue
+		}
+		r, ok := prohibitReasons[i]
+		if !ok {
+			r.Reason = fmt.Sprintf("unknown reason (bit %d)", i)
+		}
+		r.Bit = i
+		reasons = append(reasons, r)
+	}
+	return reasons
+}
+
+func prohibitReason(cond uint32) string {
+	reasons := decodeProhibitCondition(cond)
+	if len(reasons) == 0 {
+		return "(empty)"
+	}
+
+	var msgs []string
+	for _, r := range reasons {
+		if r.Hint != "" {
+			msgs = append(msgs, fmt.Sprintf("%s (%s)", r.Reason, r.Hint))
+		} else {
+			msgs = append(msgs, r.Reason)
+		}
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// LiveViewProhibitReasons reads why the camera refuses to start live view.
+func (n *nikonDriver) LiveViewProhibitReasons(ctx context.Context) ([]ProhibitReason, error) {
+	if !n.caps.prop(DPC_NIKON_LiveViewProhibitCondition) {
+		return nil, nil
+	}
+
+	cond, err := n.liveViewProhibitCondition(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return decodeProhibitCondition(cond), nil
+}
+
+func (n *nikonDriver) EndLiveView(ctx context.Context) error {
+	err := n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_EndLiveView)
+	if err != nil {
+		return fmt.Errorf("failed to end live view: %s", err)
+	}
+	return nil
+}
+
+func (n *nikonDriver) LiveViewStatus(ctx context.Context) (bool, error) {
+	val := StringValue{}
+	err := n.dev.GetDevicePropValueContext(ctx, DPC_NIKON_LiveViewStatus, &val)
+
+	if err != nil && err != io.EOF {
+		return false, fmt.Errorf("failed to get live view status: %s", err)
+	}
+
+	return err == io.EOF, nil
+}
+
+func (n *nikonDriver) AutoFocus(ctx context.Context) error {
+	err := n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_AfDrive)
+	if err != nil {
+		return fmt.Errorf("failed to do auto focus: %s", err)
+	}
+	return nil
+}
+
+type liveViewRaw struct {
+	LVWidth             int16
+	LVHeight            int16
+	Width               int16
+	Height              int16
+	Dummy1              [8]byte
+	FocusFrameWidth     int16
+	FocusFrameHeight    int16
+	FocusX              int16
+	FocusY              int16
+	Dummy2              [5]byte
+	Rotation            int8
+	Dummy3              [10]byte
+	AutoFocus           int8
+	Dummy4              [15]byte
+	MovieTimeRemainInt  int16
+	MovieTimeRemainFrac int16
+	Recording           int8
+}
+
+func (n *nikonDriver) LiveViewImg(ctx context.Context) (LiveView, error) {
+	var req, rep Container
+	buf := bytes.NewBuffer([]byte{})
+
+	hs := n.model.HeaderSize
+
+	req.Code = OC_NIKON_GetLiveViewImg
+	req.Param = []uint32{}
+	err := n.dev.RunTransactionContext(ctx, &req, &rep, buf, nil, 0)
+	if err != nil {
+		if casted, ok := err.(RCError); ok && uint16(casted) == RC_NIKON_NotLiveView {
+			return LiveView{}, errLiveViewInactive
+		}
+		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
+	}
+
+	raw := buf.Bytes()
+	if !isJPEGAt(raw, hs) {
+		probed, ok := probeHeaderSize(raw)
+		if !ok {
+			return LiveView{}, fmt.Errorf("failed to obtain an image: the data has no JPEG image")
+		}
+		log.LV.Infof("the live view header is %d bytes rather than %d, consider adding the model to -model-file", probed, hs)
+		n.model.HeaderSize = probed
+		hs = probed
+	}
+
+	// Old bodies have headers shorter than liveViewRaw; the rest is zero.
+	header := make([]byte, binary.Size(liveViewRaw{}))
+	copy(header, raw[8:hs])
+
+	lvr := liveViewRaw{}
+	err = binary.Read(bytes.NewReader(header), binary.BigEndian, &lvr)
+	if err != nil {
+		return LiveView{}, fmt.Errorf("failed to decode header")
+	}
+
+	rot := Rotation0
+	if lvr.Rotation == 1 {
+		rot = RotationMinus90
+	} else if lvr.Rotation == 2 {
+		rot = Rotation90
+	} else if lvr.Rotation == 3 {
+		rot = Rotation180
+	}
+
+	af := AFNotActive
+	if lvr.AutoFocus == 1 {
+		af = AFFail
+	} else if lvr.AutoFocus == 2 {
+		af = AFSuccess
+	}
+
+	return LiveView{
+		LVWidth:          lvr.LVWidth,
+		LVHeight:         lvr.LVHeight,
+		Width:            lvr.Width,
+		Height:           lvr.Height,
+		FocusFrameWidth:  lvr.FocusFrameWidth,
+		FocusFrameHeight: lvr.FocusFrameHeight,
+		FocusX:           lvr.FocusX,
+		FocusY:           lvr.FocusY,
+		Rotation:         rot,
+		AutoFocus:        af,
+		Recording:        lvr.Recording == 1,
+		JPEG:             raw[hs:],
+	}, nil
+}
+
+func isJPEGAt(raw []byte, i int) bool {
+	return i >= 8 && i+2 <= len(raw) && raw[i] == 0xff && raw[i+1] == 0xd8
+}
+
+// probeHeaderSize measures the header of a live view frame by the JPEG SOI
+// marker following it.
+func probeHeaderSize(raw []byte) (int, bool) {
+	if len(raw) < 8 {
+		return 0, false
+	}
+
+	i := bytes.Index(raw[8:], []byte{0xff, 0xd8, 0xff})
+	if i < 0 {
+		return 0, false
+	}
+	return i + 8, true
+}
+
+func (n *nikonDriver) ISOs(ctx context.Context) ([]int, int, error) {
+	isoi := make([]int, 0)
+
+	val := DevicePropDesc{}
+	err := n.dev.GetDevicePropDescContext(ctx, DPC_ExposureIndex, &val)
+
+	if err != nil && err != io.EOF {
+		return isoi, 0, err
+	}
+
+	asserted, ok := val.Form.(*PropDescEnumForm)
+	if !ok {
+		return isoi, 0, fmt.Errorf("unexpedted type: could not assert that returned prop is enum form")
+	}
+
+	for _, raw := range asserted.Values {
+		iso, ok := raw.(uint64)
+		if !ok {
+			return isoi, 0, fmt.Errorf("unexpedted type: could not assert that form value is uint64")
+		}
+		isoi = append(isoi, int(iso))
+	}
+
+	currentISO, ok := val.CurrentValue.(uint16)
+	if !ok {
+		return isoi, 0, fmt.Errorf("unexpedted type: could not assert that current value is uint16")
+	}
+
+	return isoi, int(currentISO), nil
+}
+
+func (n *nikonDriver) SetISO(ctx context.Context, iso int) error {
+	err := n.dev.SetDevicePropValueContext(ctx, DPC_ExposureIndex, &struct {
+		ISO uint16
+	}{
+		ISO: uint16(iso),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set ISO: %w", err)
+	}
+	return nil
+}
+
+func (n *nikonDriver) FNs(ctx context.Context) ([]string, string, error) {
+	fns := make([]string, 0)
+
+	val := DevicePropDesc{}
+	err := n.dev.GetDevicePropDescContext(ctx, DPC_FNumber, &val)
+
+	if err != nil && err != io.EOF {
+		return fns, "", err
+	}
+
+	asserted, ok := val.Form.(*PropDescEnumForm)
+	if !ok {
+		return fns, "", fmt.Errorf("unexpedted type: could not assert that returned prop is enum form")
+	}
+
+	for _, raw := range asserted.Values {
+		fn, ok := raw.(uint64)
+		if !ok {
+			return fns, "", fmt.Errorf("unexpedted type: could not assert that form value is uint64")
+		}
+		fns = append(fns, strconv.FormatFloat(float64(fn)/100, 'f', -1, 64))
+	}
+
+	current, ok := val.CurrentValue.(uint16)
+	if !ok {
+		return fns, "", fmt.Errorf("unexpedted type: could not assert that current value is uint16")
+	}
+
+	return fns, strconv.FormatFloat(float64(current)/100, 'f', -1, 64), nil
+}
+
+func (n *nikonDriver) SetFN(ctx context.Context, fn string) error {
+	fnf, err := strconv.ParseFloat(fn, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse f-number: %s", err)
+	}
+
+	// Nikon bodies reject aperture changes during live view.
+	err = n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_EndLiveView)
+	if err != nil {
+		return fmt.Errorf("failed to set f-number: failed to stop live view: %w", err)
+	}
+
+	err = n.dev.SetDevicePropValueContext(ctx, DPC_FNumber, &struct {
+		FN uint16
+	}{
+		FN: uint16(fnf * 100),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set f-number: %w", err)
+	}
+
+	err = n.dev.RunTransactionWithNoParamsContext(ctx, OC_NIKON_StartLiveView)
+	if err != nil {
+		if casted, ok := err.(RCError); ok && uint16(casted) == RC_NIKON_InvalidStatus {
+			return fmt.Errorf("failed to set f-number: failed to start live view: InvalidStatus (battery level is low?)")
+		}
+		return fmt.Errorf("failed to set f-number: start live view: %w", err)
+	}
+	return nil
+}
+
+func (n *nikonDriver) GetPropUint(ctx context.Context, code uint16) (uint64, error) {
+	return n.props.getUint(ctx, code)
+}
+
+func (n *nikonDriver) SetPropUint(ctx context.Context, code uint16, v uint64) error {
+	return n.props.setUint(ctx, code, v)
+}
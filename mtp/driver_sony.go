@@ -0,0 +1,429 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Sony PTP extensions
+
+const (
+	VENDOR_SONY = 0x00000011
+
+	OC_SONY_SDIOConnect             = 0x9201
+	OC_SONY_GetSDIOGetExtDeviceInfo = 0x9202
+	OC_SONY_SetControlDeviceA       = 0x9205
+	OC_SONY_SetControlDeviceB       = 0x9207
+	OC_SONY_GetAllDevicePropData    = 0x9209
+
+	DPC_SONY_ISO       = 0xD21E
+	DPC_SONY_AutoFocus = 0xD2C1
+)
+
+// sonyLiveViewHandle is the object handle of the live view frame.
+const sonyLiveViewHandle = 0xFFFFC002
+
+// Sony ISO values carry flags like multi frame noise reduction in the
+// highest byte, and the lower bytes are all set for Auto.
+const (
+	sonyISOMask = 0x00FFFFFF
+	sonyISOAuto = 0x00FFFFFF
+)
+
+// sonyProp is an integer property in the data of GetAllDevicePropData.
+type sonyProp struct {
+	DataType DataTypeSelector
+	Current  uint64
+	Values   []uint64
+}
+
+// sonyReader reads the little endian fields of Sony property data. It keeps
+// the first error and returns zeroes afterwards.
+type sonyReader struct {
+	buf []byte
+	err error
+}
+
+func (r *sonyReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	} else if n > len(r.buf) {
+		r.err = fmt.Errorf("unexpected end of property data")
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *sonyReader) uint(n int) uint64 {
+	b := r.next(n)
+	var v uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | uint64(b[i])
+	}
+	return v
+}
+
+// value reads a value of the data type. Strings and arrays are skipped and
+// read as 0.
+func (r *sonyReader) value(dt DataTypeSelector) uint64 {
+	switch {
+	case dt == DTC_STR:
+		r.next(2 * int(r.uint(1)))
+		return 0
+	case dt&0x4000 != 0:
+		n := r.uint(4)
+		size := dataTypeSize(dt &^ 0x4000)
+		if r.err == nil && size == 0 {
+			r.err = fmt.Errorf("unsupported data type %s", getName(DTC_names, int(dt)))
+		}
+		r.next(int(n) * size)
+		return 0
+	}
+
+	size := dataTypeSize(dt)
+	if size == 0 && r.err == nil {
+		r.err = fmt.Errorf("unsupported data type %s", getName(DTC_names, int(dt)))
+	}
+	if size > 8 {
+		r.next(size)
+		return 0
+	}
+	return r.uint(size)
+}
+
+func dataTypeSize(dt DataTypeSelector) int {
+	switch dt {
+	case DTC_INT8, DTC_UINT8:
+		return 1
+	case DTC_INT16, DTC_UINT16:
+		return 2
+	case DTC_INT32, DTC_UINT32:
+		return 4
+	case DTC_INT64, DTC_UINT64:
+		return 8
+	case DTC_INT128, DTC_UINT128:
+		return 16
+	}
+	return 0
+}
+
+// parseSonyProps decodes the data of GetAllDevicePropData. It is a count
+// followed by property descriptions which have an extra IsEnabled field
+// compared to the standard ones. Bodies with SDIO protocol version 3.00 or
+// later list the enumerated values twice: all of them, then the settable
+// ones, which are kept.
+func parseSonyProps(data []byte, twoEnums bool) (map[uint16]sonyProp, error) {
+	r := &sonyReader{buf: data}
+	props := map[uint16]sonyProp{}
+
+	n := r.uint(8)
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		code := uint16(r.uint(2))
+		p := sonyProp{DataType: DataTypeSelector(r.uint(2))}
+		r.uint(1) // GetSet
+		r.uint(1) // IsEnabled
+		r.value(p.DataType)
+		p.Current = r.value(p.DataType)
+
+		switch r.uint(1) {
+		case DPFF_Range:
+			r.value(p.DataType)
+			r.value(p.DataType)
+			r.value(p.DataType)
+		case DPFF_Enumeration:
+			lists := 1
+			if twoEnums {
+				lists = 2
+			}
+			for l := 0; l < lists; l++ {
+				p.Values = make([]uint64, r.uint(2))
+				for j := range p.Values {
+					p.Values[j] = r.value(p.DataType)
+				}
+			}
+		}
+
+		if r.err == nil {
+			props[code] = p
+		}
+	}
+	return props, r.err
+}
+
+// sonyDriver drives Sony Alpha cameras in the PC remote mode.
+type sonyDriver struct {
+	dev       Device
+	props     map[uint16]sonyProp
+	version   uint16
+	connected bool
+	// synced is when props was read, zero if a write made it stale.
+	synced time.Time
+}
+
+func newSonyDriver(dev Device) *sonyDriver {
+	return &sonyDriver{
+		dev:   dev,
+		props: map[uint16]sonyProp{},
+	}
+}
+
+func (sd *sonyDriver) Name() string {
+	return "Sony"
+}
+
+func (sd *sonyDriver) run(ctx context.Context, dest io.Writer, code uint16, params ...uint32) error {
+	var req, rep Container
+	req.Code = code
+	req.Param = params
+	return sd.dev.RunTransactionContext(ctx, &req, &rep, dest, nil, 0)
+}
+
+// connect performs the SDIO handshake that switches the camera to the PC
+// remote mode.
+func (sd *sonyDriver) connect(ctx context.Context) error {
+	for _, phase := range []uint32{1, 2} {
+		err := sd.run(ctx, &bytes.Buffer{}, OC_SONY_SDIOConnect, phase, 0, 0)
+		if err != nil {
+			return fmt.Errorf("SDIO connect phase %d failed: %s", phase, err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	err := sd.run(ctx, buf, OC_SONY_GetSDIOGetExtDeviceInfo, 0xC8)
+	if err != nil {
+		return fmt.Errorf("failed to get the extended device info: %s", err)
+	} else if buf.Len() < 2 {
+		return fmt.Errorf("the extended device info has insufficient length")
+	}
+	sd.version = byteOrder.Uint16(buf.Bytes())
+	log.LV.Debugf("Sony SDIO protocol version: %d", sd.version)
+
+	err = sd.run(ctx, &bytes.Buffer{}, OC_SONY_SDIOConnect, 3, 0, 0)
+	if err != nil {
+		return fmt.Errorf("SDIO connect phase 3 failed: %s", err)
+	}
+
+	sd.connected = true
+	return nil
+}
+
+// sync connects to the camera once, then reads all the properties unless
+// they are recent.
+func (sd *sonyDriver) sync(ctx context.Context) error {
+	if !sd.connected {
+		err := sd.connect(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if time.Since(sd.synced) < propsMaxAge {
+		return nil
+	}
+
+	buf := &bytes.Buffer{}
+	err := sd.run(ctx, buf, OC_SONY_GetAllDevicePropData)
+	if err != nil {
+		return fmt.Errorf("failed to get properties: %s", err)
+	}
+
+	props, err := parseSonyProps(buf.Bytes(), sd.version >= 300)
+	if err != nil {
+		return fmt.Errorf("failed to decode properties: %s", err)
+	}
+	sd.props = props
+	sd.synced = time.Now()
+	return nil
+}
+
+// control writes a property with SetControlDeviceA (settings) or
+// SetControlDeviceB (buttons).
+func (sd *sonyDriver) control(ctx context.Context, op uint16, code uint16, dt DataTypeSelector, v uint64) error {
+	size := dataTypeSize(dt)
+	if size == 0 || size > 8 {
+		return fmt.Errorf("unsupported data type %s of %s", getName(DTC_names, int(dt)), getName(DPC_names, int(code)))
+	}
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(v >> (8 * i))
+	}
+
+	var req, rep Container
+	req.Code = op
+	req.Param = []uint32{uint32(code)}
+	err := sd.dev.RunTransactionContext(ctx, &req, &rep, nil, bytes.NewReader(data), int64(len(data)))
+	sd.synced = time.Time{}
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", getName(DPC_names, int(code)), err)
+	}
+	return nil
+}
+
+func (sd *sonyDriver) StartLiveView(ctx context.Context) error {
+	// Live view runs as long as the camera is in the PC remote mode.
+	if sd.connected {
+		return nil
+	}
+
+	err := sd.connect(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start live view: %s", err)
+	}
+	return nil
+}
+
+func (sd *sonyDriver) EndLiveView(ctx context.Context) error {
+	return nil
+}
+
+func (sd *sonyDriver) LiveViewStatus(ctx context.Context) (bool, error) {
+	return sd.connected, nil
+}
+
+func (sd *sonyDriver) LiveViewImg(ctx context.Context) (LiveView, error) {
+	if !sd.connected {
+		return LiveView{}, errLiveViewInactive
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, liveViewTimeout)
+	defer cancel()
+
+	buf := &bytes.Buffer{}
+	err := sd.run(ctx, buf, OC_GetObject, sonyLiveViewHandle)
+	if err != nil {
+		if casted, ok := err.(RCError); ok && uint16(casted) == RC_AccessDenied {
+			// The camera returns AccessDenied until the first frame is ready.
+			return LiveView{}, errLiveViewInactive
+		}
+		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
+	}
+
+	img, err := extractJPEG(buf.Bytes())
+	if err != nil {
+		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
+	}
+	return liveViewFromJPEG(img)
+}
+
+func (sd *sonyDriver) AutoFocus(ctx context.Context) error {
+	// Half-press the shutter button, give the camera a moment, and release it.
+	err := sd.control(ctx, OC_SONY_SetControlDeviceB, DPC_SONY_AutoFocus, DTC_UINT16, 2)
+	if err != nil {
+		return fmt.Errorf("failed to do auto focus: %s", err)
+	}
+
+	select {
+	case <-time.After(time.Second):
+	case <-ctx.Done():
+	}
+
+	// Release it even if ctx is done so that the button isn't left pressed.
+	err = sd.control(context.Background(), OC_SONY_SetControlDeviceB, DPC_SONY_AutoFocus, DTC_UINT16, 1)
+	if err != nil {
+		return fmt.Errorf("failed to do auto focus: %s", err)
+	}
+	return nil
+}
+
+func sonyISO(v uint64) (int, bool) {
+	if v&^sonyISOMask != 0 {
+		// Values with noise reduction flags duplicate the plain ones.
+		return 0, false
+	} else if v == sonyISOAuto {
+		return 0, true
+	}
+	return int(v), true
+}
+
+func (sd *sonyDriver) ISOs(ctx context.Context) ([]int, int, error) {
+	err := sd.sync(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	p := sd.props[DPC_SONY_ISO]
+	isos := make([]int, 0)
+	for _, v := range p.Values {
+		if iso, ok := sonyISO(v); ok {
+			isos = append(isos, iso)
+		}
+	}
+	current, _ := sonyISO(p.Current)
+	return isos, current, nil
+}
+
+func (sd *sonyDriver) SetISO(ctx context.Context, iso int) error {
+	p := sd.props[DPC_SONY_ISO]
+	for _, v := range p.Values {
+		if i, ok := sonyISO(v); ok && i == iso {
+			return sd.control(ctx, OC_SONY_SetControlDeviceA, DPC_SONY_ISO, p.DataType, v)
+		}
+	}
+	return fmt.Errorf("failed to set ISO: %d is not available", iso)
+}
+
+func (sd *sonyDriver) FNs(ctx context.Context) ([]string, string, error) {
+	err := sd.sync(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	p := sd.props[DPC_FNumber]
+	fns := make([]string, 0)
+	for _, v := range p.Values {
+		fns = append(fns, strconv.FormatFloat(float64(v)/100, 'f', -1, 64))
+	}
+	return fns, strconv.FormatFloat(float64(p.Current)/100, 'f', -1, 64), nil
+}
+
+func (sd *sonyDriver) SetFN(ctx context.Context, fn string) error {
+	fnf, err := strconv.ParseFloat(fn, 64)
+	if err != nil {
+		return fmt.Errorf("failed to parse f-number: %s", err)
+	}
+
+	p, ok := sd.props[DPC_FNumber]
+	if !ok {
+		return fmt.Errorf("failed to set f-number: the camera doesn't report f-numbers")
+	}
+	return sd.control(ctx, OC_SONY_SetControlDeviceA, DPC_FNumber, p.DataType, uint64(math.Round(fnf*100)))
+}
+
+// sonyPropCode maps the standard property codes to the Sony ones. Codes
+// which Sony shares with the standard map to themselves.
+func sonyPropCode(code uint16) uint16 {
+	if code == DPC_ExposureIndex {
+		return DPC_SONY_ISO
+	}
+	return code
+}
+
+func (sd *sonyDriver) GetPropUint(ctx context.Context, code uint16) (uint64, error) {
+	err := sd.sync(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	p, ok := sd.props[sonyPropCode(code)]
+	if !ok {
+		return 0, fmt.Errorf("%s is not reported by the camera", getName(DPC_names, int(code)))
+	}
+	return p.Current, nil
+}
+
+func (sd *sonyDriver) SetPropUint(ctx context.Context, code uint16, v uint64) error {
+	code = sonyPropCode(code)
+	p, ok := sd.props[code]
+	if !ok {
+		return fmt.Errorf("%s is not reported by the camera", getName(DPC_names, int(code)))
+	}
+	return sd.control(ctx, OC_SONY_SetControlDeviceA, code, p.DataType, v)
+}
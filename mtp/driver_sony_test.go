@@ -0,0 +1,156 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestParseSonyProps(t *testing.T) {
+	for _, twoEnums := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := func(v interface{}) { binary.Write(&buf, binary.LittleEndian, v) }
+
+		w(uint64(3))
+
+		// ISO with an enumeration
+		w(uint16(DPC_SONY_ISO))
+		w(uint16(DTC_UINT32))
+		w([]uint8{1, 1})
+		w([]uint32{sonyISOAuto, 800})
+		w(uint8(DPFF_Enumeration))
+		if twoEnums {
+			w(uint16(1))
+			w(uint32(100))
+		}
+		w(uint16(3))
+		w([]uint32{sonyISOAuto, 100, 0x01000100})
+
+		// A string property is skipped
+		w(uint16(0xD20E))
+		w(uint16(DTC_STR))
+		w([]uint8{0, 1})
+		w([]uint8{2, 'A', 0, 0, 0})
+		w([]uint8{0})
+		w(uint8(0))
+
+		// F-number with a range
+		w(uint16(DPC_FNumber))
+		w(uint16(DTC_UINT16))
+		w([]uint8{1, 1})
+		w([]uint16{0, 560})
+		w(uint8(DPFF_Range))
+		w([]uint16{140, 2200, 10})
+
+		props, err := parseSonyProps(buf.Bytes(), twoEnums)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := sonyProp{DataType: DTC_UINT32, Current: 800, Values: []uint64{sonyISOAuto, 100, 0x01000100}}
+		if !reflect.DeepEqual(props[DPC_SONY_ISO], want) {
+			t.Errorf("got %+v, want %+v", props[DPC_SONY_ISO], want)
+		}
+		if p := props[DPC_FNumber]; p.Current != 560 {
+			t.Errorf("got f-number %d, want 560", p.Current)
+		}
+	}
+
+	if _, err := parseSonyProps([]byte{1, 0, 0, 0, 0, 0, 0, 0, 0x1e, 0xd2}, false); err == nil {
+		t.Error("truncated data should be rejected")
+	}
+}
+
+func TestSonyISO(t *testing.T) {
+	if iso, ok := sonyISO(sonyISOAuto); !ok || iso != 0 {
+		t.Errorf("auto: got %d, %v", iso, ok)
+	}
+	if iso, ok := sonyISO(3200); !ok || iso != 3200 {
+		t.Errorf("got %d, %v, want 3200", iso, ok)
+	}
+	if _, ok := sonyISO(0x01000c80); ok {
+		t.Error("ISO with noise reduction flags should be skipped")
+	}
+}
+
+// busyDevice refuses every operation.
+type busyDevice struct {
+	Device
+}
+
+func (d busyDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	return RCError(RC_DeviceBusy)
+}
+
+func TestSonySetRC(t *testing.T) {
+	sd := newSonyDriver(busyDevice{})
+	sd.props[DPC_FNumber] = sonyProp{DataType: DTC_UINT16}
+
+	err := sd.SetFN(context.Background(), "5.6")
+	if code := rcName(err); code != "DeviceBusy" {
+		t.Errorf("got %q of %v", code, err)
+	}
+}
+
+// dumpDevice counts GetAllDevicePropData, which reports no properties.
+type dumpDevice struct {
+	Device
+	dumps int
+}
+
+func (d *dumpDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	if req.Code == OC_SONY_GetAllDevicePropData {
+		d.dumps++
+		_, err := dest.Write(make([]byte, 8))
+		return err
+	}
+	return nil
+}
+
+func TestSonySyncCache(t *testing.T) {
+	dev := &dumpDevice{}
+	sd := newSonyDriver(dev)
+	sd.connected = true
+	ctx := context.Background()
+
+	_, _, _ = sd.ISOs(ctx)
+	_, _, _ = sd.FNs(ctx)
+	if dev.dumps != 1 {
+		t.Errorf("got %d dumps for a frame", dev.dumps)
+	}
+
+	_ = sd.control(ctx, OC_SONY_SetControlDeviceA, DPC_FNumber, DTC_UINT16, 560)
+	_, _, _ = sd.FNs(ctx)
+	if dev.dumps != 2 {
+		t.Errorf("the properties should be read again after a write, got %d dumps", dev.dumps)
+	}
+}
+
+// controlDevice keeps the data of the last operation.
+type controlDevice struct {
+	Device
+	data []byte
+}
+
+func (d *controlDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	var err error
+	d.data, err = ioutil.ReadAll(src)
+	return err
+}
+
+func TestSonySetFN(t *testing.T) {
+	dev := &controlDevice{}
+	sd := newSonyDriver(dev)
+	sd.props[DPC_FNumber] = sonyProp{DataType: DTC_UINT16}
+
+	for fn, expected := range map[string]uint16{"1.15": 115, "2.01": 201, "5.6": 560} {
+		err := sd.SetFN(context.Background(), fn)
+		if err != nil || len(dev.data) != 2 || byteOrder.Uint16(dev.data) != expected {
+			t.Errorf("%s: got %v, %v", fn, dev.data, err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package mtp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDetectVendor(t *testing.T) {
+	cases := []struct {
+		id   ID
+		info DeviceInfo
+		want uint32
+	}{
+		{ID{Manufacturer: "Nikon Corporation"}, DeviceInfo{MTPVendorExtensionID: VENDOR_MICROSOFT}, VENDOR_NIKON},
+		{ID{Manufacturer: "Canon Inc."}, DeviceInfo{MTPVendorExtensionID: VENDOR_MICROSOFT}, VENDOR_CANON},
+		{ID{}, DeviceInfo{MTPVendorExtensionID: VENDOR_SONY}, VENDOR_SONY},
+		{ID{}, DeviceInfo{MTPVendorExtensionID: VENDOR_MICROSOFT, Manufacturer: "Sony Corporation"}, VENDOR_SONY},
+		{ID{Manufacturer: "FUJIFILM"}, DeviceInfo{}, VENDOR_FUJI},
+		{ID{}, DeviceInfo{}, VENDOR_NIKON},
+	}
+
+	for _, c := range cases {
+		if got := detectVendor(c.id, c.info); got != c.want {
+			t.Errorf("%+v %+v: got %s, want %s", c.id, c.info, VENDOR_names[int(got)], VENDOR_names[int(c.want)])
+		}
+	}
+}
+
+func TestExtractJPEG(t *testing.T) {
+	img := []byte{0xff, 0xd8, 0x01, 0xff, 0xd9, 0x02, 0xff, 0xd9}
+	data := append([]byte{0x08, 0x00, 0x00, 0x00}, img...)
+	data = append(data, 0x00, 0x00)
+
+	got, err := extractJPEG(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, img) {
+		t.Errorf("got % x, want % x", got, img)
+	}
+
+	if _, err = extractJPEG([]byte{0xff, 0xd9, 0xff, 0xd8}); err == nil {
+		t.Error("data without an image should be rejected")
+	}
+}
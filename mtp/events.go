@@ -0,0 +1,207 @@
+package mtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// eventBacklog is the number of discrete events kept to resume from.
+	eventBacklog = 256
+	// eventKeepAlive is the interval of comments sent to idle connections.
+	eventKeepAlive = 15 * time.Second
+)
+
+// Names of the discrete events of /api/events. It also sends EventState once
+// a second.
+const (
+	EventProperty   = "property"
+	EventAF         = "af"
+	EventCapture    = "capture"
+	EventConnection = "connection"
+	EventLiveView   = "live_view"
+)
+
+// PropertyEvent notifies a setting changed by a client or on the camera.
+// Prop is one of the props of the control protocol v2.
+type PropertyEvent struct {
+	Prop     string      `json:"prop"`
+	Value    interface{} `json:"value"`
+	Previous interface{} `json:"previous"`
+}
+
+// AFEvent notifies the result of an AF.
+type AFEvent struct {
+	// Trigger is periodic or user.
+	Trigger string `json:"trigger"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+}
+
+// CaptureEvent notifies files saved from the camera.
+type CaptureEvent struct {
+	// Source is still and liveview for focus stacks and brackets, or
+	// ingest.
+	Source string   `json:"source"`
+	Dir    string   `json:"dir"`
+	Files  []string `json:"files"`
+}
+
+// ConnectionEvent notifies the connection to the camera.
+type ConnectionEvent struct {
+	// State is connected or disconnected.
+	State  string `json:"state"`
+	Driver string `json:"driver,omitempty"`
+}
+
+type sseEvent struct {
+	id   uint64
+	name string
+	data []byte
+}
+
+// eventHub keeps the latest state and the recent discrete events for
+// /api/events. A nil eventHub drops events.
+type eventHub struct {
+	lock    sync.Mutex
+	seq     uint64
+	state   sseEvent
+	backlog []sseEvent
+	// notify is closed and replaced on every event.
+	notify chan struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		// IDs start at the Unix time in milliseconds so that they keep
+		// increasing across restarts, which makes stale Last-Event-IDs
+		// harmless.
+		seq:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		notify: make(chan struct{}),
+	}
+}
+
+func (h *eventHub) publish(name string, v interface{}) {
+	if h == nil {
+		return
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.LV.Errorf("failed to marshal %s event: %s", name, err)
+		return
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.seq++
+	ev := sseEvent{id: h.seq, name: name, data: data}
+	if name == EventState {
+		h.state = ev
+	} else {
+		h.backlog = append(h.backlog, ev)
+		if len(h.backlog) > eventBacklog {
+			h.backlog = h.backlog[len(h.backlog)-eventBacklog:]
+		}
+	}
+
+	close(h.notify)
+	h.notify = make(chan struct{})
+}
+
+// since returns the events after the ID in order, the ID to follow from and
+// a channel closed on the next event. Of the states, only the latest one is
+// returned. Without resume, or with an ID from the future, the latest state
+// is all.
+func (h *eventHub) since(last uint64, resume bool) ([]sseEvent, uint64, <-chan struct{}) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var evs []sseEvent
+	if resume && last <= h.seq {
+		for _, ev := range h.backlog {
+			if ev.id > last {
+				evs = append(evs, ev)
+			}
+		}
+	}
+	if h.state.id > last || !resume || last > h.seq {
+		if h.state.id != 0 {
+			evs = append(evs, h.state)
+		}
+		sort.Slice(evs, func(i, j int) bool { return evs[i].id < evs[j].id })
+	}
+	return evs, h.seq, h.notify
+}
+
+// propertyChanges returns the settings which differ between the states.
+func propertyChanges(prev, cur *InfoPayload) []PropertyEvent {
+	var evs []PropertyEvent
+	add := func(prop string, p, c interface{}) {
+		if p != c {
+			evs = append(evs, PropertyEvent{Prop: prop, Value: c, Previous: p})
+		}
+	}
+	add("iso", prev.ISO, cur.ISO)
+	add("fn", prev.FN, cur.FN)
+	add("af_mode", prev.AFMode, cur.AFMode)
+	add("af_area", prev.AFArea, cur.AFArea)
+	add("program", prev.Program, cur.Program)
+	add("metering", prev.Metering, cur.Metering)
+	add("af_interval", prev.AF, cur.AF)
+	add("lr_fps", prev.LR, cur.LR)
+	add("preset", prev.Preset, cur.Preset)
+	return evs
+}
+
+// HandleEvents streams the state and the events as Server-Sent Events. The
+// events after Last-Event-ID are sent first if they are still kept.
+func (s *LVServer) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	evs, last, next := s.events.since(id, err == nil)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		for _, ev := range evs {
+			_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.id, ev.name, ev.data)
+			if err != nil {
+				return
+			}
+		}
+		f.Flush()
+
+		evs = nil
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.ctx.Done():
+			return
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+		case <-next:
+			evs, last, next = s.events.since(last, true)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package mtp
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func eventNames(evs []sseEvent) []string {
+	var names []string
+	for _, ev := range evs {
+		names = append(names, ev.name)
+	}
+	return names
+}
+
+func TestEventHub(t *testing.T) {
+	h := newEventHub()
+	start := h.seq
+
+	h.publish(EventState, StateData{})
+	h.publish(EventAF, AFEvent{Trigger: "user", OK: true})
+	h.publish(EventState, StateData{})
+	h.publish(EventCapture, CaptureEvent{Source: "still"})
+
+	evs, last, _ := h.since(0, false)
+	if !reflect.DeepEqual(eventNames(evs), []string{EventState}) || evs[0].id != start+3 || last != start+4 {
+		t.Errorf("new client: got %v, %d", eventNames(evs), last)
+	}
+
+	evs, last, next := h.since(start+1, true)
+	if expected := []string{EventAF, EventState, EventCapture}; !reflect.DeepEqual(eventNames(evs), expected) || last != start+4 {
+		t.Errorf("resume: got %v, %d, expected %v", eventNames(evs), last, expected)
+	}
+	if string(evs[0].data) != `{"trigger":"user","ok":true}` {
+		t.Errorf("got %s", evs[0].data)
+	}
+
+	evs, _, _ = h.since(start+4, true)
+	if len(evs) != 0 {
+		t.Errorf("up to date: got %v", eventNames(evs))
+	}
+	evs, _, _ = h.since(start+100, true)
+	if !reflect.DeepEqual(eventNames(evs), []string{EventState}) {
+		t.Errorf("future ID: got %v", eventNames(evs))
+	}
+
+	select {
+	case <-next:
+		t.Error("notified without an event")
+	default:
+	}
+	for i := 0; i < eventBacklog+10; i++ {
+		h.publish(EventAF, AFEvent{})
+	}
+	<-next
+	evs, _, _ = h.since(start, true)
+	// The latest state is kept while the oldest events are dropped.
+	if len(evs) != eventBacklog+1 || evs[0].name != EventState || evs[1].id != start+15 {
+		t.Errorf("got %d events, %v", len(evs), eventNames(evs[:2]))
+	}
+
+	var nilHub *eventHub
+	nilHub.publish(EventAF, AFEvent{})
+}
+
+func TestPropertyChanges(t *testing.T) {
+	prev := InfoPayload{ISO: 400, FN: "5.6", Program: "A", AF: 5}
+	cur := prev
+	if evs := propertyChanges(&prev, &cur); len(evs) != 0 {
+		t.Errorf("got %+v", evs)
+	}
+
+	cur.ISO, cur.Program = 800, "S"
+	expected := []PropertyEvent{
+		{Prop: "iso", Value: 800, Previous: 400},
+		{Prop: "program", Value: "S", Previous: "A"},
+	}
+	if evs := propertyChanges(&prev, &cur); !reflect.DeepEqual(evs, expected) {
+		t.Errorf("got %+v, expected %+v", evs, expected)
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	s := NewLVServer(context.Background(), nil, false, nil, "", nil)
+	start := s.events.seq
+	s.events.publish(EventConnection, ConnectionEvent{State: "connected", Driver: "Nikon D850"})
+	s.events.publish(EventState, StateData{InfoPayload: InfoPayload{ISO: 400, Frame: []byte{0xFF}}})
+	s.events.publish(EventProperty, PropertyEvent{Prop: "iso", Value: 400, Previous: 200})
+
+	srv := httptest.NewServer(http.HandlerFunc(s.HandleEvents))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(start+1, 10))
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got Content-Type %s", ct)
+	}
+
+	go s.events.publish(EventAF, AFEvent{Trigger: "periodic", OK: true})
+
+	expected := []string{
+		"id: " + strconv.FormatUint(start+2, 10),
+		"event: state",
+		`data: {"iso":400,*`,
+		"",
+		"id: " + strconv.FormatUint(start+3, 10),
+		"event: property",
+		`data: {"prop":"iso","value":400,"previous":200}`,
+		"",
+		"id: " + strconv.FormatUint(start+4, 10),
+		"event: af",
+		`data: {"trigger":"periodic","ok":true}`,
+		"",
+	}
+	sc := bufio.NewScanner(res.Body)
+	for i, e := range expected {
+		if !sc.Scan() {
+			t.Fatalf("the stream ended: %v", sc.Err())
+		}
+		line := sc.Text()
+		if strings.HasSuffix(e, "*") {
+			if !strings.HasPrefix(line, strings.TrimSuffix(e, "*")) || strings.Contains(line, `"frame"`) {
+				t.Errorf("line %d: got %q, expected %q", i, line, e)
+			}
+		} else if line != e {
+			t.Errorf("line %d: got %q, expected %q", i, line, e)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package mtp
+
+import (
+	"time"
+)
+
+// exposureInterval is the interval to read the exposure modes, which change
+// whenever the mode dial is turned.
+const exposureInterval = 2 * time.Second
+
+// Names of the values of the exposure properties.
+var (
+	exposureProgramNames = map[uint64]string{
+		0x0001: "M",
+		0x0002: "P",
+		0x0003: "A",
+		0x0004: "S",
+		0x8010: "auto",
+		0x8011: "portrait",
+		0x8012: "landscape",
+		0x8013: "close up",
+		0x8014: "sports",
+		0x8015: "night portrait",
+		0x8016: "flash off",
+		0x8017: "child",
+		0x8018: "scene",
+		0x8019: "effects",
+		0x8050: "U1",
+		0x8051: "U2",
+		0x8052: "U3",
+	}
+	meteringModeNames = map[uint64]string{
+		0x0001: "average",
+		0x0002: "center-weighted",
+		0x0003: "matrix",
+		0x0004: "spot",
+		0x8010: "highlight-weighted",
+	}
+)
+
+// Controls reported in InfoPayload.ReadOnly.
+const (
+	controlISO      = "iso"
+	controlFN       = "fn"
+	controlShutter  = "shutter"
+	controlProgram  = "program"
+	controlMetering = "metering"
+)
+
+// programReadOnly returns the controls the camera decides by itself in the
+// exposure program. User settings are treated as M since they can hold any.
+func programReadOnly(program string) []string {
+	switch program {
+	case "M", "U1", "U2", "U3", "":
+		return nil
+	case "A":
+		return []string{controlShutter}
+	case "S":
+		return []string{controlFN}
+	case "auto", "flash off":
+		return []string{controlISO, controlFN, controlShutter}
+	default:
+		// P and the scene modes
+		return []string{controlFN, controlShutter}
+	}
+}
+
+func (s *LVServer) exposureProp(code uint16, names map[uint64]string) (namedProp, bool) {
+	_, ok := s.driver.(*nikonDriver)
+	return namedProp{code, names}, ok && s.caps.prop(code)
+}
+
+func (s *LVServer) programProp() (namedProp, bool) {
+	return s.exposureProp(DPC_ExposureProgramMode, exposureProgramNames)
+}
+
+func (s *LVServer) meteringProp() (namedProp, bool) {
+	return s.exposureProp(DPC_ExposureMeteringMode, meteringModeNames)
+}
+
+// refreshExposure reads the exposure program and metering modes into
+// InfoPayload along with the controls they make read-only.
+func (s *LVServer) refreshExposure(prio Priority) {
+	var programs, meterings []string
+	var program, metering string
+	var programSettable, meteringSettable bool
+
+	if s.dummy {
+		programs, program, programSettable = []string{"P", "S", "A", "M"}, "A", true
+		meterings, metering, meteringSettable = []string{"matrix", "center-weighted", "spot"}, "matrix", true
+	}
+
+	var err error
+	if p, ok := s.programProp(); ok && !s.dummy {
+		programs, program, programSettable, err = s.getNamedProp(prio, p)
+		if err != nil {
+			log.LV.Warningf("failed to get the exposure program: %s", err)
+		}
+	}
+	if p, ok := s.meteringProp(); ok && !s.dummy {
+		meterings, metering, meteringSettable, err = s.getNamedProp(prio, p)
+		if err != nil {
+			log.LV.Warningf("failed to get the metering mode: %s", err)
+		}
+	}
+
+	readOnly := programReadOnly(program)
+	if programs != nil && !programSettable {
+		readOnly = append(readOnly, controlProgram)
+	}
+	if meterings != nil && !meteringSettable {
+		readOnly = append(readOnly, controlMetering)
+	}
+
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.info.Program, s.info.Programs = program, programs
+	s.info.Metering, s.info.Meterings = metering, meterings
+	s.info.ReadOnly = readOnly
+}
+
+// readOnly reports whether the current exposure program makes the control
+// read-only.
+func (s *LVServer) readOnly(control string) bool {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	for _, c := range s.info.ReadOnly {
+		if c == control {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *LVServer) workerExposure() error {
+	tick := time.NewTicker(exposureInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+		s.refreshExposure(PriorityBackground)
+	}
+}
@@ -0,0 +1,65 @@
+package mtp
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestExposure(t *testing.T) {
+	// A mode dial makes only the metering mode settable.
+	dev := &propDevice{props: map[uint16]*fakeProp{
+		DPC_ExposureProgramMode:  {dataType: DTC_UINT16, values: []uint64{1, 2, 3, 4, 0x8010}, current: 3},
+		DPC_ExposureMeteringMode: {dataType: DTC_UINT16, settable: true, values: []uint64{2, 3, 4, 0x8010}, current: 3},
+	}}
+	s := &LVServer{
+		dev:    dev,
+		driver: &nikonDriver{dev: dev, props: newPropAccessor(dev)},
+		caps:   capabilities{props: map[uint16]bool{DPC_ExposureProgramMode: true, DPC_ExposureMeteringMode: true}},
+		sched:  NewScheduler(),
+		ctx:    context.Background(),
+	}
+
+	s.refreshExposure(PriorityUser)
+	if expected := []string{"M", "P", "A", "S", "auto"}; s.info.Program != "A" || !reflect.DeepEqual(s.info.Programs, expected) {
+		t.Errorf("got %s of %v, expected A of %v", s.info.Program, s.info.Programs, expected)
+	}
+	if s.info.Metering != "matrix" {
+		t.Errorf("got %s, expected matrix", s.info.Metering)
+	}
+	if expected := []string{controlShutter, controlProgram}; !reflect.DeepEqual(s.info.ReadOnly, expected) {
+		t.Errorf("got %v, expected %v", s.info.ReadOnly, expected)
+	}
+	if s.readOnly(controlFN) || !s.readOnly(controlProgram) || s.readOnly(controlMetering) {
+		t.Errorf("unexpected read-only controls: %v", s.info.ReadOnly)
+	}
+
+	metering, _ := s.meteringProp()
+	err := s.setNamedProp(s.sched.Enqueue(PriorityUser, "metering"), metering, "highlight-weighted")
+	if err != nil || dev.props[DPC_ExposureMeteringMode].current != 0x8010 {
+		t.Errorf("got 0x%X, %v", dev.props[DPC_ExposureMeteringMode].current, err)
+	}
+
+	// The mode dial is turned to S.
+	dev.props[DPC_ExposureProgramMode].current = 4
+	s.refreshExposure(PriorityUser)
+	if s.info.Metering != "highlight-weighted" || !s.readOnly(controlFN) || s.readOnly(controlShutter) {
+		t.Errorf("got %s, %v", s.info.Metering, s.info.ReadOnly)
+	}
+}
+
+func TestProgramReadOnly(t *testing.T) {
+	for program, expected := range map[string][]string{
+		"M":        nil,
+		"U1":       nil,
+		"A":        {controlShutter},
+		"S":        {controlFN},
+		"P":        {controlFN, controlShutter},
+		"portrait": {controlFN, controlShutter},
+		"auto":     {controlISO, controlFN, controlShutter},
+	} {
+		if got := programReadOnly(program); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: got %v, expected %v", program, got, expected)
+		}
+	}
+}
@@ -0,0 +1,406 @@
+package mtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// OC_NIKON_CheckEvent returns the events queued in Nikon cameras, which
+// otherwise only arrive over the interrupt endpoint.
+const OC_NIKON_CheckEvent = 0x90C7
+
+// ingestInterval is the interval to check for new images.
+const ingestInterval = time.Second
+
+// ingestAttempts is the number of attempts to copy an image before giving up.
+const ingestAttempts = 3
+
+// ingestExts are the file types to ingest.
+var ingestExts = map[string]bool{".jpg": true, ".jpeg": true, ".nef": true, ".nrw": true}
+
+// DefaultIngestTemplate puts images in a folder per capture date.
+const DefaultIngestTemplate = "{date}/{name}"
+
+// IngestConfig configures copying newly shot images to the host.
+type IngestConfig struct {
+	// Dir is the directory to copy images into.
+	Dir string
+	// Template is the path of an image in Dir. See expandIngestTemplate.
+	Template string
+	// Delete deletes images from the card after they are copied.
+	Delete bool
+	// Webhook is the URL to POST an IngestEvent for every image.
+	Webhook string
+}
+
+// IngestEvent notifies a copied image to WebSocket clients and the webhook.
+type IngestEvent struct {
+	Handle   uint32    `json:"handle"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Captured time.Time `json:"captured"`
+	Serial   string    `json:"serial"`
+	Seq      int       `json:"seq"`
+	Deleted  bool      `json:"deleted"`
+}
+
+type ingester struct {
+	cfg    IngestConfig
+	serial string
+	seq    int
+
+	// pending holds handles to copy with the number of failed attempts.
+	pending map[uint32]int
+	// known holds handles seen by polling, nil until the first poll.
+	known map[uint32]bool
+
+	clients map[*websocket.Conn]bool
+	lock    sync.Mutex
+}
+
+// EnableIngest copies every new JPEG/NEF image to the host while running.
+func (s *LVServer) EnableIngest(cfg IngestConfig) {
+	if cfg.Template == "" {
+		cfg.Template = DefaultIngestTemplate
+	}
+	s.ingest = &ingester{
+		cfg:     cfg,
+		pending: map[uint32]int{},
+		clients: map[*websocket.Conn]bool{},
+	}
+}
+
+// expandIngestTemplate expands the placeholders in t: {date} (2006-01-02) and
+// {time} (150405) of the capture, {serial} of the camera, {seq} (0001) of the
+// image in this session, {name} (DSC_0001.NEF), {base} (DSC_0001) and {ext}
+// (NEF) of the original file.
+func expandIngestTemplate(t string, name string, captured time.Time, serial string, seq int) string {
+	ext := filepath.Ext(name)
+	return strings.NewReplacer(
+		"{date}", captured.Format("2006-01-02"),
+		"{time}", captured.Format("150405"),
+		"{serial}", serial,
+		"{seq}", fmt.Sprintf("%04d", seq),
+		"{name}", name,
+		"{base}", strings.TrimSuffix(name, ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+	).Replace(t)
+}
+
+// ingestPath returns the destination of an image, which doesn't exist yet and
+// is inside dir.
+func ingestPath(dir, rel string) (string, error) {
+	dir = filepath.Clean(dir)
+	p := filepath.Join(dir, filepath.FromSlash(rel))
+	r, err := filepath.Rel(dir, p)
+	if err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is outside of the ingest directory", rel)
+	}
+
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 1; ; i++ {
+		_, err := os.Stat(p)
+		if os.IsNotExist(err) {
+			return p, nil
+		} else if err != nil {
+			return "", err
+		}
+		p = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// parseNikonEvents parses the data of OC_NIKON_CheckEvent.
+func parseNikonEvents(data []byte) ([]Container, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("short event data")
+	}
+	n := int(byteOrder.Uint16(data))
+	data = data[2:]
+	if len(data) < n*6 {
+		return nil, fmt.Errorf("got %d bytes for %d events", len(data), n)
+	}
+
+	events := make([]Container, n)
+	for i := range events {
+		events[i].Code = byteOrder.Uint16(data[i*6:])
+		events[i].Param = []uint32{byteOrder.Uint32(data[i*6+2:])}
+	}
+	return events, nil
+}
+
+func (s *LVServer) workerIngest() error {
+	tick := time.NewTicker(ingestInterval)
+	defer tick.Stop()
+
+	_, nikon := s.driver.(*nikonDriver)
+	events := nikon && s.caps.op(OC_NIKON_CheckEvent)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+
+		var err error
+		if events {
+			err = s.checkIngestEvents()
+			if err == RCError(RC_OperationNotSupported) {
+				log.LV.Info("workerIngest: the camera doesn't queue events, polling objects instead")
+				events = false
+			}
+		} else {
+			err = s.pollIngestObjects()
+		}
+		if err != nil {
+			log.LV.Warningf("workerIngest: failed to check new images: %s", err)
+			continue
+		}
+
+		if s.seq.running() {
+			// Focus stacks and brackets copy their shots themselves, so
+			// wait until the sequence has claimed them.
+			continue
+		}
+
+		for h, attempts := range s.ingest.pending {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			if s.seq.release(h) {
+				delete(s.ingest.pending, h)
+				continue
+			}
+
+			err = s.ingestObject(h)
+			if err == nil {
+				delete(s.ingest.pending, h)
+			} else if attempts+1 >= ingestAttempts {
+				log.LV.Errorf("workerIngest: giving up copying 0x%08x: %s", h, err)
+				delete(s.ingest.pending, h)
+			} else {
+				log.LV.Warningf("workerIngest: failed to copy 0x%08x, retrying: %s", h, err)
+				s.ingest.pending[h] = attempts + 1
+			}
+		}
+	}
+}
+
+func (s *LVServer) checkIngestEvents() error {
+	var buf bytes.Buffer
+	err := s.withDevice(PriorityBackground, func() error {
+		var req, rep Container
+		req.Code = OC_NIKON_CheckEvent
+		req.Param = []uint32{}
+		return s.dev.RunTransactionContext(s.ctx, &req, &rep, &buf, nil, 0)
+	})
+	if err != nil {
+		return err
+	}
+
+	events, err := parseNikonEvents(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		switch e.Code {
+		case EC_ObjectAdded:
+			s.ingest.pending[e.Param[0]] = 0
+		case EC_Nikon_ObjectAddedInSDRAM:
+			log.LV.Debug("workerIngest: skipping an image without a card")
+		}
+	}
+	return nil
+}
+
+// pollIngestObjects finds new objects by comparing all handles with the
+// previous ones. Objects on the card when ingest starts are left alone.
+func (s *LVServer) pollIngestObjects() error {
+	var handles []uint32
+	err := s.withDevice(PriorityBackground, func() (err error) {
+		handles, err = getObjectHandles(s.ctx, s.dev, allStorages, 0)
+		return
+	})
+	if err != nil {
+		return err
+	}
+
+	known := make(map[uint32]bool, len(handles))
+	for _, h := range handles {
+		known[h] = true
+		if s.ingest.known != nil && !s.ingest.known[h] {
+			s.ingest.pending[h] = 0
+		}
+	}
+	s.ingest.known = known
+	return nil
+}
+
+// ingestObject copies an image if it is the type to ingest.
+func (s *LVServer) ingestObject(handle uint32) error {
+	var info ObjectInfo
+	err := s.withDevice(PriorityBackground, func() (err error) {
+		info, err = getObjectInfo(s.ctx, s.dev, handle)
+		return
+	})
+	if err == RCError(RC_InvalidObjectHandle) {
+		// Deleted before we got there.
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to get object info: %s", err)
+	}
+
+	if info.ObjectFormat == OFC_Association || !ingestExts[strings.ToLower(filepath.Ext(info.Filename))] {
+		return nil
+	}
+
+	captured := info.CaptureDate
+	if captured.IsZero() {
+		captured = time.Now()
+	}
+	seq := s.ingest.seq + 1
+	rel := expandIngestTemplate(s.ingest.cfg.Template, info.Filename, captured, s.ingest.serial, seq)
+	dst, err := ingestPath(s.ingest.cfg.Dir, rel)
+	if err != nil {
+		return err
+	}
+
+	size, err := s.copyObject(handle, dst)
+	if err != nil {
+		return err
+	}
+	if info.CompressedSize != 0xFFFFFFFF && size != int64(info.CompressedSize) {
+		os.Remove(dst)
+		return fmt.Errorf("copied %d bytes, want %d", size, info.CompressedSize)
+	}
+	s.ingest.seq = seq
+	log.LV.Infof("ingested %s to %s", info.Filename, dst)
+
+	ev := IngestEvent{
+		Handle:   handle,
+		Name:     info.Filename,
+		Path:     dst,
+		Size:     size,
+		Captured: captured,
+		Serial:   s.ingest.serial,
+		Seq:      seq,
+	}
+	if s.ingest.cfg.Delete {
+		err = s.withDevice(PriorityBackground, func() error {
+			return deleteObject(s.ctx, s.dev, handle)
+		})
+		if err != nil {
+			log.LV.Warningf("workerIngest: failed to delete %s from the card: %s", info.Filename, err)
+		}
+		ev.Deleted = err == nil
+	}
+
+	s.notifyIngest(ev)
+	s.events.publish(EventCapture, CaptureEvent{Source: "ingest", Dir: filepath.Dir(dst), Files: []string{filepath.Base(dst)}})
+	return nil
+}
+
+// copyObject downloads an object to a temporary file and renames it to dst.
+func (s *LVServer) copyObject(handle uint32, dst string) (int64, error) {
+	err := os.MkdirAll(filepath.Dir(dst), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	tmp := dst + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	cw := &countingWriter{w: f}
+	err = s.withDevice(PriorityBackground, func() error {
+		return getObject(s.ctx, s.dev, OC_GetObject, handle, cw)
+	})
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return cw.n, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *LVServer) notifyIngest(ev IngestEvent) {
+	j, err := json.Marshal(ev)
+	if err != nil {
+		log.LV.Errorf("notifyIngest: failed to marshal payload: %s", err)
+		return
+	}
+
+	s.ingest.lock.Lock()
+	for c := range s.ingest.clients {
+		err = c.WriteMessage(websocket.TextMessage, j)
+		if err != nil {
+			log.LV.Errorf("notifyIngest: failed to send an event: %s", err)
+		}
+	}
+	s.ingest.lock.Unlock()
+
+	if s.ingest.cfg.Webhook != "" {
+		go s.postWebhook(s.ingest.cfg.Webhook, j)
+	}
+}
+
+// HandleIngest sends an IngestEvent for every copied image over WebSocket.
+func (s *LVServer) HandleIngest(w http.ResponseWriter, r *http.Request) {
+	if s.ingest == nil {
+		http.Error(w, "ingest is disabled", http.StatusNotFound)
+		return
+	}
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.LV.Errorf("HandleIngest: failed to upgrade: %s", err)
+		return
+	}
+	defer ws.Close()
+
+	s.ingest.lock.Lock()
+	s.ingest.clients[ws] = true
+	s.ingest.lock.Unlock()
+
+	for {
+		var mes struct{}
+		err := ws.ReadJSON(&mes)
+		if err != nil {
+			break
+		}
+	}
+
+	s.ingest.lock.Lock()
+	delete(s.ingest.clients, ws)
+	s.ingest.lock.Unlock()
+}
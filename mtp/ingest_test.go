@@ -0,0 +1,81 @@
+package mtp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpandIngestTemplate(t *testing.T) {
+	captured := time.Date(2020, 5, 1, 9, 8, 7, 0, time.UTC)
+
+	cases := map[string]string{
+		"{date}/{name}":                      "2020-05-01/DSC_0001.NEF",
+		"{serial}/{date}_{time}_{seq}.{ext}": "3001234/2020-05-01_090807_0012.NEF",
+		"{base}-{seq}.jpg":                   "DSC_0001-0012.jpg",
+	}
+	for tpl, want := range cases {
+		if got := expandIngestTemplate(tpl, "DSC_0001.NEF", captured, "3001234", 12); got != want {
+			t.Errorf("%s: got %q, want %q", tpl, got, want)
+		}
+	}
+}
+
+func TestIngestPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtplvcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := ingestPath(dir, "2020-05-01/DSC_0001.NEF")
+	if err != nil || p != filepath.Join(dir, "2020-05-01", "DSC_0001.NEF") {
+		t.Fatalf("got %q, %v", p, err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(p, nil, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = ingestPath(dir, "2020-05-01/DSC_0001.NEF")
+	if err != nil || p != filepath.Join(dir, "2020-05-01", "DSC_0001_1.NEF") {
+		t.Errorf("existing files should be kept: got %q, %v", p, err)
+	}
+
+	if _, err = ingestPath(dir, "../DSC_0001.NEF"); err == nil {
+		t.Error("paths outside of the directory should be rejected")
+	}
+
+	for _, d := range []string{".", "/"} {
+		p, err = ingestPath(d, "2020-05-01/DSC_0001.NEF")
+		if err != nil || p != filepath.Join(d, "2020-05-01", "DSC_0001.NEF") {
+			t.Errorf("%s: got %q, %v", d, p, err)
+		}
+	}
+}
+
+func TestParseNikonEvents(t *testing.T) {
+	data := []byte{
+		0x02, 0x00,
+		0x02, 0x40, 0x01, 0x00, 0x01, 0x90,
+		0x01, 0xc1, 0x00, 0x00, 0xff, 0xff,
+	}
+
+	events, err := parseNikonEvents(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Code != EC_ObjectAdded || events[0].Param[0] != 0x90010001 ||
+		events[1].Code != EC_Nikon_ObjectAddedInSDRAM {
+		t.Errorf("got %+v", events)
+	}
+
+	if _, err = parseNikonEvents(data[:10]); err == nil {
+		t.Error("truncated data should be rejected")
+	}
+}
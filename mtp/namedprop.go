@@ -0,0 +1,63 @@
+package mtp
+
+import (
+	"fmt"
+)
+
+// namedProp is an enumerated property of Nikon cameras with the names of its
+// values, which the controller shows and sends back.
+type namedProp struct {
+	code  uint16
+	names map[uint64]string
+}
+
+func (p namedProp) name(v uint64) string {
+	if n, ok := p.names[v]; ok {
+		return n
+	}
+	return fmt.Sprintf("0x%X", v)
+}
+
+// getNamedProp returns the names of the available values, the current one,
+// and whether the property is settable.
+func (s *LVServer) getNamedProp(prio Priority, p namedProp) ([]string, string, bool, error) {
+	s.sched.Lock(prio)
+	defer s.sched.Unlock()
+
+	e, err := s.driver.(*nikonDriver).props.enum(s.ctx, p.code)
+	if err != nil {
+		return nil, "", false, err
+	}
+
+	names := make([]string, 0, len(e.values))
+	for _, v := range e.values {
+		names = append(names, p.name(v))
+	}
+	return names, p.name(e.current), e.settable, nil
+}
+
+// setNamedProp sets a property to the value of the name when t is granted.
+// It returns errSuperseded if a newer request superseded t.
+func (s *LVServer) setNamedProp(t *Ticket, p namedProp, name string) error {
+	if !t.Wait() {
+		log.LV.Debugf("setNamedProp: %s is superseded", name)
+		return errSuperseded
+	}
+	defer s.sched.Unlock()
+
+	if s.dummy {
+		return nil
+	}
+
+	n := s.driver.(*nikonDriver)
+	e, err := n.props.enum(s.ctx, p.code)
+	if err != nil {
+		return err
+	}
+	for _, v := range e.values {
+		if p.name(v) == name {
+			return n.props.setUint(s.ctx, p.code, v)
+		}
+	}
+	return fmt.Errorf("%s is not available", name)
+}
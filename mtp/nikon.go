@@ -1,14 +1,20 @@
 package mtp
 
-import "strings"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
 
 // Nikon MTP extensions
 
 const (
-	OC_NIKON_AfDrive         = 0x90C1
-	OC_NIKON_DeviceReady     = 0x90C8
-	DPC_NIKON_RecordingMedia = 0xD10B
-	DPC_NIKON_Resolution     = 0xD1AC
+	OC_NIKON_AfDrive                   = 0x90C1
+	OC_NIKON_DeviceReady               = 0x90C8
+	OC_NIKON_InitiateCaptureRecInMedia = 0x9207
+	DPC_NIKON_RecordingMedia           = 0xD10B
+	DPC_NIKON_Resolution               = 0xD1AC
 )
 
 type Rotation int
@@ -29,177 +35,173 @@ const (
 )
 
 type RecordingMedia int8
-type Resolution64 uint64
-type Resolution8 uint8
-
-type ResolutionType int
-
-const (
-	ResolutionType8 ResolutionType = iota
-	ResolutionType64
-)
 
 const (
 	RecordingMediaCard  RecordingMedia = 0
 	RecordingMediaSDRAM                = 1
 )
 
+// Model holds the quirks of a camera body which can't be probed from the
+// capabilities it reports. A HeaderSize of 0 means unknown; the header of
+// live view frames is then measured on the first frame.
 type Model struct {
-	Name             string
-	HeaderSize       int
-	ResolutionType   ResolutionType
-	QuirkSwitchMedia bool
+	Name             string `json:"-"`
+	HeaderSize       int    `json:"header_size,omitempty"`
+	QuirkSwitchMedia bool   `json:"switch_media,omitempty"`
 }
 
 type ModelMap map[string]Model
 
+// Match returns the model named in the product name. Names are compared
+// ignoring case and spaces, so that "Z 6" matches Z6 and "NIKON DSC D3300"
+// matches D3300. The longest name wins if several match.
 func (mm ModelMap) Match(product string) (Model, bool) {
-	tokens := strings.Split(product, " ")
-	for i := range tokens {
-		tokens[i] = strings.ToLower(tokens[i])
+	var candidates []string
+	var joined string
+	for _, t := range strings.Fields(strings.ToLower(product)) {
+		if t == "nikon" || t == "dsc" {
+			continue
+		}
+		candidates = append(candidates, t)
+		joined += t
 	}
+	// Second generation Z bodies report themselves as "Z 6_2" and so on.
+	candidates = append(candidates, joined, strings.ReplaceAll(joined, "_2", "ii"))
 
-	for k, v := range models {
-		for _, t := range tokens {
-			if strings.ToLower(k) == t {
-				return v, true
+	var found Model
+	for k, v := range mm {
+		if strings.HasPrefix(k, "_") {
+			continue
+		}
+		key := strings.ToLower(strings.ReplaceAll(k, " ", ""))
+		for _, c := range candidates {
+			if c == key && (len(k) > len(found.Name) || len(k) == len(found.Name) && k < found.Name) {
+				v.Name = k
+				found = v
 			}
 		}
 	}
-	return Model{}, false
+	return found, found.Name != ""
 }
 
 func (mm ModelMap) Generic() Model {
-	return mm["_generic"]
+	m := mm["_generic"]
+	m.Name = "Generic"
+	return m
+}
+
+// LoadModels adds the models in a JSON file to the built-in ones, replacing
+// those with the same names. The file maps model names to models, e.g.
+// {"Z8": {"header_size": 384}}.
+func LoadModels(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read models: %s", err)
+	}
+
+	loaded := ModelMap{}
+	err = json.Unmarshal(b, &loaded)
+	if err != nil {
+		return fmt.Errorf("failed to parse models: %s", err)
+	}
+
+	for k, v := range loaded {
+		v.Name = k
+		models[k] = v
+	}
+	return nil
 }
 
 var models = ModelMap{
 	"_generic": {
-		Name:       "Generic",
 		HeaderSize: 384,
 	},
 	"D3": {
-		Name:             "D3",
 		HeaderSize:       128,
 		QuirkSwitchMedia: true,
 	},
 	"D3s": {
-		Name:             "D3s",
 		HeaderSize:       128,
 		QuirkSwitchMedia: true,
 	},
 	"D3X": {
-		Name:             "D3X",
 		HeaderSize:       64,
 		QuirkSwitchMedia: true,
 	},
 	"D300": {
-		Name:             "D300",
 		HeaderSize:       64,
 		QuirkSwitchMedia: true,
 	},
 	"D300s": {
-		Name:             "D300s",
 		HeaderSize:       64,
 		QuirkSwitchMedia: true,
 	},
 	"D3200": {
-		Name:       "D3200",
 		HeaderSize: 384,
 	},
 	"D3300": {
-		Name:       "D3300",
 		HeaderSize: 384,
 	},
 	"D5000": {
-		Name:             "D5000",
 		HeaderSize:       128,
 		QuirkSwitchMedia: true,
 	},
 	"D5300": {
-		Name:       "D5300",
 		HeaderSize: 384,
 	},
 	"D5500": {
-		Name:       "D5500",
 		HeaderSize: 384,
 	},
 	"D5600": {
-		Name:       "D5600",
 		HeaderSize: 384,
 	},
 	"D6": {
-		Name:           "D6",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"D600": {
-		Name:       "D600",
 		HeaderSize: 384,
 	},
 	"D610": {
-		Name:       "D610",
 		HeaderSize: 384,
 	},
 	"D700": {
-		Name:       "D700",
 		HeaderSize: 64,
 	},
 	"D750": {
-		Name:       "D750",
 		HeaderSize: 384,
 	},
 	"D780": {
-		Name:           "D780",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"D7000": {
-		Name:       "D7000",
 		HeaderSize: 384,
 	},
 	"D7200": {
-		Name:       "D7200",
 		HeaderSize: 384,
 	},
 	"D90": {
-		Name:             "D90",
 		HeaderSize:       128,
 		QuirkSwitchMedia: true,
 	},
 	"Z6": {
-		Name:           "Z6",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"Z6II": {
-		Name:           "Z6II",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"Z7": {
-		Name:           "Z7",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"Z7II": {
-		Name:           "Z7II",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"Z9": {
-		Name:           "Z9",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"Z50": {
-		Name:           "Z50",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 	"Zfc": {
-		Name:           "Zfc",
-		HeaderSize:     384,
-		ResolutionType: ResolutionType8,
+		HeaderSize: 384,
 	},
 }
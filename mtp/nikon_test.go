@@ -0,0 +1,137 @@
+package mtp
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModelMapMatch(t *testing.T) {
+	mm := ModelMap{
+		"_generic": {HeaderSize: 384},
+		"D3":       {HeaderSize: 128},
+		"D3300":    {HeaderSize: 384},
+		"Z6":       {HeaderSize: 384},
+		"Z6II":     {HeaderSize: 384},
+		"Z fc":     {HeaderSize: 384},
+	}
+
+	cases := map[string]string{
+		"D3":              "D3",
+		"NIKON DSC D3300": "D3300",
+		"Z 6":             "Z6",
+		"Z 6_2":           "Z6II",
+		"Z fc":            "Z fc",
+		"D7500":           "",
+		"_generic":        "",
+	}
+
+	for product, want := range cases {
+		// Iterate a few times as map iteration order is random.
+		for i := 0; i < 10; i++ {
+			m, ok := mm.Match(product)
+			if m.Name != want || ok != (want != "") {
+				t.Errorf("%q: got %q (%v), want %q", product, m.Name, ok, want)
+				break
+			}
+		}
+	}
+}
+
+func TestLoadModels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mtplvcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "models.json")
+	err = ioutil.WriteFile(path, []byte(`{"Z8": {"header_size": 512, "switch_media": true}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer delete(models, "Z8")
+	if err = LoadModels(path); err != nil {
+		t.Fatal(err)
+	}
+
+	m, ok := models.Match("Z 8")
+	if !ok || m != (Model{Name: "Z8", HeaderSize: 512, QuirkSwitchMedia: true}) {
+		t.Errorf("got %+v (%v)", m, ok)
+	}
+}
+
+func TestProbeHeaderSize(t *testing.T) {
+	raw := append(make([]byte, 384), 0xff, 0xd8, 0xff, 0xe0)
+
+	if isJPEGAt(raw, 128) {
+		t.Error("the header isn't 128 bytes")
+	}
+	if hs, ok := probeHeaderSize(raw); !ok || hs != 384 {
+		t.Errorf("got %d (%v), want 384", hs, ok)
+	}
+	if !isJPEGAt(raw, 384) {
+		t.Error("the header is 384 bytes")
+	}
+
+	if _, ok := probeHeaderSize(make([]byte, 100)); ok {
+		t.Error("data without an image should be rejected")
+	}
+}
+
+func TestDecodeProhibitCondition(t *testing.T) {
+	reasons := decodeProhibitCondition(1<<13 | 1<<14 | 1<<31)
+	if len(reasons) != 3 {
+		t.Fatalf("got %+v", reasons)
+	}
+	if reasons[0].Bit != 13 || reasons[0].Hint != "switch the release mode dial from Mup" {
+		t.Errorf("got %+v", reasons[0])
+	}
+	if reasons[1].Bit != 14 || reasons[1].Reason != "no card inserted" {
+		t.Errorf("got %+v", reasons[1])
+	}
+	if reasons[2].Bit != 31 || reasons[2].Reason != "unknown reason (bit 31)" || reasons[2].Hint != "" {
+		t.Errorf("got %+v", reasons[2])
+	}
+
+	if got := prohibitReason(0); got != "(empty)" {
+		t.Errorf("got %q", got)
+	}
+	if got, expected := prohibitReason(1<<4|1<<8), "button is fully pressed (release the shutter button); insufficient battery (charge or replace the battery, or connect an AC adapter)"; got != expected {
+		t.Errorf("got %q, expected %q", got, expected)
+	}
+}
+
+// prohibitDriver reports fixed prohibit reasons.
+type prohibitDriver struct {
+	Driver
+	reasons []ProhibitReason
+	reads   int
+}
+
+func (d *prohibitDriver) LiveViewProhibitReasons(ctx context.Context) ([]ProhibitReason, error) {
+	d.reads++
+	return d.reasons, nil
+}
+
+func TestDiagnoseLiveView(t *testing.T) {
+	d := &prohibitDriver{reasons: decodeProhibitCondition(1 << 17)}
+	s := &LVServer{driver: d, sched: NewScheduler(), ctx: context.Background()}
+
+	s.diagnoseLiveView(errors.New("failed to start live view: DeviceBusy"))
+	if d.reads != 1 {
+		t.Errorf("the prohibit condition is read %d times", d.reads)
+	}
+	st := s.info.LV
+	if st.Active || st.Error != "failed to start live view: DeviceBusy" || len(st.Prohibit) != 1 || st.Prohibit[0].Bit != 17 {
+		t.Errorf("got %+v", st)
+	}
+
+	if s.setLiveView(LiveViewState{Active: true}); s.info.LV.Prohibit != nil {
+		t.Errorf("reasons are not cleared: %+v", s.info.LV)
+	}
+}
@@ -2,6 +2,7 @@ package mtp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"math/rand"
@@ -21,9 +22,12 @@ func (d *DeviceDirect) OpenSession() error {
 	sid := uint32(rand.Int31()) | 1
 	req.Param = []uint32{sid} // session
 
+	ctx, cancel := withOpTimeout(context.Background(), req.Code)
+	defer cancel()
+
 	// If opening the session fails, we want to be able to reset
 	// the device, so don't do sanity checks afterwards.
-	if err := d.runTransaction(&req, &rep, nil, nil, 0); err != nil {
+	if err := d.runTransaction(ctx, &req, &rep, nil, nil, 0); err != nil {
 		return err
 	}
 
@@ -44,9 +48,13 @@ func (d *DeviceDirect) CloseSession() error {
 }
 
 func (d *DeviceDirect) GetData(req *Container, info interface{}) error {
+	return d.GetDataContext(context.Background(), req, info)
+}
+
+func (d *DeviceDirect) GetDataContext(ctx context.Context, req *Container, info interface{}) error {
 	var buf bytes.Buffer
 	var rep Container
-	if err := d.RunTransaction(req, &rep, &buf, nil, 0); err != nil {
+	if err := d.RunTransactionContext(ctx, req, &rep, &buf, nil, 0); err != nil {
 		return err
 	}
 	err := Decode(&buf, info)
@@ -90,6 +98,10 @@ func (d *DeviceDirect) SetObjectPropValue(objHandle uint32, objPropCode uint16,
 }
 
 func (d *DeviceDirect) SendData(req *Container, rep *Container, value interface{}) error {
+	return d.SendDataContext(context.Background(), req, rep, value)
+}
+
+func (d *DeviceDirect) SendDataContext(ctx context.Context, req *Container, rep *Container, value interface{}) error {
 	var buf bytes.Buffer
 	if err := Encode(&buf, value); err != nil {
 		return err
@@ -97,7 +109,7 @@ func (d *DeviceDirect) SendData(req *Container, rep *Container, value interface{
 	if d.Debug.MTP {
 		log.MTP.Debugf("encoded %#v", value)
 	}
-	return d.RunTransaction(req, rep, nil, &buf, int64(buf.Len()))
+	return d.RunTransactionContext(ctx, req, rep, nil, &buf, int64(buf.Len()))
 }
 
 func (d *DeviceDirect) GetObjectPropsSupported(objFormatCode uint16, props *Uint16Array) error {
@@ -109,24 +121,36 @@ func (d *DeviceDirect) GetObjectPropsSupported(objFormatCode uint16, props *Uint
 }
 
 func (d *DeviceDirect) GetDevicePropDesc(propCode uint16, info *DevicePropDesc) error {
+	return d.GetDevicePropDescContext(context.Background(), propCode, info)
+}
+
+func (d *DeviceDirect) GetDevicePropDescContext(ctx context.Context, propCode uint16, info *DevicePropDesc) error {
 	var req Container
 	req.Code = OC_GetDevicePropDesc
 	req.Param = append(req.Param, uint32(propCode))
-	return d.GetData(&req, info)
+	return d.GetDataContext(ctx, &req, info)
 }
 
 func (d *DeviceDirect) SetDevicePropValue(propCode uint32, src interface{}) error {
+	return d.SetDevicePropValueContext(context.Background(), propCode, src)
+}
+
+func (d *DeviceDirect) SetDevicePropValueContext(ctx context.Context, propCode uint32, src interface{}) error {
 	var req, rep Container
 	req.Code = OC_SetDevicePropValue
 	req.Param = []uint32{propCode}
-	return d.SendData(&req, &rep, src)
+	return d.SendDataContext(ctx, &req, &rep, src)
 }
 
 func (d *DeviceDirect) GetDevicePropValue(propCode uint32, dest interface{}) error {
+	return d.GetDevicePropValueContext(context.Background(), propCode, dest)
+}
+
+func (d *DeviceDirect) GetDevicePropValueContext(ctx context.Context, propCode uint32, dest interface{}) error {
 	var req Container
 	req.Code = OC_GetDevicePropValue
 	req.Param = []uint32{propCode}
-	return d.GetData(&req, dest)
+	return d.GetDataContext(ctx, &req, dest)
 }
 
 func (d *DeviceDirect) ResetDevicePropValue(propCode uint32) error {
@@ -205,3 +229,15 @@ func (d *DeviceDirect) GetObject(handle uint32, w io.Writer) error {
 
 	return d.RunTransaction(&req, &rep, w, nil, 0)
 }
+
+// GetPartialObject copies up to size bytes of an object from offset to w.
+func (d *DeviceDirect) GetPartialObject(handle, offset, size uint32, w io.Writer) error {
+	return getPartialObject(context.Background(), d, OC_GetPartialObject, handle, uint64(offset), size, w)
+}
+
+// GetPartialObject64 is GetPartialObject for objects of 4GiB or more. code is
+// OC_MTP_GetPartialObject64, OC_NIKON_GetPartialObjectEx or
+// OC_CANON_EOS_GetPartialObject64, whichever the device supports.
+func (d *DeviceDirect) GetPartialObject64(code uint16, handle uint32, offset uint64, size uint32, w io.Writer) error {
+	return getPartialObject(context.Background(), d, code, handle, offset, size, w)
+}
@@ -2,7 +2,9 @@ package mtp
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"math/rand"
 )
 
@@ -18,9 +20,12 @@ func (d *DeviceGoUSB) OpenSession() error {
 	sid := uint32(rand.Int31()) | 1
 	req.Param = []uint32{sid} // session
 
+	ctx, cancel := withOpTimeout(context.Background(), req.Code)
+	defer cancel()
+
 	// If opening the session fails, we want to be able to reset
 	// the device, so don't do sanity checks afterwards.
-	if err := d.runTransaction(&req, &rep, nil, nil, 0); err != nil {
+	if err := d.runTransaction(ctx, &req, &rep, nil, nil, 0); err != nil {
 		return err
 	}
 
@@ -41,9 +46,13 @@ func (d *DeviceGoUSB) CloseSession() error {
 }
 
 func (d *DeviceGoUSB) GetData(req *Container, info interface{}) error {
+	return d.GetDataContext(context.Background(), req, info)
+}
+
+func (d *DeviceGoUSB) GetDataContext(ctx context.Context, req *Container, info interface{}) error {
 	var buf bytes.Buffer
 	var rep Container
-	if err := d.RunTransaction(req, &rep, &buf, nil, 0); err != nil {
+	if err := d.RunTransactionContext(ctx, req, &rep, &buf, nil, 0); err != nil {
 		return err
 	}
 	err := Decode(&buf, info)
@@ -54,12 +63,16 @@ func (d *DeviceGoUSB) GetData(req *Container, info interface{}) error {
 }
 
 func (d *DeviceGoUSB) SendData(req *Container, rep *Container, value interface{}) error {
+	return d.SendDataContext(context.Background(), req, rep, value)
+}
+
+func (d *DeviceGoUSB) SendDataContext(ctx context.Context, req *Container, rep *Container, value interface{}) error {
 	var buf bytes.Buffer
 	if err := Encode(&buf, value); err != nil {
 		return err
 	}
 	log.MTP.Debugf("encoded %#v", value)
-	return d.RunTransaction(req, rep, nil, &buf, int64(buf.Len()))
+	return d.RunTransactionContext(ctx, req, rep, nil, &buf, int64(buf.Len()))
 }
 
 func (d *DeviceGoUSB) GetDeviceInfo(info *DeviceInfo) error {
@@ -69,22 +82,46 @@ func (d *DeviceGoUSB) GetDeviceInfo(info *DeviceInfo) error {
 }
 
 func (d *DeviceGoUSB) GetDevicePropDesc(propCode uint16, info *DevicePropDesc) error {
+	return d.GetDevicePropDescContext(context.Background(), propCode, info)
+}
+
+func (d *DeviceGoUSB) GetDevicePropDescContext(ctx context.Context, propCode uint16, info *DevicePropDesc) error {
 	var req Container
 	req.Code = OC_GetDevicePropDesc
 	req.Param = append(req.Param, uint32(propCode))
-	return d.GetData(&req, info)
+	return d.GetDataContext(ctx, &req, info)
 }
 
 func (d *DeviceGoUSB) GetDevicePropValue(propCode uint32, dest interface{}) error {
+	return d.GetDevicePropValueContext(context.Background(), propCode, dest)
+}
+
+func (d *DeviceGoUSB) GetDevicePropValueContext(ctx context.Context, propCode uint32, dest interface{}) error {
 	var req Container
 	req.Code = OC_GetDevicePropValue
 	req.Param = []uint32{propCode}
-	return d.GetData(&req, dest)
+	return d.GetDataContext(ctx, &req, dest)
 }
 
 func (d *DeviceGoUSB) SetDevicePropValue(propCode uint32, src interface{}) error {
+	return d.SetDevicePropValueContext(context.Background(), propCode, src)
+}
+
+func (d *DeviceGoUSB) SetDevicePropValueContext(ctx context.Context, propCode uint32, src interface{}) error {
 	var req, rep Container
 	req.Code = OC_SetDevicePropValue
 	req.Param = []uint32{propCode}
-	return d.SendData(&req, &rep, src)
+	return d.SendDataContext(ctx, &req, &rep, src)
+}
+
+// GetPartialObject copies up to size bytes of an object from offset to w.
+func (d *DeviceGoUSB) GetPartialObject(handle, offset, size uint32, w io.Writer) error {
+	return getPartialObject(context.Background(), d, OC_GetPartialObject, handle, uint64(offset), size, w)
+}
+
+// GetPartialObject64 is GetPartialObject for objects of 4GiB or more. code is
+// OC_MTP_GetPartialObject64, OC_NIKON_GetPartialObjectEx or
+// OC_CANON_EOS_GetPartialObject64, whichever the device supports.
+func (d *DeviceGoUSB) GetPartialObject64(code uint16, handle uint32, offset uint64, size uint32, w io.Writer) error {
+	return getPartialObject(context.Background(), d, code, handle, offset, size, w)
 }
@@ -0,0 +1,114 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+)
+
+func (d *DevicePTPIP) OpenSession() error {
+	if d.session != nil {
+		return fmt.Errorf("session already open")
+	}
+
+	var req, rep Container
+	req.Code = OC_OpenSession
+
+	// avoid 0xFFFFFFFF and 0x00000000 for session IDs.
+	sid := uint32(rand.Int31()) | 1
+	req.Param = []uint32{sid} // session
+
+	ctx, cancel := withOpTimeout(context.Background(), req.Code)
+	defer cancel()
+
+	// If opening the session fails, we want to be able to reset
+	// the device, so don't do sanity checks afterwards.
+	if err := d.runTransaction(ctx, &req, &rep, nil, nil, 0); err != nil {
+		return err
+	}
+
+	d.session = &sessionData{
+		tid: 1,
+		sid: sid,
+	}
+	return nil
+}
+
+// Closes a sessions. This is done automatically if the device is closed.
+func (d *DevicePTPIP) CloseSession() error {
+	var req, rep Container
+	req.Code = OC_CloseSession
+	err := d.RunTransaction(&req, &rep, nil, nil, 0)
+	d.session = nil
+	return err
+}
+
+func (d *DevicePTPIP) GetData(req *Container, info interface{}) error {
+	return d.GetDataContext(context.Background(), req, info)
+}
+
+func (d *DevicePTPIP) GetDataContext(ctx context.Context, req *Container, info interface{}) error {
+	var buf bytes.Buffer
+	var rep Container
+	if err := d.RunTransactionContext(ctx, req, &rep, &buf, nil, 0); err != nil {
+		return err
+	}
+	err := Decode(&buf, info)
+	if err == nil {
+		log.MTP.Debugf("mTP decoded %#v", info)
+	}
+	return err
+}
+
+func (d *DevicePTPIP) SendData(req *Container, rep *Container, value interface{}) error {
+	return d.SendDataContext(context.Background(), req, rep, value)
+}
+
+func (d *DevicePTPIP) SendDataContext(ctx context.Context, req *Container, rep *Container, value interface{}) error {
+	var buf bytes.Buffer
+	if err := Encode(&buf, value); err != nil {
+		return err
+	}
+	log.MTP.Debugf("encoded %#v", value)
+	return d.RunTransactionContext(ctx, req, rep, nil, &buf, int64(buf.Len()))
+}
+
+func (d *DevicePTPIP) GetDeviceInfo(info *DeviceInfo) error {
+	var req Container
+	req.Code = OC_GetDeviceInfo
+	return d.GetData(&req, info)
+}
+
+func (d *DevicePTPIP) GetDevicePropDesc(propCode uint16, info *DevicePropDesc) error {
+	return d.GetDevicePropDescContext(context.Background(), propCode, info)
+}
+
+func (d *DevicePTPIP) GetDevicePropDescContext(ctx context.Context, propCode uint16, info *DevicePropDesc) error {
+	var req Container
+	req.Code = OC_GetDevicePropDesc
+	req.Param = append(req.Param, uint32(propCode))
+	return d.GetDataContext(ctx, &req, info)
+}
+
+func (d *DevicePTPIP) GetDevicePropValue(propCode uint32, dest interface{}) error {
+	return d.GetDevicePropValueContext(context.Background(), propCode, dest)
+}
+
+func (d *DevicePTPIP) GetDevicePropValueContext(ctx context.Context, propCode uint32, dest interface{}) error {
+	var req Container
+	req.Code = OC_GetDevicePropValue
+	req.Param = []uint32{propCode}
+	return d.GetDataContext(ctx, &req, dest)
+}
+
+func (d *DevicePTPIP) SetDevicePropValue(propCode uint32, src interface{}) error {
+	return d.SetDevicePropValueContext(context.Background(), propCode, src)
+}
+
+func (d *DevicePTPIP) SetDevicePropValueContext(ctx context.Context, propCode uint32, src interface{}) error {
+	var req, rep Container
+	req.Code = OC_SetDevicePropValue
+	req.Param = []uint32{propCode}
+	return d.SendDataContext(ctx, &req, &rep, src)
+}
@@ -0,0 +1,214 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// 64-bit variants of GetPartialObject and GetObjectSize for objects of 4GiB
+// or more, such as movies.
+const (
+	OC_MTP_GetPartialObject64       = 0x95C1
+	OC_NIKON_GetObjectSize          = 0x9421
+	OC_NIKON_GetPartialObjectEx     = 0x9431
+	OC_CANON_EOS_GetPartialObject64 = 0x9170
+)
+
+// partialChunkSize is the size of a chunk read by an objectReader. Other
+// transactions, e.g. live view, can run between chunks.
+const partialChunkSize = 1 << 20
+
+// partialAttempts is the number of attempts to read a chunk.
+const partialAttempts = 3
+
+// getPartialObject copies up to size bytes of an object from offset to w with
+// the operation code, which is OC_GetPartialObject or one of its 64-bit
+// variants.
+func getPartialObject(ctx context.Context, dev Device, code uint16, handle uint32, offset uint64, size uint32, w io.Writer) error {
+	var req, rep Container
+	req.Code = code
+
+	lo, hi := uint32(offset), uint32(offset>>32)
+	switch code {
+	case OC_GetPartialObject:
+		if hi != 0 {
+			return fmt.Errorf("offset %d is out of range of %s", offset, getName(OC_names, int(code)))
+		}
+		req.Param = []uint32{handle, lo, size}
+	case OC_NIKON_GetPartialObjectEx:
+		req.Param = []uint32{handle, lo, hi, size, 0}
+	case OC_MTP_GetPartialObject64, OC_CANON_EOS_GetPartialObject64:
+		req.Param = []uint32{handle, lo, hi, size}
+	default:
+		return fmt.Errorf("0x%04x isn't a partial object operation", code)
+	}
+
+	return dev.RunTransactionContext(ctx, &req, &rep, w, nil, 0)
+}
+
+// getObjectSize64 returns the size of an object of 4GiB or more, whose
+// ObjectInfo only reports 0xFFFFFFFF.
+func getObjectSize64(ctx context.Context, dev Device, code uint16, handle uint32) (uint64, error) {
+	var buf bytes.Buffer
+	var req, rep Container
+	req.Code = code
+	switch code {
+	case OC_NIKON_GetObjectSize:
+		req.Param = []uint32{handle}
+	case OC_MTP_GetObjectPropValue:
+		req.Param = []uint32{handle, OPC_ObjectSize}
+	default:
+		return 0, fmt.Errorf("0x%04x doesn't get an object size", code)
+	}
+
+	err := dev.RunTransactionContext(ctx, &req, &rep, &buf, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	if buf.Len() < 8 {
+		return 0, fmt.Errorf("got %d bytes for an object size", buf.Len())
+	}
+	return byteOrder.Uint64(buf.Bytes()), nil
+}
+
+// objectReader reads an object in chunks with GetPartialObject, retrying a
+// chunk that fails. It implements io.ReadSeeker for http.ServeContent.
+type objectReader struct {
+	ctx    context.Context
+	s      *LVServer
+	code   uint16
+	handle uint32
+	size   int64
+	off    int64
+
+	buf    []byte
+	bufOff int64
+}
+
+func (o *objectReader) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.off < o.bufOff || o.off >= o.bufOff+int64(len(o.buf)) {
+		err := o.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, o.buf[o.off-o.bufOff:])
+	o.off += int64(n)
+	return n, nil
+}
+
+func (o *objectReader) fill() error {
+	size := int64(partialChunkSize)
+	if rest := o.size - o.off; rest < size {
+		size = rest
+	}
+
+	var buf bytes.Buffer
+	var err error
+	for i := 0; i < partialAttempts; i++ {
+		if i > 0 {
+			log.LV.Warningf("objectReader: retrying to read 0x%08x at %d: %s", o.handle, o.off, err)
+			time.Sleep(time.Duration(i) * 500 * time.Millisecond)
+		}
+
+		buf.Reset()
+		err = o.s.withDevice(PriorityUser, func() error {
+			return getPartialObject(o.ctx, o.s.dev, o.code, o.handle, uint64(o.off), uint32(size), &buf)
+		})
+		if err == nil || o.ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if buf.Len() == 0 {
+		return io.ErrUnexpectedEOF
+	}
+
+	o.buf, o.bufOff = buf.Bytes(), o.off
+	return nil
+}
+
+func (o *objectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("objectReader: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("objectReader: negative position")
+	}
+	o.off = offset
+	return offset, nil
+}
+
+// partialObjectCode returns the operation to read an object of the size in
+// parts, or 0 if the device can't. Unlike capabilities.op, operations are
+// deliberately taken as unsupported without DeviceInfo: a wrong guess fails
+// the download, while reading the whole object works on every device.
+func (s *LVServer) partialObjectCode(size uint64) uint16 {
+	if size < 0xFFFFFFFF && s.caps.ops[OC_GetPartialObject] {
+		return OC_GetPartialObject
+	}
+
+	// The vendor operations are only checked in the dialect of the driver,
+	// as they share the code space.
+	switch s.driver.(type) {
+	case *nikonDriver:
+		if s.caps.ops[OC_NIKON_GetPartialObjectEx] {
+			return OC_NIKON_GetPartialObjectEx
+		}
+	case *canonDriver:
+		if s.caps.ops[OC_CANON_EOS_GetPartialObject64] {
+			return OC_CANON_EOS_GetPartialObject64
+		}
+	}
+	if s.caps.ops[OC_MTP_GetPartialObject64] {
+		return OC_MTP_GetPartialObject64
+	}
+	return 0
+}
+
+// objectSize returns the size of an object, which needs another operation for
+// objects of 4GiB or more. As in partialObjectCode, operations missing from
+// DeviceInfo aren't tried.
+func (s *LVServer) objectSize(ctx context.Context, handle uint32, info ObjectInfo) (uint64, bool) {
+	if info.CompressedSize != 0xFFFFFFFF {
+		return uint64(info.CompressedSize), true
+	}
+
+	var codes []uint16
+	if _, ok := s.driver.(*nikonDriver); ok && s.caps.ops[OC_NIKON_GetObjectSize] {
+		codes = append(codes, OC_NIKON_GetObjectSize)
+	}
+	if s.caps.ops[OC_MTP_GetObjectPropValue] {
+		codes = append(codes, OC_MTP_GetObjectPropValue)
+	}
+
+	for _, code := range codes {
+		var size uint64
+		err := s.withDevice(PriorityUser, func() (err error) {
+			size, err = getObjectSize64(ctx, s.dev, code, handle)
+			return
+		})
+		if err == nil {
+			return size, true
+		}
+		log.LV.Warningf("failed to get the size of 0x%08x with %s: %s", handle, getName(OC_names, int(code)), err)
+	}
+	return 0, false
+}
@@ -0,0 +1,100 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// partialDevice serves GetPartialObject from data and fails the first
+// transactions.
+type partialDevice struct {
+	Device
+	data  []byte
+	fails int
+}
+
+func (d *partialDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	if d.fails > 0 {
+		d.fails--
+		return RCError(RC_IncompleteTransfer)
+	}
+
+	offset := uint64(req.Param[1])
+	size := req.Param[2]
+	if req.Code == OC_MTP_GetPartialObject64 {
+		offset |= uint64(req.Param[2]) << 32
+		size = req.Param[3]
+	}
+	end := offset + uint64(size)
+	if end > uint64(len(d.data)) {
+		end = uint64(len(d.data))
+	}
+	_, err := dest.Write(d.data[offset:end])
+	return err
+}
+
+func TestObjectReader(t *testing.T) {
+	data := make([]byte, 3*partialChunkSize+100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+
+	dev := &partialDevice{data: data, fails: 1}
+	s := &LVServer{dev: dev, sched: NewScheduler()}
+	or := &objectReader{ctx: context.Background(), s: s, code: OC_GetPartialObject, handle: 1, size: int64(len(data))}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/api/objects/1", nil)
+	req.Header.Set("Range", "bytes=1048570-1048590")
+	http.ServeContent(rec, req, "DSC_0001.MOV", time.Time{}, or)
+
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 1048570-1048590/3145828" {
+		t.Errorf("got Content-Range %q", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), data[1048570:1048591]) {
+		t.Error("the range across chunks doesn't match")
+	}
+
+	_, err := or.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(or)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Errorf("the whole object doesn't match: %v", err)
+	}
+}
+
+func TestGetPartialObjectParams(t *testing.T) {
+	var got []uint32
+	dev := &paramsDevice{params: &got}
+
+	err := getPartialObject(context.Background(), dev, OC_NIKON_GetPartialObjectEx, 5, 0x100000010, 1024, ioutil.Discard)
+	if err != nil || len(got) != 5 || got[1] != 0x10 || got[2] != 1 || got[3] != 1024 {
+		t.Errorf("got %v, %v", got, err)
+	}
+
+	err = getPartialObject(context.Background(), dev, OC_GetPartialObject, 5, 0x100000000, 1024, ioutil.Discard)
+	if err == nil {
+		t.Error("64-bit offsets should be rejected by GetPartialObject")
+	}
+}
+
+type paramsDevice struct {
+	Device
+	params *[]uint32
+}
+
+func (d *paramsDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	*d.params = req.Param
+	return nil
+}
@@ -0,0 +1,432 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Picture Control items of DPC_NIKON_ActivePicCtrlItem. Creative Picture
+// Controls start at 101 and the custom ones at 201.
+var picCtrlNames = map[int]string{
+	1: "Standard",
+	2: "Neutral",
+	3: "Vivid",
+	4: "Monochrome",
+	5: "Portrait",
+	6: "Landscape",
+	7: "Flat",
+	8: "Auto",
+}
+
+const (
+	picCtrlCustomFirst = 201
+	picCtrlCustomLast  = 209
+)
+
+// Offsets in Picture Control data, which has the layout of NCP files and the
+// PictureControlData tag in Nikon maker notes. The adjustments are stored
+// with 0x80 added, and 0xFF means not applicable.
+const (
+	picCtrlName        = 4 // 20 bytes
+	picCtrlBase        = 24
+	picCtrlAdjust      = 48 // 0: default, 1: quick adjust, 2: full control
+	picCtrlQuickAdjust = 49
+	picCtrlSharpening  = 50
+	picCtrlContrast    = 51
+	picCtrlBrightness  = 52
+	picCtrlSaturation  = 53
+	picCtrlHue         = 54
+	picCtrlMinSize     = 58
+)
+
+func isCustomPicCtrl(item int) bool {
+	return item >= picCtrlCustomFirst && item <= picCtrlCustomLast
+}
+
+// PictureControlAdjust holds the adjustments of a Picture Control. Nil means
+// not applicable when reading, and unchanged when writing.
+type PictureControlAdjust struct {
+	QuickAdjust *int `json:"quick_adjust,omitempty"`
+	Sharpening  *int `json:"sharpening,omitempty"`
+	Contrast    *int `json:"contrast,omitempty"`
+	Brightness  *int `json:"brightness,omitempty"`
+	Saturation  *int `json:"saturation,omitempty"`
+	Hue         *int `json:"hue,omitempty"`
+}
+
+func (a *PictureControlAdjust) fields() map[int]**int {
+	return map[int]**int{
+		picCtrlQuickAdjust: &a.QuickAdjust,
+		picCtrlSharpening:  &a.Sharpening,
+		picCtrlContrast:    &a.Contrast,
+		picCtrlBrightness:  &a.Brightness,
+		picCtrlSaturation:  &a.Saturation,
+		picCtrlHue:         &a.Hue,
+	}
+}
+
+// PictureControl is an entry of /api/picture-controls.
+type PictureControl struct {
+	Item   int                   `json:"item"`
+	Name   string                `json:"name"`
+	Base   string                `json:"base,omitempty"`
+	Custom bool                  `json:"custom"`
+	Active bool                  `json:"active"`
+	Adjust *PictureControlAdjust `json:"adjust,omitempty"`
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// isNCP reports whether data has the layout parsePicCtrlData understands.
+// Newer bodies use the NP3 format, which is only transferred as is.
+func isNCP(data []byte) bool {
+	if len(data) < picCtrlMinSize {
+		return false
+	}
+	for _, c := range data[:4] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parsePicCtrlData reads the names and the adjustments in Picture Control
+// data.
+func parsePicCtrlData(data []byte) (string, string, PictureControlAdjust, error) {
+	var adj PictureControlAdjust
+	if !isNCP(data) {
+		return "", "", adj, fmt.Errorf("unsupported Picture Control data format")
+	}
+
+	for off, f := range adj.fields() {
+		if data[off] != 0xFF {
+			v := int(data[off]) - 0x80
+			*f = &v
+		}
+	}
+	return cString(data[picCtrlName : picCtrlName+20]), cString(data[picCtrlBase : picCtrlBase+20]), adj, nil
+}
+
+// applyPicCtrlAdjust returns a copy of Picture Control data with the non-nil
+// adjustments.
+func applyPicCtrlAdjust(data []byte, adj PictureControlAdjust) ([]byte, error) {
+	if !isNCP(data) {
+		return nil, fmt.Errorf("unsupported Picture Control data format")
+	}
+
+	data = append([]byte{}, data...)
+	for off, f := range adj.fields() {
+		if *f == nil {
+			continue
+		}
+		if data[off] == 0xFF {
+			return nil, fmt.Errorf("the adjustment at %d is not applicable to this Picture Control", off)
+		}
+		v := **f + 0x80
+		if v < 0 || v >= 0xFF {
+			return nil, fmt.Errorf("adjustment %d is out of range", **f)
+		}
+		data[off] = byte(v)
+		if off != picCtrlQuickAdjust {
+			data[picCtrlAdjust] = 2
+		}
+	}
+	return data, nil
+}
+
+func (n *nikonDriver) picCtrlData(ctx context.Context, item int) ([]byte, error) {
+	var buf bytes.Buffer
+	var req, rep Container
+	req.Code = OC_NIKON_GetPictCtrlData
+	req.Param = []uint32{uint32(item), 0}
+	err := n.dev.RunTransactionContext(ctx, &req, &rep, &buf, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (n *nikonDriver) setPicCtrlData(ctx context.Context, item int, data []byte) error {
+	var req, rep Container
+	req.Code = OC_NIKON_SetPictCtrlData
+	req.Param = []uint32{uint32(item), 0}
+	return n.dev.RunTransactionContext(ctx, &req, &rep, nil, bytes.NewReader(data), int64(len(data)))
+}
+
+func (n *nikonDriver) deletePicCtrl(ctx context.Context, item int) error {
+	var req, rep Container
+	req.Code = OC_NIKON_DelCstPicCtrl
+	req.Param = []uint32{uint32(item)}
+	return n.dev.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
+}
+
+// picCtrlItems returns the selectable Picture Controls and the active one.
+func (n *nikonDriver) picCtrlItems(ctx context.Context) ([]int, int, error) {
+	e, err := n.props.enum(ctx, DPC_NIKON_ActivePicCtrlItem)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var items []int
+	for _, v := range e.values {
+		items = append(items, int(v))
+	}
+	return items, int(e.current), nil
+}
+
+// pictureControl reads a Picture Control. The adjustments are omitted if the
+// data is in a format we can't parse.
+func (n *nikonDriver) pictureControl(ctx context.Context, item int) (PictureControl, error) {
+	pc := PictureControl{Item: item, Name: picCtrlNames[item], Custom: isCustomPicCtrl(item)}
+	if pc.Name == "" && pc.Custom {
+		pc.Name = fmt.Sprintf("Custom %d", item-picCtrlCustomFirst+1)
+	} else if pc.Name == "" {
+		pc.Name = fmt.Sprintf("Picture Control %d", item)
+	}
+
+	data, err := n.picCtrlData(ctx, item)
+	if err != nil {
+		return pc, err
+	}
+
+	name, base, adj, err := parsePicCtrlData(data)
+	if err == nil {
+		if name != "" {
+			pc.Name = name
+		}
+		pc.Base = base
+		pc.Adjust = &adj
+	}
+	return pc, nil
+}
+
+// picCtrlDriver returns the driver if the camera manages Picture Controls.
+func (s *LVServer) picCtrlDriver() (*nikonDriver, bool) {
+	n, ok := s.driver.(*nikonDriver)
+	return n, ok && s.caps.op(OC_NIKON_GetPictCtrlData) && s.caps.prop(DPC_NIKON_ActivePicCtrlItem)
+}
+
+// HandlePictureControls manages the Picture Controls of Nikon cameras:
+//
+//	GET    /api/picture-controls              lists them
+//	PUT    /api/picture-controls/active       selects one with {"item": 1}
+//	GET    /api/picture-controls/{item}       reads one
+//	PUT    /api/picture-controls/{item}       edits the adjustments
+//	DELETE /api/picture-controls/{item}       deletes a custom one
+//	GET    /api/picture-controls/{item}/file  downloads the NCP/NP3 data
+//	PUT    /api/picture-controls/{item}/file  uploads the data of a custom one
+func (s *LVServer) HandlePictureControls(w http.ResponseWriter, r *http.Request) {
+	n, ok := s.picCtrlDriver()
+	if s.dummy || !ok {
+		http.Error(w, "the camera doesn't support Picture Controls", http.StatusNotImplemented)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/picture-controls"), "/"), "/")
+	switch {
+	case parts[0] == "" && r.Method == http.MethodGet:
+		s.listPictureControls(w, r, n)
+		return
+	case parts[0] == "active" && len(parts) == 1 && r.Method == http.MethodPut:
+		s.selectPictureControl(w, r, n)
+		return
+	}
+
+	item, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "file") {
+		http.NotFound(w, r)
+		return
+	}
+	file := len(parts) == 2
+
+	switch {
+	case r.Method == http.MethodGet && file:
+		s.downloadPictureControl(w, r, n, item)
+	case r.Method == http.MethodPut && file:
+		s.uploadPictureControl(w, r, n, item)
+	case r.Method == http.MethodGet:
+		s.getPictureControl(w, r, n, item)
+	case r.Method == http.MethodPut:
+		s.editPictureControl(w, r, n, item)
+	case r.Method == http.MethodDelete && !file:
+		s.deletePictureControl(w, r, n, item)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *LVServer) listPictureControls(w http.ResponseWriter, r *http.Request, n *nikonDriver) {
+	var pcs []PictureControl
+	err := s.withDevice(PriorityUser, func() error {
+		items, active, err := n.picCtrlItems(r.Context())
+		if err != nil {
+			return err
+		}
+
+		pcs = make([]PictureControl, 0, len(items))
+		for _, item := range items {
+			pc, err := n.pictureControl(r.Context(), item)
+			if err != nil {
+				// Empty custom slots can't be read.
+				log.LV.Debugf("HandlePictureControls: failed to read Picture Control %d: %s", item, err)
+				if pc.Custom {
+					continue
+				}
+			}
+			pc.Active = item == active
+			pcs = append(pcs, pc)
+		}
+		return nil
+	})
+	if err != nil {
+		log.LV.Errorf("HandlePictureControls: failed to list Picture Controls: %s", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, pcs)
+}
+
+func (s *LVServer) selectPictureControl(w http.ResponseWriter, r *http.Request, n *nikonDriver) {
+	var req struct {
+		Item int `json:"item"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Item <= 0 {
+		http.Error(w, "an item is required", http.StatusBadRequest)
+		return
+	}
+
+	err = s.withDevice(PriorityUser, func() error {
+		return n.SetPropUint(r.Context(), DPC_NIKON_ActivePicCtrlItem, uint64(req.Item))
+	})
+	if err != nil {
+		log.LV.Errorf("HandlePictureControls: failed to select Picture Control %d: %s", req.Item, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *LVServer) getPictureControl(w http.ResponseWriter, r *http.Request, n *nikonDriver, item int) {
+	var pc PictureControl
+	err := s.withDevice(PriorityUser, func() (err error) {
+		pc, err = n.pictureControl(r.Context(), item)
+		return
+	})
+	if err != nil {
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+	writeJSON(w, pc)
+}
+
+func (s *LVServer) editPictureControl(w http.ResponseWriter, r *http.Request, n *nikonDriver, item int) {
+	var adj PictureControlAdjust
+	err := json.NewDecoder(r.Body).Decode(&adj)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode adjustments: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	var pc PictureControl
+	status := http.StatusBadGateway
+	err = s.withDevice(PriorityUser, func() error {
+		data, err := n.picCtrlData(r.Context(), item)
+		if err != nil {
+			status = storageStatus(err)
+			return err
+		}
+		data, err = applyPicCtrlAdjust(data, adj)
+		if err != nil {
+			status = http.StatusBadRequest
+			return err
+		}
+		err = n.setPicCtrlData(r.Context(), item, data)
+		if err != nil {
+			return err
+		}
+		pc, err = n.pictureControl(r.Context(), item)
+		return err
+	})
+	if err != nil {
+		log.LV.Errorf("HandlePictureControls: failed to edit Picture Control %d: %s", item, err)
+		http.Error(w, err.Error(), status)
+		return
+	}
+	writeJSON(w, pc)
+}
+
+func (s *LVServer) deletePictureControl(w http.ResponseWriter, r *http.Request, n *nikonDriver, item int) {
+	if !isCustomPicCtrl(item) {
+		http.Error(w, "only custom Picture Controls can be deleted", http.StatusForbidden)
+		return
+	}
+
+	err := s.withDevice(PriorityUser, func() error {
+		return n.deletePicCtrl(r.Context(), item)
+	})
+	if err != nil {
+		log.LV.Errorf("HandlePictureControls: failed to delete Picture Control %d: %s", item, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *LVServer) downloadPictureControl(w http.ResponseWriter, r *http.Request, n *nikonDriver, item int) {
+	var data []byte
+	err := s.withDevice(PriorityUser, func() (err error) {
+		data, err = n.picCtrlData(r.Context(), item)
+		return
+	})
+	if err != nil {
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+
+	ext := ".NP3"
+	if isNCP(data) {
+		ext = ".NCP"
+	}
+	name := fmt.Sprintf("PICCON%02d%s", item%100, ext)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	w.Write(data)
+}
+
+func (s *LVServer) uploadPictureControl(w http.ResponseWriter, r *http.Request, n *nikonDriver, item int) {
+	if !isCustomPicCtrl(item) {
+		http.Error(w, fmt.Sprintf("custom Picture Controls are %d to %d", picCtrlCustomFirst, picCtrlCustomLast), http.StatusForbidden)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil || len(data) == 0 {
+		http.Error(w, "a Picture Control file is required", http.StatusBadRequest)
+		return
+	}
+
+	err = s.withDevice(PriorityUser, func() error {
+		return n.setPicCtrlData(r.Context(), item, data)
+	})
+	if err != nil {
+		log.LV.Errorf("HandlePictureControls: failed to upload Picture Control %d: %s", item, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+	log.LV.Infof("uploaded Picture Control %d", item)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,57 @@
+package mtp
+
+import (
+	"testing"
+)
+
+func testPicCtrlData() []byte {
+	data := make([]byte, picCtrlMinSize)
+	copy(data, "0100")
+	copy(data[picCtrlName:], "MY LOOK")
+	copy(data[picCtrlBase:], "STANDARD")
+	data[picCtrlQuickAdjust] = 0xFF
+	data[picCtrlSharpening] = 0x83
+	data[picCtrlContrast] = 0x7F
+	data[picCtrlBrightness] = 0x80
+	data[picCtrlSaturation] = 0x80
+	data[picCtrlHue] = 0x80
+	return data
+}
+
+func TestParsePicCtrlData(t *testing.T) {
+	name, base, adj, err := parsePicCtrlData(testPicCtrlData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "MY LOOK" || base != "STANDARD" {
+		t.Errorf("got %q, %q", name, base)
+	}
+	if adj.QuickAdjust != nil || *adj.Sharpening != 3 || *adj.Contrast != -1 || *adj.Hue != 0 {
+		t.Errorf("got %+v", adj)
+	}
+
+	if _, _, _, err = parsePicCtrlData([]byte("NCP\x00")); err == nil {
+		t.Error("unknown formats should be rejected")
+	}
+}
+
+func TestApplyPicCtrlAdjust(t *testing.T) {
+	orig := testPicCtrlData()
+	saturation := 2
+	data, err := applyPicCtrlAdjust(orig, PictureControlAdjust{Saturation: &saturation})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[picCtrlSaturation] != 0x82 || data[picCtrlAdjust] != 2 || orig[picCtrlSaturation] != 0x80 {
+		t.Errorf("got % x", data)
+	}
+
+	quick := 1
+	if _, err = applyPicCtrlAdjust(orig, PictureControlAdjust{QuickAdjust: &quick}); err == nil {
+		t.Error("adjustments not applicable should be rejected")
+	}
+	big := 200
+	if _, err = applyPicCtrlAdjust(orig, PictureControlAdjust{Hue: &big}); err == nil {
+		t.Error("adjustments out of range should be rejected")
+	}
+}
@@ -0,0 +1,203 @@
+package mtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// powerInterval is the interval to read the power state.
+const powerInterval = 10 * time.Second
+
+// Battery cells of DPC_NIKON_BatteryCellKind, used in AA battery packs.
+var nikonBatteryCells = map[uint64]string{
+	0: "LR6 (alkaline)",
+	1: "HR6 (Ni-MH)",
+	2: "FR6 (lithium)",
+	3: "ZR6 (Ni-Mn)",
+}
+
+// PowerStatus is the battery and power state of the camera.
+type PowerStatus struct {
+	// BatteryLevel is in percent, or nil if the camera doesn't report it.
+	BatteryLevel *int      `json:"battery_level"`
+	BatteryCell  string    `json:"battery_cell,omitempty"`
+	ACPower      *bool     `json:"ac_power,omitempty"`
+	Low          bool      `json:"low"`
+	Updated      time.Time `json:"updated"`
+}
+
+// PowerAlert is POSTed to the webhook when the battery level reaches a
+// threshold.
+type PowerAlert struct {
+	Event        string `json:"event"`
+	BatteryLevel int    `json:"battery_level"`
+	Threshold    int    `json:"threshold"`
+}
+
+// PowerConfig configures low battery alerts.
+type PowerConfig struct {
+	// Thresholds are the battery levels in percent to warn at.
+	Thresholds []int
+	// Webhook is the URL to POST a PowerAlert to.
+	Webhook string
+}
+
+type powerMonitor struct {
+	cfg PowerConfig
+
+	status *PowerStatus
+	lock   sync.Mutex
+
+	// alerted holds the thresholds warned about until the level recovers.
+	alerted map[int]bool
+}
+
+// SetPowerAlerts sets the battery levels to warn at.
+func (s *LVServer) SetPowerAlerts(cfg PowerConfig) {
+	sort.Sort(sort.Reverse(sort.IntSlice(cfg.Thresholds)))
+	s.power.cfg = cfg
+}
+
+// crossed returns the thresholds the battery level has newly reached, and
+// forgets the ones it has recovered from, e.g. after swapping the battery.
+func (p *powerMonitor) crossed(level int) []int {
+	var crossed []int
+	for _, t := range p.cfg.Thresholds {
+		if level > t {
+			delete(p.alerted, t)
+		} else if !p.alerted[t] {
+			p.alerted[t] = true
+			crossed = append(crossed, t)
+		}
+	}
+	return crossed
+}
+
+// low reports whether the level is at the lowest threshold or below, or 10%
+// if no threshold is set.
+func (p *powerMonitor) low(level int) bool {
+	lowest := 10
+	if n := len(p.cfg.Thresholds); n > 0 {
+		lowest = p.cfg.Thresholds[n-1]
+	}
+	return level <= lowest
+}
+
+func (p *powerMonitor) get() *PowerStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.status
+}
+
+// readPower reads the power state. Properties the camera lacks are left out.
+func (s *LVServer) readPower() (PowerStatus, error) {
+	st := PowerStatus{Updated: time.Now()}
+
+	err := s.withDevice(PriorityBackground, func() error {
+		v, err := s.driver.GetPropUint(s.ctx, DPC_BatteryLevel)
+		if err != nil {
+			return err
+		}
+		level := int(v)
+		if level > 100 {
+			level = 100
+		}
+		st.BatteryLevel = &level
+
+		if _, ok := s.driver.(*nikonDriver); !ok {
+			return nil
+		}
+		if s.caps.prop(DPC_NIKON_BatteryCellKind) {
+			if v, err := s.driver.GetPropUint(s.ctx, DPC_NIKON_BatteryCellKind); err == nil {
+				st.BatteryCell = nikonBatteryCells[v]
+			}
+		}
+		if s.caps.prop(DPC_NIKON_ACPower) {
+			if v, err := s.driver.GetPropUint(s.ctx, DPC_NIKON_ACPower); err == nil {
+				ac := v != 0
+				st.ACPower = &ac
+			}
+		}
+		return nil
+	})
+	return st, err
+}
+
+func (s *LVServer) workerPower() error {
+	tick := time.NewTicker(powerInterval)
+	defer tick.Stop()
+
+	failed := false
+	for {
+		st, err := s.readPower()
+		if err != nil && !failed {
+			log.LV.Warningf("workerPower: failed to read the battery level: %s", err)
+			failed = true
+		} else if err == nil {
+			failed = false
+			s.updatePower(st)
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return nil
+		case <-tick.C:
+		}
+	}
+}
+
+func (s *LVServer) updatePower(st PowerStatus) {
+	level := *st.BatteryLevel
+	onAC := st.ACPower != nil && *st.ACPower
+
+	p := s.power
+	p.lock.Lock()
+	st.Low = !onAC && p.low(level)
+	var crossed []int
+	if !onAC {
+		crossed = p.crossed(level)
+	}
+	p.status = &st
+	p.lock.Unlock()
+
+	s.infoLock.Lock()
+	s.info.Power = &st
+	s.infoLock.Unlock()
+
+	for _, t := range crossed {
+		log.LV.Warningf("battery level is %d%%, at or below %d%%", level, t)
+		if p.cfg.Webhook == "" {
+			continue
+		}
+
+		j, err := json.Marshal(PowerAlert{Event: "battery_low", BatteryLevel: level, Threshold: t})
+		if err != nil {
+			log.LV.Errorf("workerPower: failed to marshal payload: %s", err)
+			continue
+		}
+		go s.postWebhook(p.cfg.Webhook, j)
+	}
+}
+
+// StatusPayload is the response of /api/status.
+type StatusPayload struct {
+	Driver   string        `json:"driver"`
+	Power    *PowerStatus  `json:"power"`
+	LiveView LiveViewState `json:"live_view"`
+}
+
+// HandleStatus reports the state of the camera.
+func (s *LVServer) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	st := StatusPayload{Power: s.power.get()}
+	if s.driver != nil {
+		st.Driver = s.driver.Name()
+	}
+
+	s.infoLock.Lock()
+	st.LiveView = s.info.LV
+	s.infoLock.Unlock()
+	writeJSON(w, st)
+}
@@ -0,0 +1,58 @@
+package mtp
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestPowerThresholds(t *testing.T) {
+	s := &LVServer{power: &powerMonitor{alerted: map[int]bool{}}}
+	s.SetPowerAlerts(PowerConfig{Thresholds: []int{5, 20, 10}})
+
+	for _, tc := range []struct {
+		level   int
+		crossed []int
+		low     bool
+	}{
+		{80, nil, false},
+		{20, []int{20}, false},
+		{18, nil, false},
+		{4, []int{10, 5}, true},
+		{3, nil, true},
+		// The battery is swapped.
+		{100, nil, false},
+		{9, []int{20, 10}, false},
+	} {
+		crossed := s.power.crossed(tc.level)
+		if !reflect.DeepEqual(crossed, tc.crossed) {
+			t.Errorf("%d%%: got %v, expected %v", tc.level, crossed, tc.crossed)
+		}
+		if low := s.power.low(tc.level); low != tc.low {
+			t.Errorf("%d%%: got low = %v, expected %v", tc.level, low, tc.low)
+		}
+	}
+}
+
+func TestHandleStatus(t *testing.T) {
+	s := &LVServer{power: &powerMonitor{alerted: map[int]bool{}}}
+
+	ac := false
+	s.updatePower(PowerStatus{BatteryLevel: new(int), ACPower: &ac})
+
+	rec := httptest.NewRecorder()
+	s.HandleStatus(rec, httptest.NewRequest("GET", "/api/status", nil))
+
+	var st StatusPayload
+	err := json.NewDecoder(rec.Body).Decode(&st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Power == nil || *st.Power.BatteryLevel != 0 || !st.Power.Low {
+		t.Errorf("got %+v", st.Power)
+	}
+	if s.info.Power == nil || !s.info.Power.Low {
+		t.Errorf("InfoPayload is not updated: %+v", s.info.Power)
+	}
+}
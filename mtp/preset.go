@@ -0,0 +1,247 @@
+package mtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Preset is a named set of camera properties. ISO and FN are in the same
+// units as ControlPayload; the others are the raw values of the properties.
+type Preset struct {
+	ISO            *int    `json:"iso,omitempty"`
+	FN             *string `json:"fn,omitempty"`
+	ExposureTime   *uint64 `json:"exposure_time,omitempty"`
+	WhiteBalance   *uint64 `json:"white_balance,omitempty"`
+	PictureControl *uint64 `json:"picture_control,omitempty"`
+	FocusMode      *uint64 `json:"focus_mode,omitempty"`
+	AFMode         *uint64 `json:"af_mode,omitempty"`
+	Resolution     *uint64 `json:"resolution,omitempty"`
+}
+
+// presetProp is a raw property of a preset.
+type presetProp struct {
+	code  uint16
+	value **uint64
+}
+
+// rawProps returns the raw properties of the preset in the order to write
+// them: the resolution before the exposure time it may limit, and the focus
+// mode before the AF mode which only applies to AF.
+func (p *Preset) rawProps() []presetProp {
+	return []presetProp{
+		{DPC_NIKON_Resolution, &p.Resolution},
+		{DPC_ExposureTime, &p.ExposureTime},
+		{DPC_WhiteBalance, &p.WhiteBalance},
+		{DPC_NIKON_ActivePicCtrlItem, &p.PictureControl},
+		{DPC_FocusMode, &p.FocusMode},
+		{DPC_NIKON_AutofocusMode, &p.AFMode},
+	}
+}
+
+// Stages of applying a preset. Like -max-resolution, the resolution is
+// written before live view starts.
+const (
+	presetAll = iota
+	presetBeforeLiveView
+	presetAfterLiveView
+)
+
+// inStage reports whether the property is written in the stage.
+func (prop presetProp) inStage(stage int) bool {
+	switch stage {
+	case presetBeforeLiveView:
+		return prop.code == DPC_NIKON_Resolution
+	case presetAfterLiveView:
+		return prop.code != DPC_NIKON_Resolution
+	}
+	return true
+}
+
+// PresetStore holds presets and persists them to a JSON file.
+type PresetStore struct {
+	path    string
+	presets map[string]Preset
+	lock    sync.Mutex
+}
+
+// LoadPresetStore reads presets from the JSON file at path.
+// A missing file is treated as an empty store and created on the first save.
+func LoadPresetStore(path string) (*PresetStore, error) {
+	ps := &PresetStore{
+		path:    path,
+		presets: map[string]Preset{},
+	}
+
+	if path == "" {
+		return ps, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read presets: %s", err)
+	}
+
+	err = json.Unmarshal(raw, &ps.presets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse presets: %s", err)
+	}
+	return ps, nil
+}
+
+func (ps *PresetStore) Get(name string) (Preset, bool) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	p, ok := ps.presets[name]
+	return p, ok
+}
+
+// Names returns the names of the presets in alphabetical order.
+func (ps *PresetStore) Names() []string {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	names := make([]string, 0, len(ps.presets))
+	for name := range ps.presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Put stores the preset and writes the whole store back to the file.
+func (ps *PresetStore) Put(name string, p Preset) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	if ps.path == "" {
+		ps.presets[name] = p
+		return nil
+	}
+
+	presets := make(map[string]Preset, len(ps.presets)+1)
+	for n, v := range ps.presets {
+		presets[n] = v
+	}
+	presets[name] = p
+
+	raw, err := json.MarshalIndent(presets, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal presets: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(ps.path), filepath.Base(ps.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save presets: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(raw)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save presets: %s", err)
+	}
+
+	err = os.Rename(tmp.Name(), ps.path)
+	if err != nil {
+		return fmt.Errorf("failed to save presets: %s", err)
+	}
+	ps.presets = presets
+	return nil
+}
+
+// Thread-safe preset operations
+
+// applyPreset writes the properties of the preset for the stage in order.
+func (s *LVServer) applyPreset(name string, stage int) error {
+	p, ok := s.presets.Get(name)
+	if !ok {
+		return fmt.Errorf("no such preset: %s", name)
+	}
+
+	s.sched.Lock(PriorityUser)
+	defer s.sched.Unlock()
+
+	if s.dummy {
+		return nil
+	}
+
+	failed := 0
+
+	if p.FN != nil && stage != presetBeforeLiveView {
+		err := s.driver.SetFN(s.ctx, *p.FN)
+		if err != nil {
+			log.LV.Warningf("preset %s: %s", name, err)
+			failed++
+		}
+	}
+
+	if p.ISO != nil && stage != presetBeforeLiveView {
+		err := s.driver.SetISO(s.ctx, *p.ISO)
+		if err != nil {
+			log.LV.Warningf("preset %s: %s", name, err)
+			failed++
+		}
+	}
+
+	for _, prop := range p.rawProps() {
+		if *prop.value == nil || !prop.inStage(stage) {
+			continue
+		}
+		err := s.driver.SetPropUint(s.ctx, prop.code, **prop.value)
+		if err != nil {
+			log.LV.Warningf("preset %s: %s", name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to apply %d properties of preset %s", failed, name)
+	}
+	return nil
+}
+
+func (s *LVServer) capturePreset() (Preset, error) {
+	s.sched.Lock(PriorityUser)
+	defer s.sched.Unlock()
+
+	p := Preset{}
+
+	if s.dummy {
+		iso, fn := 100, "3.5"
+		p.ISO, p.FN = &iso, &fn
+		return p, nil
+	}
+
+	_, iso, err := s.driver.ISOs(s.ctx)
+	if err != nil {
+		return p, fmt.Errorf("failed to capture preset: %s", err)
+	}
+	p.ISO = &iso
+
+	_, fn, err := s.driver.FNs(s.ctx)
+	if err != nil {
+		return p, fmt.Errorf("failed to capture preset: %s", err)
+	}
+	p.FN = &fn
+
+	for _, prop := range p.rawProps() {
+		raw, err := s.driver.GetPropUint(s.ctx, prop.code)
+		if err != nil {
+			// Not every body has every property.
+			log.LV.Debugf("capturePreset: skipping %s: %s", getName(DPC_names, int(prop.code)), err)
+			continue
+		}
+		*prop.value = &raw
+	}
+
+	return p, nil
+}
@@ -0,0 +1,109 @@
+package mtp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPresetStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "preset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "presets.json")
+
+	ps, err := LoadPresetStore(path)
+	if err != nil || len(ps.Names()) != 0 {
+		t.Fatalf("a missing file should be an empty store: %v, %v", ps.Names(), err)
+	}
+
+	iso, fn, wb := 400, "5.6", uint64(0x8010)
+	indoor := Preset{ISO: &iso, FN: &fn, WhiteBalance: &wb}
+	err = ps.Put("indoor", indoor)
+	if err == nil {
+		err = ps.Put("outdoor", Preset{FN: &fn})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps, err = LoadPresetStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := ps.Names(); !reflect.DeepEqual(names, []string{"indoor", "outdoor"}) {
+		t.Errorf("got %v", names)
+	}
+	if p, ok := ps.Get("indoor"); !ok || !reflect.DeepEqual(p, indoor) {
+		t.Errorf("got %+v", p)
+	}
+
+	// A preset which can't be saved isn't kept either.
+	ps.path = filepath.Join(dir, "missing", "presets.json")
+	err = ps.Put("night", Preset{ISO: &iso})
+	if _, ok := ps.Get("night"); err == nil || ok {
+		t.Errorf("got %v, %v", ok, err)
+	}
+}
+
+// presetDriver records the properties written in order, ISO and f-number as
+// DPC_ExposureIndex and DPC_FNumber.
+type presetDriver struct {
+	Driver
+	writes []uint16
+}
+
+func (d *presetDriver) SetISO(ctx context.Context, iso int) error {
+	d.writes = append(d.writes, DPC_ExposureIndex)
+	return nil
+}
+
+func (d *presetDriver) SetFN(ctx context.Context, fn string) error {
+	d.writes = append(d.writes, DPC_FNumber)
+	return nil
+}
+
+func (d *presetDriver) SetPropUint(ctx context.Context, code uint16, v uint64) error {
+	d.writes = append(d.writes, code)
+	if code == DPC_WhiteBalance {
+		return RCError(RC_InvalidDevicePropValue)
+	}
+	return nil
+}
+
+func TestApplyPreset(t *testing.T) {
+	ps, _ := LoadPresetStore("")
+	iso, fn, v := 400, "5.6", uint64(1)
+	_ = ps.Put("all", Preset{ISO: &iso, FN: &fn, ExposureTime: &v, WhiteBalance: &v, FocusMode: &v, AFMode: &v, Resolution: &v})
+
+	d := &presetDriver{}
+	s := &LVServer{driver: d, presets: ps, sched: NewScheduler(), ctx: context.Background()}
+
+	for _, tc := range []struct {
+		stage    int
+		expected []uint16
+	}{
+		{presetAll, []uint16{DPC_FNumber, DPC_ExposureIndex, DPC_NIKON_Resolution, DPC_ExposureTime, DPC_WhiteBalance, DPC_FocusMode, DPC_NIKON_AutofocusMode}},
+		{presetBeforeLiveView, []uint16{DPC_NIKON_Resolution}},
+		{presetAfterLiveView, []uint16{DPC_FNumber, DPC_ExposureIndex, DPC_ExposureTime, DPC_WhiteBalance, DPC_FocusMode, DPC_NIKON_AutofocusMode}},
+	} {
+		d.writes = nil
+		err := s.applyPreset("all", tc.stage)
+		if !reflect.DeepEqual(d.writes, tc.expected) {
+			t.Errorf("stage %d: got %v, expected %v", tc.stage, d.writes, tc.expected)
+		}
+		failed := tc.stage != presetBeforeLiveView
+		if (err != nil) != failed {
+			t.Errorf("stage %d: got %v", tc.stage, err)
+		}
+	}
+
+	if err := s.applyPreset("none", presetAll); err == nil {
+		t.Error("applied a missing preset")
+	}
+}
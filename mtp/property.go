@@ -0,0 +1,165 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// newPropValue instantiates a pointer to a single-field struct that holds a
+// property value of the given data type, so that it can be passed to
+// GetDevicePropValue and SetDevicePropValue.
+func newPropValue(dataType DataTypeSelector) (reflect.Value, error) {
+	switch dataType {
+	case DTC_INT8, DTC_UINT8, DTC_INT16, DTC_UINT16, DTC_INT32, DTC_UINT32, DTC_INT64, DTC_UINT64:
+	default:
+		return reflect.Value{}, fmt.Errorf("unsupported data type %s", getName(DTC_names, int(dataType)))
+	}
+
+	t := reflect.StructOf([]reflect.StructField{
+		{Name: "Value", Type: InstantiateType(DecodeHints{Selector: dataType}).Type()},
+	})
+	return reflect.New(t), nil
+}
+
+// propUint converts an integer property value of any width into uint64.
+// Signed values are reinterpreted bit by bit.
+func propUint(v interface{}) (uint64, bool) {
+	switch c := v.(type) {
+	case int8:
+		return uint64(uint8(c)), true
+	case uint8:
+		return uint64(c), true
+	case int16:
+		return uint64(uint16(c)), true
+	case uint16:
+		return uint64(c), true
+	case int32:
+		return uint64(uint32(c)), true
+	case uint32:
+		return uint64(c), true
+	case int64:
+		return uint64(c), true
+	case uint64:
+		return c, true
+	}
+	return 0, false
+}
+
+// propAccessor reads and writes integer properties with the standard
+// operations, remembering their data types.
+type propAccessor struct {
+	dev   Device
+	types map[uint16]DataTypeSelector
+}
+
+func newPropAccessor(dev Device) *propAccessor {
+	return &propAccessor{
+		dev:   dev,
+		types: map[uint16]DataTypeSelector{},
+	}
+}
+
+// dataType returns the data type of a device property.
+func (pa *propAccessor) dataType(ctx context.Context, code uint16) (DataTypeSelector, error) {
+	if t, ok := pa.types[code]; ok {
+		return t, nil
+	}
+
+	desc := DevicePropDesc{}
+	err := pa.dev.GetDevicePropDescContext(ctx, code, &desc)
+	if err != nil {
+		return 0, err
+	}
+	pa.types[code] = desc.DataType
+	return desc.DataType, nil
+}
+
+// getUint reads an integer device property regardless of its width.
+func (pa *propAccessor) getUint(ctx context.Context, code uint16) (uint64, error) {
+	dataType, err := pa.dataType(ctx, code)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the type of %s: %s", getName(DPC_names, int(code)), err)
+	}
+
+	val, err := newPropValue(dataType)
+	if err != nil {
+		return 0, err
+	}
+
+	err = pa.dev.GetDevicePropValueContext(ctx, uint32(code), val.Interface())
+	if err != nil {
+		return 0, fmt.Errorf("failed to get %s: %s", getName(DPC_names, int(code)), err)
+	}
+
+	v, _ := propUint(val.Elem().Field(0).Interface())
+	return v, nil
+}
+
+// setUint writes an integer device property, encoding the value in the width
+// the camera expects.
+func (pa *propAccessor) setUint(ctx context.Context, code uint16, v uint64) error {
+	dataType, err := pa.dataType(ctx, code)
+	if err != nil {
+		return fmt.Errorf("failed to get the type of %s: %s", getName(DPC_names, int(code)), err)
+	}
+
+	val, err := newPropValue(dataType)
+	if err != nil {
+		return err
+	}
+
+	f := val.Elem().Field(0)
+	switch f.Kind() {
+	case reflect.Int8:
+		f.SetInt(int64(int8(v)))
+	case reflect.Int16:
+		f.SetInt(int64(int16(v)))
+	case reflect.Int32:
+		f.SetInt(int64(int32(v)))
+	case reflect.Int64:
+		f.SetInt(int64(v))
+	default:
+		f.SetUint(v)
+	}
+
+	err = pa.dev.SetDevicePropValueContext(ctx, uint32(code), val.Interface())
+	if err != nil {
+		return fmt.Errorf("failed to set %s: %w", getName(DPC_names, int(code)), err)
+	}
+	return nil
+}
+
+// propEnum is an enumerated integer property.
+type propEnum struct {
+	values   []uint64
+	current  uint64
+	settable bool
+}
+
+// enum reads the values an enumerated integer property accepts and the
+// current one.
+func (pa *propAccessor) enum(ctx context.Context, code uint16) (propEnum, error) {
+	desc := DevicePropDesc{}
+	err := pa.dev.GetDevicePropDescContext(ctx, code, &desc)
+	if err != nil {
+		return propEnum{}, fmt.Errorf("failed to get %s: %w", getName(DPC_names, int(code)), err)
+	}
+	pa.types[code] = desc.DataType
+
+	form, ok := desc.Form.(*PropDescEnumForm)
+	if !ok {
+		return propEnum{}, fmt.Errorf("%s is not enumerated", getName(DPC_names, int(code)))
+	}
+
+	e := propEnum{settable: desc.GetSet == DPGS_GetSet}
+	for _, iface := range form.Values {
+		v, ok := propUint(iface)
+		if !ok {
+			return propEnum{}, fmt.Errorf("unexpected value of %s: %v", getName(DPC_names, int(code)), iface)
+		}
+		e.values = append(e.values, v)
+	}
+	e.current, _ = propUint(desc.CurrentValue)
+	return e, nil
+}
@@ -0,0 +1,93 @@
+package mtp
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// fakeProp is an integer property of propDevice. values is the enumeration
+// form, which is omitted if empty.
+type fakeProp struct {
+	dataType DataTypeSelector
+	settable bool
+	values   []uint64
+	current  uint64
+}
+
+// propDevice serves the integer properties in its table.
+type propDevice struct {
+	Device
+	props map[uint16]*fakeProp
+}
+
+// value converts v into the Go type of the data type.
+func (p *fakeProp) value(v uint64) DataDependentType {
+	val, _ := newPropValue(p.dataType)
+	f := val.Elem().Field(0)
+	f.Set(reflect.ValueOf(v).Convert(f.Type()))
+	return f.Interface()
+}
+
+func (d *propDevice) GetDevicePropDescContext(ctx context.Context, code uint16, desc *DevicePropDesc) error {
+	p, ok := d.props[code]
+	if !ok {
+		return RCError(RC_DevicePropNotSupported)
+	}
+	desc.DevicePropertyCode = code
+	desc.DataType = p.dataType
+	desc.CurrentValue = p.value(p.current)
+	if p.settable {
+		desc.GetSet = DPGS_GetSet
+	}
+	if len(p.values) > 0 {
+		form := &PropDescEnumForm{}
+		for _, v := range p.values {
+			form.Values = append(form.Values, p.value(v))
+		}
+		desc.FormFlag = DPFF_Enumeration
+		desc.Form = form
+	}
+	return nil
+}
+
+func (d *propDevice) GetDevicePropValueContext(ctx context.Context, code uint32, dest interface{}) error {
+	p, ok := d.props[uint16(code)]
+	if !ok {
+		return RCError(RC_DevicePropNotSupported)
+	}
+	f := reflect.ValueOf(dest).Elem().Field(0)
+	f.Set(reflect.ValueOf(p.current).Convert(f.Type()))
+	return nil
+}
+
+func (d *propDevice) SetDevicePropValueContext(ctx context.Context, code uint32, src interface{}) error {
+	p, ok := d.props[uint16(code)]
+	if !ok {
+		return RCError(RC_DevicePropNotSupported)
+	}
+	p.current, _ = propUint(reflect.ValueOf(src).Elem().Field(0).Interface())
+	return nil
+}
+
+func TestPropAccessorEnum(t *testing.T) {
+	dev := &propDevice{props: map[uint16]*fakeProp{
+		DPC_WhiteBalance: {dataType: DTC_UINT16, settable: true, values: []uint64{2, 4, 0x8010}, current: 4},
+		DPC_BatteryLevel: {dataType: DTC_UINT8, current: 80},
+	}}
+	pa := newPropAccessor(dev)
+	ctx := context.Background()
+
+	e, err := pa.enum(ctx, DPC_WhiteBalance)
+	if err != nil || !reflect.DeepEqual(e.values, []uint64{2, 4, 0x8010}) || e.current != 4 || !e.settable {
+		t.Errorf("got %+v, %v", e, err)
+	}
+	if _, err = pa.enum(ctx, DPC_BatteryLevel); err == nil {
+		t.Error("a property without an enumeration form should be rejected")
+	}
+	_, err = pa.enum(ctx, DPC_FNumber)
+	if !errors.Is(err, RCError(RC_DevicePropNotSupported)) {
+		t.Errorf("the return code should be wrapped, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+package mtp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// Versions of the /control protocol. Version 1 is the ControlPayload and
+// InfoPayload as they are, kept for the existing clients.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+)
+
+// Clients ask for a version with the WebSocket subprotocol, e.g.
+// mtplvcap.v2. Without one the version 1 is used.
+const protocolPrefix = "mtplvcap.v"
+
+// ControlSchemaPath is where the JSON Schema of the protocol v2 is served.
+const ControlSchemaPath = "/api/schema/control.json"
+
+// Types of the envelopes of the protocol v2.
+const (
+	MessageHello  = "hello"
+	MessageSet    = "set"
+	MessageAction = "action"
+	MessageReply  = "reply"
+	MessageEvent  = "event"
+)
+
+// EventState carries the state of the camera once a second.
+const EventState = "state"
+
+// setProps and actions are the controls of ControlPayload the protocol v2
+// accepts by their JSON names, as "set" and "action" respectively.
+var (
+	setProps = map[string]bool{
+		"iso":         true,
+		"fn":          true,
+		"af_mode":     true,
+		"af_area":     true,
+		"program":     true,
+		"metering":    true,
+		"af_interval": true,
+		"lr_fps":      true,
+		"preset":      true,
+	}
+	actions = map[string]bool{
+		"af_focus_now":   true,
+		"save_preset":    true,
+		"stack":          true,
+		"stack_cancel":   true,
+		"bracket":        true,
+		"bracket_cancel": true,
+	}
+)
+
+// Message is an envelope of the protocol v2 sent by clients.
+type Message struct {
+	Type string `json:"type"`
+	// ID is echoed in the reply. Messages without an ID are not replied.
+	ID string `json:"id,omitempty"`
+
+	// Prop and Value of "set".
+	Prop  string          `json:"prop,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// Action and Params of "action". Params is omitted for the actions
+	// without parameters.
+	Action string          `json:"action,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// HelloMessage is sent first on a connection of the protocol v2.
+type HelloMessage struct {
+	Type     string `json:"type"`
+	Version  int    `json:"version"`
+	Versions []int  `json:"versions"`
+	Schema   string `json:"schema"`
+}
+
+// EventMessage notifies clients of the protocol v2.
+type EventMessage struct {
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data"`
+}
+
+// StateData is InfoPayload without the frame, which is available from
+// /stream, /mjpeg and /snapshot instead.
+type StateData struct {
+	InfoPayload
+	// Frame hides InfoPayload.Frame.
+	Frame []byte `json:"frame,omitempty"`
+}
+
+func newHelloMessage(version int) HelloMessage {
+	return HelloMessage{
+		Type:     MessageHello,
+		Version:  version,
+		Versions: []int{ProtocolV1, ProtocolV2},
+		Schema:   ControlSchemaPath,
+	}
+}
+
+// negotiateProtocol returns the first version the client offers that the
+// server speaks, and the header to accept it.
+func negotiateProtocol(r *http.Request) (int, http.Header) {
+	for _, p := range websocket.Subprotocols(r) {
+		if !strings.HasPrefix(p, protocolPrefix) {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimPrefix(p, protocolPrefix))
+		if err == nil && v >= ProtocolV1 && v <= ProtocolV2 {
+			return v, http.Header{"Sec-Websocket-Protocol": {p}}
+		}
+	}
+	return ProtocolV1, nil
+}
+
+// parseMessage converts a message of the protocol v2 into ControlPayload.
+// It also returns the name of the control to reply with.
+func parseMessage(msg []byte) (ControlPayload, string, error) {
+	var m Message
+	err := json.Unmarshal(msg, &m)
+	if err != nil {
+		return ControlPayload{}, "", fmt.Errorf("failed to parse a message: %s", err)
+	}
+	p := ControlPayload{ID: m.ID}
+
+	var control string
+	var value json.RawMessage
+	switch m.Type {
+	case MessageSet:
+		control, value = m.Prop, m.Value
+		if !setProps[control] {
+			return p, control, fmt.Errorf("unknown prop %q", control)
+		}
+		if len(value) == 0 {
+			return p, control, fmt.Errorf("no value of %s", control)
+		}
+	case MessageAction:
+		control, value = m.Action, m.Params
+		if !actions[control] {
+			return p, control, fmt.Errorf("unknown action %q", control)
+		}
+		if len(value) == 0 {
+			value = json.RawMessage("true")
+		}
+	default:
+		return p, "", fmt.Errorf("unknown message type %q", m.Type)
+	}
+
+	j, err := json.Marshal(map[string]json.RawMessage{control: value})
+	if err == nil {
+		err = json.Unmarshal(j, &p)
+	}
+	if err != nil {
+		return p, control, fmt.Errorf("invalid value of %s: %s", control, err)
+	}
+	return p, control, nil
+}
@@ -0,0 +1,194 @@
+package mtp
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseMessage(t *testing.T) {
+	iso, fn := 400, "5.6"
+	yes := true
+	for _, tc := range []struct {
+		msg      string
+		expected ControlPayload
+		control  string
+		err      bool
+	}{
+		{`{"type": "set", "id": "1", "prop": "iso", "value": 400}`, ControlPayload{ID: "1", ISO: &iso}, "iso", false},
+		{`{"type": "set", "prop": "fn", "value": "5.6"}`, ControlPayload{FN: &fn}, "fn", false},
+		{`{"type": "action", "id": "2", "action": "stack_cancel"}`, ControlPayload{ID: "2", StackCancel: &yes}, "stack_cancel", false},
+		{`{"type": "action", "action": "stack", "params": {"near": -100, "far": 100, "steps": 5}}`, ControlPayload{Stack: &StackRequest{Near: -100, Far: 100, Steps: 5}}, "stack", false},
+		{`{"type": "set", "id": "3", "prop": "stack", "value": {}}`, ControlPayload{ID: "3"}, "stack", true},
+		{`{"type": "set", "prop": "iso"}`, ControlPayload{}, "iso", true},
+		{`{"type": "set", "prop": "iso", "value": "high"}`, ControlPayload{}, "iso", true},
+		{`{"type": "action", "action": "format"}`, ControlPayload{}, "format", true},
+		{`{"type": "event", "event": "state"}`, ControlPayload{}, "", true},
+		{`{"iso": 400}`, ControlPayload{}, "", true},
+	} {
+		p, control, err := parseMessage([]byte(tc.msg))
+		if (err != nil) != tc.err {
+			t.Errorf("%s: got error %v", tc.msg, err)
+		}
+		if control != tc.control {
+			t.Errorf("%s: got control %q, expected %q", tc.msg, control, tc.control)
+		}
+		if !tc.err && !reflect.DeepEqual(p, tc.expected) {
+			t.Errorf("%s: got %+v, expected %+v", tc.msg, p, tc.expected)
+		}
+		if p.ID != tc.expected.ID {
+			t.Errorf("%s: got ID %q, expected %q", tc.msg, p.ID, tc.expected.ID)
+		}
+	}
+}
+
+func TestNegotiateProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		offered  string
+		version  int
+		accepted string
+	}{
+		{"", ProtocolV1, ""},
+		{"mtplvcap.v2", ProtocolV2, "mtplvcap.v2"},
+		{"mtplvcap.v9, mtplvcap.v1", ProtocolV1, "mtplvcap.v1"},
+		{"graphql-ws", ProtocolV1, ""},
+	} {
+		r := httptest.NewRequest("GET", "/control", nil)
+		if tc.offered != "" {
+			r.Header.Set("Sec-Websocket-Protocol", tc.offered)
+		}
+		version, header := negotiateProtocol(r)
+		if version != tc.version || header.Get("Sec-Websocket-Protocol") != tc.accepted {
+			t.Errorf("%q: got %d, %q", tc.offered, version, header.Get("Sec-Websocket-Protocol"))
+		}
+	}
+}
+
+// TestControlSchema checks that the published schema and the code agree.
+func TestControlSchema(t *testing.T) {
+	b, err := ioutil.ReadFile("../public/schema/control.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type branch struct {
+		Properties map[string]struct {
+			Const interface{} `json:"const"`
+		} `json:"properties"`
+	}
+	var schema struct {
+		Definitions struct {
+			Set    struct{ OneOf []branch } `json:"set"`
+			Action struct{ OneOf []branch } `json:"action"`
+			State  struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			} `json:"state"`
+		} `json:"definitions"`
+	}
+	err = json.Unmarshal(b, &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	consts := func(branches []branch, key string) map[string]bool {
+		m := map[string]bool{}
+		for _, b := range branches {
+			c, _ := b.Properties[key].Const.(string)
+			m[c] = true
+		}
+		return m
+	}
+	if props := consts(schema.Definitions.Set.OneOf, "prop"); !reflect.DeepEqual(props, setProps) {
+		t.Errorf("props in the schema: %v, in the code: %v", props, setProps)
+	}
+	if a := consts(schema.Definitions.Action.OneOf, "action"); !reflect.DeepEqual(a, actions) {
+		t.Errorf("actions in the schema: %v, in the code: %v", a, actions)
+	}
+
+	typ := reflect.TypeOf(InfoPayload{})
+	fields := map[string]bool{}
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name != "frame" {
+			fields[name] = true
+		}
+	}
+	for name := range schema.Definitions.State.Properties {
+		if !fields[name] {
+			t.Errorf("%s in the schema is not in InfoPayload", name)
+		}
+		delete(fields, name)
+	}
+	for name := range fields {
+		t.Errorf("%s of InfoPayload is not in the schema", name)
+	}
+}
+
+func TestStateData(t *testing.T) {
+	j, err := json.Marshal(StateData{InfoPayload: InfoPayload{ISO: 400, Frame: []byte{0xFF, 0xD8}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	_ = json.Unmarshal(j, &m)
+	if _, ok := m["frame"]; ok || m["iso"] != float64(400) {
+		t.Errorf("got %s", j)
+	}
+}
+
+func TestControlV2(t *testing.T) {
+	s := NewLVServer(context.Background(), nil, false, nil, "", func(r *http.Request) bool { return true })
+	s.info.ReadOnly = []string{controlFN}
+
+	srv := httptest.NewServer(http.HandlerFunc(s.HandleControl))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"mtplvcap.v2"}}
+	ws, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var hello HelloMessage
+	err = ws.ReadJSON(&hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ws.Subprotocol() != "mtplvcap.v2" || hello.Type != MessageHello || hello.Version != ProtocolV2 || hello.Schema != ControlSchemaPath {
+		t.Errorf("got %s, %+v", ws.Subprotocol(), hello)
+	}
+
+	for _, tc := range []struct {
+		msg      string
+		expected ControlReply
+	}{
+		{`{"type": "set", "id": "1", "prop": "iso", "value": 400}`, ControlReply{Type: MessageReply, ID: "1", Control: "iso", OK: true}},
+		{`{"type": "set", "id": "2", "prop": "fn", "value": "5.6"}`, ControlReply{Type: MessageReply, ID: "2", Control: "fn", Error: "f-number is read-only in the exposure program"}},
+		{`{"type": "set", "id": "3", "prop": "shutter", "value": "1/60"}`, ControlReply{Type: MessageReply, ID: "3", Control: "shutter", Error: `unknown prop "shutter"`}},
+		{`{"type": "action", "id": "4", "action": "bracket_cancel"}`, ControlReply{Type: MessageReply, ID: "4", Control: "bracket_cancel", OK: true}},
+	} {
+		err = ws.WriteMessage(websocket.TextMessage, []byte(tc.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r ControlReply
+		err = ws.ReadJSON(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != tc.expected {
+			t.Errorf("%s: got %+v, expected %+v", tc.msg, r, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package mtp
+
+import (
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// ControlReply is sent back on /control for each control of a message with an
+// ID, once the camera accepts or refuses it.
+type ControlReply struct {
+	// Type is "reply" in the protocol v2 and omitted in v1.
+	Type    string `json:"type,omitempty"`
+	ID      string `json:"id"`
+	Control string `json:"control"`
+	OK      bool   `json:"ok"`
+	Error   string `json:"error,omitempty"`
+	// Code is the name of the PTP return code, e.g. DeviceBusy, if the
+	// camera refused the change.
+	Code string `json:"code,omitempty"`
+	// Superseded tells that the value was not written as a newer one of the
+	// same control came before the camera was free.
+	Superseded bool `json:"superseded,omitempty"`
+}
+
+// rcName returns the name of the return code err wraps, if any.
+func rcName(err error) string {
+	var rc RCError
+	if errors.As(err, &rc) {
+		return getName(RC_names, int(rc))
+	}
+	return ""
+}
+
+// reply sends the result of a control to the client. Messages without an ID
+// are not replied, so that older clients only receive InfoPayload.
+func (s *LVServer) reply(c *websocket.Conn, id, control string, err error) {
+	if id == "" {
+		return
+	}
+
+	r := ControlReply{ID: id, Control: control, OK: err == nil}
+	if err != nil {
+		r.Error, r.Code = err.Error(), rcName(err)
+		r.Superseded = errors.Is(err, errSuperseded)
+	}
+
+	// Replies share the connection with workerBroadcastInfo.
+	s.controlLock.Lock()
+	defer s.controlLock.Unlock()
+	version, ok := s.controlClients[c]
+	if !ok {
+		return
+	}
+	if version != ProtocolV1 {
+		r.Type = MessageReply
+	}
+	err = c.WriteJSON(r)
+	if err != nil {
+		log.LV.Errorf("HandleControl: failed to send a reply: %s", err)
+	}
+}
@@ -0,0 +1,77 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// refusingDriver is a camera which is busy whenever ISO is changed.
+type refusingDriver struct {
+	Driver
+}
+
+func (d refusingDriver) SetISO(ctx context.Context, iso int) error {
+	return fmt.Errorf("failed to set ISO: %w", RCError(RC_DeviceBusy))
+}
+
+func TestControlReply(t *testing.T) {
+	s := NewLVServer(context.Background(), &propDevice{}, false, nil, "", func(r *http.Request) bool { return true })
+	s.driver = refusingDriver{}
+	s.info.ReadOnly = []string{controlFN}
+
+	srv := httptest.NewServer(http.HandlerFunc(s.HandleControl))
+	defer srv.Close()
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	for _, tc := range []struct {
+		msg      string
+		expected ControlReply
+	}{
+		{`{"id": "1", "iso": 400}`, ControlReply{ID: "1", Control: "iso", Error: "failed to set ISO: DeviceBusy", Code: "DeviceBusy"}},
+		{`{"id": "2", "fn": "5.6"}`, ControlReply{ID: "2", Control: "fn", Error: "f-number is read-only in the exposure program"}},
+		{`{"id": "3", "lr_fps": 10}`, ControlReply{ID: "3", Control: "lr_fps", OK: true}},
+	} {
+		err = ws.WriteMessage(websocket.TextMessage, []byte(tc.msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var r ControlReply
+		_ = ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		err = ws.ReadJSON(&r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r != tc.expected {
+			t.Errorf("%s: got %+v, expected %+v", tc.msg, r, tc.expected)
+		}
+	}
+}
+
+func TestSuperseded(t *testing.T) {
+	s := NewLVServer(context.Background(), nil, false, nil, "", nil)
+	s.sched.Lock(PriorityFrame)
+
+	first := s.sched.Enqueue(PriorityUser, "iso")
+	second := s.sched.Enqueue(PriorityUser, "iso")
+	if err := s.setISO(first, 400); err != errSuperseded {
+		t.Errorf("got %v", err)
+	}
+
+	s.sched.Unlock()
+	if err := s.setISO(second, 800); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
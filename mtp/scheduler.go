@@ -0,0 +1,177 @@
+package mtp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errSuperseded is returned for a write dropped as a newer one with the same
+// key was queued.
+var errSuperseded = errors.New("superseded by a newer value")
+
+// Priority orders the requests waiting for the device.
+type Priority int
+
+const (
+	PriorityBackground Priority = iota // polling the device state
+	PriorityFrame                      // fetching live view frames
+	PriorityUser                       // commands sent by users
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBackground:
+		return "background"
+	case PriorityFrame:
+		return "frame"
+	case PriorityUser:
+		return "user"
+	}
+	return "unknown"
+}
+
+// QueueStats describes the requests of a priority.
+type QueueStats struct {
+	Depth     int     `json:"depth"`
+	MaxDepth  int     `json:"max_depth"`
+	Granted   uint64  `json:"granted"`
+	Coalesced uint64  `json:"coalesced"`
+	AvgWaitMs float64 `json:"avg_wait_ms"`
+
+	totalWait time.Duration
+}
+
+// Ticket is a queued request for the device.
+type Ticket struct {
+	prio   Priority
+	key    string
+	queued time.Time
+	ch     chan bool
+}
+
+// Wait blocks until the device is granted and returns true, or returns false
+// if a newer request with the same key superseded the ticket. The caller
+// must call Scheduler.Unlock only when Wait returned true.
+func (t *Ticket) Wait() bool {
+	return <-t.ch
+}
+
+// Scheduler serializes the access to the device like a mutex, but grants it
+// to the waiter with the highest priority first, in FIFO order within the
+// same priority. A waiter with a key is dropped when another one with the
+// same key is queued, so that a burst of writes to a property results in a
+// single write of the latest value.
+type Scheduler struct {
+	lock   sync.Mutex
+	busy   bool
+	queues [numPriorities][]*Ticket
+	keys   map[string]*Ticket
+	stats  [numPriorities]QueueStats
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		keys: map[string]*Ticket{},
+	}
+}
+
+// Lock blocks until the device is granted.
+func (sc *Scheduler) Lock(prio Priority) {
+	sc.Enqueue(prio, "").Wait()
+}
+
+// Enqueue queues a request without waiting for it. Requests are granted in
+// the order they are enqueued, so it allows waiting in another goroutine
+// without reordering them.
+func (sc *Scheduler) Enqueue(prio Priority, key string) *Ticket {
+	t := &Ticket{
+		prio:   prio,
+		key:    key,
+		queued: time.Now(),
+		ch:     make(chan bool, 1),
+	}
+
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	if key != "" {
+		if old, ok := sc.keys[key]; ok {
+			sc.remove(old)
+			sc.stats[old.prio].Coalesced++
+			old.ch <- false
+		}
+		sc.keys[key] = t
+	}
+
+	if !sc.busy {
+		sc.grant(t)
+		return t
+	}
+
+	sc.queues[prio] = append(sc.queues[prio], t)
+	st := &sc.stats[prio]
+	st.Depth++
+	if st.Depth > st.MaxDepth {
+		st.MaxDepth = st.Depth
+	}
+	return t
+}
+
+// Unlock passes the device to the next waiter.
+func (sc *Scheduler) Unlock() {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	for p := numPriorities - 1; p >= 0; p-- {
+		if q := sc.queues[p]; len(q) > 0 {
+			sc.queues[p] = q[1:]
+			sc.stats[p].Depth--
+			sc.grant(q[0])
+			return
+		}
+	}
+	sc.busy = false
+}
+
+// Stats returns the statistics of the queues by priority names.
+func (sc *Scheduler) Stats() map[string]QueueStats {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+
+	stats := map[string]QueueStats{}
+	for p, st := range sc.stats {
+		if st.Granted > 0 {
+			st.AvgWaitMs = float64(st.totalWait.Microseconds()) / float64(st.Granted) / 1000
+		}
+		stats[Priority(p).String()] = st
+	}
+	return stats
+}
+
+func (sc *Scheduler) grant(t *Ticket) {
+	// sc.lock must be locked by caller
+	sc.busy = true
+	if t.key != "" && sc.keys[t.key] == t {
+		delete(sc.keys, t.key)
+	}
+
+	st := &sc.stats[t.prio]
+	st.Granted++
+	st.totalWait += time.Since(t.queued)
+	t.ch <- true
+}
+
+func (sc *Scheduler) remove(t *Ticket) {
+	// sc.lock must be locked by caller
+	q := sc.queues[t.prio]
+	for i := range q {
+		if q[i] == t {
+			sc.queues[t.prio] = append(q[:i:i], q[i+1:]...)
+			sc.stats[t.prio].Depth--
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package mtp
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSchedulerPriority(t *testing.T) {
+	sc := NewScheduler()
+	sc.Lock(PriorityBackground)
+
+	var order []string
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range []struct {
+		name string
+		prio Priority
+	}{
+		{"background", PriorityBackground},
+		{"frame", PriorityFrame},
+		{"user 1", PriorityUser},
+		{"user 2", PriorityUser},
+	} {
+		name, ticket := c.name, sc.Enqueue(c.prio, "")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ticket.Wait() {
+				lock.Lock()
+				order = append(order, name)
+				lock.Unlock()
+				sc.Unlock()
+			}
+		}()
+	}
+
+	if depth := sc.Stats()["user"].Depth; depth != 2 {
+		t.Errorf("got user queue depth %d, want 2", depth)
+	}
+
+	sc.Unlock()
+	wg.Wait()
+
+	want := []string{"user 1", "user 2", "frame", "background"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("got order %v, want %v", order, want)
+	}
+}
+
+func TestSchedulerCoalesce(t *testing.T) {
+	sc := NewScheduler()
+	sc.Lock(PriorityFrame)
+
+	first := sc.Enqueue(PriorityUser, "iso")
+	second := sc.Enqueue(PriorityUser, "iso")
+	other := sc.Enqueue(PriorityUser, "fn")
+
+	if first.Wait() {
+		t.Error("the first ticket should be superseded")
+	}
+
+	sc.Unlock()
+	if !second.Wait() {
+		t.Fatal("the second ticket should be granted")
+	}
+	sc.Unlock()
+	if !other.Wait() {
+		t.Fatal("a ticket with another key should be granted")
+	}
+	sc.Unlock()
+
+	stats := sc.Stats()["user"]
+	if stats.Coalesced != 1 || stats.Granted != 2 || stats.Depth != 0 || stats.MaxDepth != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
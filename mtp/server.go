@@ -1,15 +1,12 @@
 package mtp
 
 import (
-	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
-	"fmt"
-	"io"
+	"errors"
 	"net/http"
-	"strconv"
+	"reflect"
 	"sync"
 	"time"
 
@@ -34,28 +31,42 @@ type LVServer struct {
 	upgrader       websocket.Upgrader
 	streamClients  map[*websocket.Conn]bool
 	streamLock     sync.Mutex
-	controlClients map[*websocket.Conn]bool
+	controlClients map[*websocket.Conn]int // to the protocol version
 	controlLock    sync.Mutex
 	motionClients  map[*MJPEGResponseWriter]bool
 	motionLock     sync.Mutex
 
-	model         Model
 	dev           Device
-	mtpLock       sync.Mutex
+	driver        Driver
+	caps          capabilities
+	sched         *Scheduler
 	dummy         bool
 	maxResolution bool
 
+	presets *PresetStore
+	preset  *atomic.String
+
 	afInterval *atomic.Int64
 	afTicker   *MutableTicker
 	afNowChan  chan bool
 
 	lrFPS *atomic.Int64
 
+	ingest *ingester
+	power  *powerMonitor
+	seq    *sequence
+	events *eventHub
+
+	stackDir   string
+	bracketDir string
+
 	eg  *errgroup.Group
 	ctx context.Context
 }
 
-func NewLVServer(ctx context.Context, dev Device, maxResolution bool) *LVServer {
+// NewLVServer creates an LVServer. checkOrigin decides whether a WebSocket
+// upgrade from another origin is accepted; nil accepts the same origin only.
+func NewLVServer(ctx context.Context, dev Device, maxResolution bool, presets *PresetStore, preset string, checkOrigin func(r *http.Request) bool) *LVServer {
 	eg, egCtx := errgroup.WithContext(ctx)
 
 	return &LVServer{
@@ -64,21 +75,30 @@ func NewLVServer(ctx context.Context, dev Device, maxResolution bool) *LVServer
 
 		fpsRate: ratecounter.NewRateCounter(time.Second),
 
+		upgrader:       websocket.Upgrader{CheckOrigin: checkOrigin},
 		streamClients:  map[*websocket.Conn]bool{},
-		controlClients: map[*websocket.Conn]bool{},
+		controlClients: map[*websocket.Conn]int{},
 		motionClients:  map[*MJPEGResponseWriter]bool{},
 
 		dev:   dev,
+		sched: NewScheduler(),
 		dummy: dev == nil,
 
 		maxResolution: maxResolution,
 
+		presets: presets,
+		preset:  atomic.NewString(preset),
+
 		afInterval: atomic.NewInt64(5),
 		afTicker:   NewMutableTicker(5 * time.Second),
 		afNowChan:  make(chan bool),
 
 		lrFPS: atomic.NewInt64(0),
 
+		power:  &powerMonitor{alerted: map[int]bool{}},
+		seq:    &sequence{},
+		events: newEventHub(),
+
 		eg:  eg,
 		ctx: egCtx,
 	}
@@ -118,33 +138,106 @@ func (s *LVServer) unregisterStreamClient(c *websocket.Conn) {
 }
 
 type ControlPayload struct {
+	// ID asks for a ControlReply of each control in the message.
+	ID string `json:"id,omitempty"`
+
 	AFInterval *int64  `json:"af_interval,omitempty"`
 	AFFocusNow *bool   `json:"af_focus_now,omitempty"`
 	LRFPS      *int64  `json:"lr_fps,omitempty"`
 	ISO        *int    `json:"iso,omitempty"`
 	FN         *string `json:"fn,omitempty"`
+	Preset     *string `json:"preset,omitempty"`
+	SavePreset *string `json:"save_preset,omitempty"`
+	AFMode     *string `json:"af_mode,omitempty"`
+	AFArea     *string `json:"af_area,omitempty"`
+	Program    *string `json:"program,omitempty"`
+	Metering   *string `json:"metering,omitempty"`
+
+	Stack       *StackRequest `json:"stack,omitempty"`
+	StackCancel *bool         `json:"stack_cancel,omitempty"`
+
+	Bracket       *BracketRequest `json:"bracket,omitempty"`
+	BracketCancel *bool           `json:"bracket_cancel,omitempty"`
 }
 
 type InfoPayload struct {
-	ISO    int      `json:"iso"`
-	ISOs   []int    `json:"isos"`
-	FN     string   `json:"fn"`
-	FNs    []string `json:"fns"`
-	AF     int64    `json:"af"`
-	LR     int64    `json:"lr"`
-	Width  int      `json:"width"`
-	Height int      `json:"height"`
-	FPS    int      `json:"fps"`
-	Frame  []byte   `json:"frame"`
+	ISO     int                   `json:"iso"`
+	ISOs    []int                 `json:"isos"`
+	FN      string                `json:"fn"`
+	FNs     []string              `json:"fns"`
+	AFMode  string                `json:"af_mode"`
+	AFModes []string              `json:"af_modes"`
+	AFArea  string                `json:"af_area"`
+	AFAreas []string              `json:"af_areas"`
+	AF      int64                 `json:"af"`
+	LR      int64                 `json:"lr"`
+	Width   int                   `json:"width"`
+	Height  int                   `json:"height"`
+	FPS     int                   `json:"fps"`
+	Preset  string                `json:"preset"`
+	Presets []string              `json:"presets"`
+	Queue   map[string]QueueStats `json:"queue"`
+	Upload  *UploadProgress       `json:"upload,omitempty"`
+	Power   *PowerStatus          `json:"power,omitempty"`
+	LV      LiveViewState         `json:"live_view"`
+	Stack   *StackProgress        `json:"stack,omitempty"`
+	Bracket *BracketProgress      `json:"bracket,omitempty"`
+	Frame   []byte                `json:"frame"`
+
+	Program   string   `json:"program"`
+	Programs  []string `json:"programs"`
+	Metering  string   `json:"metering"`
+	Meterings []string `json:"meterings"`
+	// ReadOnly are the controls the exposure program or the camera doesn't
+	// allow to change, e.g. fn in S.
+	ReadOnly []string `json:"read_only"`
 }
 
 func (s *LVServer) HandleControl(w http.ResponseWriter, r *http.Request) {
-	ws, err := s.upgrader.Upgrade(w, r, nil)
+	version, header := negotiateProtocol(r)
+	ws, err := s.upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.LV.Errorf("HandleControl: failed to upgrade: %s", err)
+		return
 	}
 	defer ws.Close()
 
+	if version != ProtocolV1 {
+		err = ws.WriteJSON(newHelloMessage(version))
+		if err != nil {
+			log.LV.Errorf("HandleControl: failed to send hello: %s", err)
+			return
+		}
+	}
+
+	s.registerControlClient(ws, version)
+	for {
+		var p ControlPayload
+		_, msg, err := ws.ReadMessage()
+		if err == nil && version == ProtocolV1 {
+			err = json.Unmarshal(msg, &p)
+		}
+		if err != nil {
+			log.LV.Errorf("HandleControl: failed to read a message: %s", err)
+			s.unregisterControlClient(ws)
+			return
+		}
+
+		if version != ProtocolV1 {
+			var control string
+			p, control, err = parseMessage(msg)
+			if err != nil {
+				log.LV.Errorf("HandleControl: invalid message: %s", err)
+				s.reply(ws, p.ID, control, err)
+				continue
+			}
+		}
+		s.control(ws, p)
+	}
+}
+
+// control applies the controls of a message.
+func (s *LVServer) control(ws *websocket.Conn, p ControlPayload) {
 	setInfo := func(af *int64, lr *int64) {
 		s.infoLock.Lock()
 		defer s.infoLock.Unlock()
@@ -156,76 +249,219 @@ func (s *LVServer) HandleControl(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	s.registerControlClient(ws)
-	for {
-		var p ControlPayload
-		err := ws.ReadJSON(&p)
-		if err != nil {
-			log.LV.Errorf("HandleControl: failed to read a message: %s", err)
-			s.unregisterControlClient(ws)
+	var err error
+
+	if p.AFInterval != nil {
+		setInfo(p.AFInterval, nil)
+		s.reply(ws, p.ID, "af_interval", nil)
+
+		if *p.AFInterval > 0 {
+			log.LV.Debug("HandleControl: enable AF")
+			s.afTicker.Start()
+		} else {
+			log.LV.Debug("HandleControl: disable AF")
+			s.afTicker.Stop()
 			return
 		}
 
-		if p.AFInterval != nil {
-			setInfo(p.AFInterval, nil)
+		s.afInterval.Store(*p.AFInterval)
+		s.afTicker.SetInterval(time.Duration(*p.AFInterval) * time.Second)
+		if err != nil {
+			log.LV.Debugf("HandleControl: failed to set interval: %d", *p.AFInterval)
+		}
+		log.LV.Debugf("HandleControl: set AF interval: %d", *p.AFInterval)
+	}
 
-			if *p.AFInterval > 0 {
-				log.LV.Debug("HandleControl: enable AF")
-				s.afTicker.Start()
-			} else {
-				log.LV.Debug("HandleControl: disable AF")
-				s.afTicker.Stop()
-				continue
-			}
+	if p.AFFocusNow != nil && *p.AFFocusNow {
+		log.LV.Debug("HandleControl: focus now")
+		select {
+		case s.afNowChan <- true:
+		default:
+		}
+		s.reply(ws, p.ID, "af_focus_now", nil)
+	}
 
-			s.afInterval.Store(*p.AFInterval)
-			s.afTicker.SetInterval(time.Duration(*p.AFInterval) * time.Second)
-			if err != nil {
-				log.LV.Debugf("HandleControl: failed to set interval: %d", *p.AFInterval)
+	if p.LRFPS != nil {
+		setInfo(nil, p.LRFPS)
+		if *p.LRFPS > 0 {
+			log.LV.Debugf("HandleControl: set rate limit: %d", *p.LRFPS)
+		} else {
+			log.LV.Debug("HandleControl: disable rate limit")
+		}
+		s.lrFPS.Store(*p.LRFPS)
+		s.reply(ws, p.ID, "lr_fps", nil)
+	}
+
+	// Property writes are queued in the order of messages and waited in
+	// the background, so that the scheduler can coalesce a burst of them.
+	if p.ISO != nil && s.readOnly(controlISO) {
+		log.LV.Error("HandleControl: ISO is read-only in the exposure program")
+		s.reply(ws, p.ID, "iso", errors.New("ISO is read-only in the exposure program"))
+	} else if p.ISO != nil {
+		log.LV.Debugf("HandleControl: set ISO: %d", *p.ISO)
+		iso, t := *p.ISO, s.sched.Enqueue(PriorityUser, "iso")
+		go func(id string) {
+			err := s.setISO(t, iso)
+			if err != nil && err != errSuperseded {
+				log.LV.Errorf("HandleControl: failed to set ISO: %s", err)
 			}
-			log.LV.Debugf("HandleControl: set AF interval: %d", *p.AFInterval)
+			s.reply(ws, id, "iso", err)
+		}(p.ID)
+	}
+
+	if p.FN != nil && s.readOnly(controlFN) {
+		log.LV.Error("HandleControl: f-number is read-only in the exposure program")
+		s.reply(ws, p.ID, "fn", errors.New("f-number is read-only in the exposure program"))
+	} else if p.FN != nil {
+		log.LV.Debugf("HandleControl: set f-number: %s", *p.FN)
+		fn, t := *p.FN, s.sched.Enqueue(PriorityUser, "fn")
+		go func(id string) {
+			err := s.setFN(t, fn)
+			if err != nil && err != errSuperseded {
+				log.LV.Errorf("HandleControl: failed to set f-number: %s", err)
+			}
+			s.reply(ws, id, "fn", err)
+		}(p.ID)
+	}
+
+	if p.AFMode != nil {
+		if prop, ok := s.afModeProp(); ok || s.dummy {
+			log.LV.Debugf("HandleControl: set AF mode: %s", *p.AFMode)
+			mode, t := *p.AFMode, s.sched.Enqueue(PriorityUser, "af_mode")
+			go func(id string) {
+				err := s.setNamedProp(t, prop, mode)
+				if err != nil && err != errSuperseded {
+					log.LV.Errorf("HandleControl: failed to set AF mode: %s", err)
+				}
+				s.refreshAF(PriorityUser)
+				s.reply(ws, id, "af_mode", err)
+			}(p.ID)
+		} else {
+			log.LV.Error("HandleControl: the camera doesn't support changing the AF mode")
+			s.reply(ws, p.ID, "af_mode", errors.New("the camera doesn't support changing the AF mode"))
+		}
+	}
+
+	if p.AFArea != nil {
+		if prop, ok := s.afAreaProp(); ok || s.dummy {
+			log.LV.Debugf("HandleControl: set AF area: %s", *p.AFArea)
+			area, t := *p.AFArea, s.sched.Enqueue(PriorityUser, "af_area")
+			go func(id string) {
+				err := s.setNamedProp(t, prop, area)
+				if err != nil && err != errSuperseded {
+					log.LV.Errorf("HandleControl: failed to set AF area: %s", err)
+				}
+				s.refreshAF(PriorityUser)
+				s.reply(ws, id, "af_area", err)
+			}(p.ID)
+		} else {
+			log.LV.Error("HandleControl: the camera doesn't support changing the AF area")
+			s.reply(ws, p.ID, "af_area", errors.New("the camera doesn't support changing the AF area"))
+		}
+	}
+
+	if p.Program != nil && s.readOnly(controlProgram) {
+		log.LV.Error("HandleControl: the exposure program is set by the mode dial")
+		s.reply(ws, p.ID, "program", errors.New("the exposure program is set by the mode dial"))
+	} else if p.Program != nil {
+		if prop, ok := s.programProp(); ok || s.dummy {
+			log.LV.Debugf("HandleControl: set exposure program: %s", *p.Program)
+			program, t := *p.Program, s.sched.Enqueue(PriorityUser, "program")
+			go func(id string) {
+				err := s.setNamedProp(t, prop, program)
+				if err != nil && err != errSuperseded {
+					log.LV.Errorf("HandleControl: failed to set exposure program: %s", err)
+				}
+				s.refreshExposure(PriorityUser)
+				s.reply(ws, id, "program", err)
+			}(p.ID)
+		} else {
+			log.LV.Error("HandleControl: the camera doesn't support changing the exposure program")
+			s.reply(ws, p.ID, "program", errors.New("the camera doesn't support changing the exposure program"))
+		}
+	}
+
+	if p.Metering != nil && s.readOnly(controlMetering) {
+		log.LV.Error("HandleControl: the camera doesn't allow changing the metering mode")
+		s.reply(ws, p.ID, "metering", errors.New("the camera doesn't allow changing the metering mode"))
+	} else if p.Metering != nil {
+		if prop, ok := s.meteringProp(); ok || s.dummy {
+			log.LV.Debugf("HandleControl: set metering mode: %s", *p.Metering)
+			metering, t := *p.Metering, s.sched.Enqueue(PriorityUser, "metering")
+			go func(id string) {
+				err := s.setNamedProp(t, prop, metering)
+				if err != nil && err != errSuperseded {
+					log.LV.Errorf("HandleControl: failed to set metering mode: %s", err)
+				}
+				s.refreshExposure(PriorityUser)
+				s.reply(ws, id, "metering", err)
+			}(p.ID)
+		} else {
+			log.LV.Error("HandleControl: the camera doesn't support changing the metering mode")
+			s.reply(ws, p.ID, "metering", errors.New("the camera doesn't support changing the metering mode"))
 		}
+	}
 
-		if p.AFFocusNow != nil && *p.AFFocusNow {
-			log.LV.Debug("HandleControl: focus now")
-			select {
-			case s.afNowChan <- true:
-			default:
-			}
+	if p.Preset != nil {
+		log.LV.Debugf("HandleControl: apply preset: %s", *p.Preset)
+		err = s.applyPreset(*p.Preset, presetAll)
+		if err != nil {
+			log.LV.Errorf("HandleControl: failed to apply preset: %s", err)
+		} else {
+			s.preset.Store(*p.Preset)
 		}
+		s.reply(ws, p.ID, "preset", err)
+	}
 
-		if p.LRFPS != nil {
-			setInfo(nil, p.LRFPS)
-			if *p.LRFPS > 0 {
-				log.LV.Debugf("HandleControl: set rate limit: %d", *p.LRFPS)
-			} else {
-				log.LV.Debug("HandleControl: disable rate limit")
-			}
-			s.lrFPS.Store(*p.LRFPS)
+	if p.SavePreset != nil {
+		log.LV.Debugf("HandleControl: save preset: %s", *p.SavePreset)
+		preset, err := s.capturePreset()
+		if err == nil {
+			err = s.presets.Put(*p.SavePreset, preset)
 		}
+		if err != nil {
+			log.LV.Errorf("HandleControl: failed to save preset: %s", err)
+		} else {
+			s.preset.Store(*p.SavePreset)
+		}
+		s.reply(ws, p.ID, "save_preset", err)
+	}
 
-		if p.ISO != nil {
-			log.LV.Debugf("HandleControl: set ISO: %d", *p.ISO)
-			err = s.setISO(*p.ISO)
-			if err != nil {
-				log.LV.Errorf("HandleControl: failed to set ISO: %s", err)
-			}
+	if p.Stack != nil {
+		log.LV.Debugf("HandleControl: start focus stack: %+v", *p.Stack)
+		err = s.startStack(*p.Stack)
+		if err != nil {
+			log.LV.Errorf("HandleControl: failed to start focus stack: %s", err)
 		}
+		s.reply(ws, p.ID, "stack", err)
+	}
 
-		if p.FN != nil {
-			log.LV.Debugf("HandleControl: set f-number: %s", *p.FN)
-			err = s.setFN(*p.FN)
-			if err != nil {
-				log.LV.Errorf("HandleControl: failed to set f-number: %s", err)
-			}
+	if p.StackCancel != nil && *p.StackCancel {
+		log.LV.Debug("HandleControl: cancel focus stack")
+		s.seq.stop(seqStack)
+		s.reply(ws, p.ID, "stack_cancel", nil)
+	}
+
+	if p.Bracket != nil {
+		log.LV.Debugf("HandleControl: start bracket: %+v", *p.Bracket)
+		err = s.startBracket(*p.Bracket)
+		if err != nil {
+			log.LV.Errorf("HandleControl: failed to start bracket: %s", err)
 		}
+		s.reply(ws, p.ID, "bracket", err)
+	}
+
+	if p.BracketCancel != nil && *p.BracketCancel {
+		log.LV.Debug("HandleControl: cancel bracket")
+		s.seq.stop(seqBracket)
+		s.reply(ws, p.ID, "bracket_cancel", nil)
 	}
 }
 
-func (s *LVServer) registerControlClient(c *websocket.Conn) {
+func (s *LVServer) registerControlClient(c *websocket.Conn, version int) {
 	s.controlLock.Lock()
 	defer s.controlLock.Unlock()
-	s.controlClients[c] = true
+	s.controlClients[c] = version
 }
 
 func (s *LVServer) unregisterControlClient(c *websocket.Conn) {
@@ -270,49 +506,74 @@ func (s *LVServer) HandleSnapshot(w http.ResponseWriter, r *http.Request) {
 func (s *LVServer) Run() error {
 	defer func() {
 		_ = s.endLiveView()
+		s.events.publish(EventConnection, ConnectionEvent{State: "disconnected"})
 	}()
 
-	id, err := s.dev.ID()
-	if err != nil {
-		log.LV.Fatalf("failed to get device identity: %s", err)
-	}
+	if !s.dummy {
+		id, err := s.dev.ID()
+		if err != nil {
+			log.LV.Fatalf("failed to get device identity: %s", err)
+		}
 
-	log.LV.Debugf(
-		"manufacturer = %s, product = %s, serialnumber = %s",
-		id.Manufacturer,
-		id.Product,
-		id.SerialNumber,
-	)
+		log.LV.Debugf(
+			"manufacturer = %s, product = %s, serialnumber = %s",
+			id.Manufacturer,
+			id.Product,
+			id.SerialNumber,
+		)
 
-	model, ok := models.Match(id.Product)
-	if ok {
-		log.LV.Debugf("model matched: %s", model.Name)
-	} else {
-		log.LV.Debugf("model didn't match, falling back to the generic model %s", model.Name)
-		model = models.Generic()
+		info := DeviceInfo{}
+		err = s.dev.GetDeviceInfo(&info)
+		if err != nil {
+			log.LV.Warningf("failed to get device info: %s", err)
+		}
+
+		s.caps = newCapabilities(info)
+		if s.ingest != nil {
+			s.ingest.serial = id.SerialNumber
+		}
+		s.driver = NewDriver(s.dev, id, info, s.maxResolution)
+		log.LV.Infof("using the %s driver", s.driver.Name())
+		s.events.publish(EventConnection, ConnectionEvent{State: "connected", Driver: s.driver.Name()})
 	}
-	s.model = model
 
-	isos, _, err := s.getISOs()
+	isos, _, err := s.getISOs(PriorityBackground)
 	if err != nil {
 		log.LV.Warningf("failed to obtain ISO list: %s", err)
 		isos = []int{0}
 	}
 	s.info.ISOs = isos
 
-	fns, _, err := s.getFNs()
+	fns, _, err := s.getFNs(PriorityBackground)
 	if err != nil {
 		log.LV.Warningf("failed to obtain F-values: %s", err)
 		fns = []string{"0"}
 	}
 	s.info.FNs = fns
 
+	s.refreshAF(PriorityBackground)
+	s.refreshExposure(PriorityBackground)
+
 	s.eg.Go(s.workerLV)
 	s.eg.Go(s.workerAF)
 	time.Sleep(500 * time.Millisecond)
 	s.eg.Go(s.frameCaptorSakura)
 	s.eg.Go(s.workerBroadcastFrame)
 	s.eg.Go(s.workerBroadcastInfo)
+	if s.ingest != nil && !s.dummy {
+		s.eg.Go(s.workerIngest)
+	}
+	if _, ok := s.programProp(); ok {
+		s.eg.Go(s.workerExposure)
+	}
+	_, afMode := s.afModeProp()
+	_, afArea := s.afAreaProp()
+	if afMode || afArea {
+		s.eg.Go(s.workerAFMode)
+	}
+	if !s.dummy && s.caps.prop(DPC_BatteryLevel) {
+		s.eg.Go(s.workerPower)
+	}
 	return s.eg.Wait()
 }
 
@@ -328,35 +589,80 @@ func (s *LVServer) workerLV() error {
 		}
 
 		status, err := s.getLiveViewStatus()
-		if err != nil {
+		if s.ctx.Err() != nil {
+			return nil
+		} else if err != nil {
 			log.LV.Warningf("workerLV: %s", err)
 			continue
 		} else if status {
+			s.setLiveView(LiveViewState{Active: true})
 			continue
 		}
 
+		name := s.preset.Load()
+		if name != "" {
+			err = s.applyPreset(name, presetBeforeLiveView)
+			if err != nil {
+				log.LV.Warningf("workerLV: %s", err)
+			}
+		}
+
 		err = s.startLiveView()
-		if err != nil {
-			log.LV.Warningf("workerLV: %s", err)
+		if s.ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			s.diagnoseLiveView(err)
+			continue
+		}
+		s.setLiveView(LiveViewState{Active: true})
+		s.refreshAF(PriorityBackground)
+
+		if name != "" {
+			log.LV.Infof("workerLV: applying preset %s", name)
+			err = s.applyPreset(name, presetAfterLiveView)
+			if err != nil {
+				log.LV.Warningf("workerLV: %s", err)
+			}
 		}
 	}
 }
 
 func (s *LVServer) workerAF() error {
 	for {
+		prio := PriorityBackground
 		select {
 		case <-s.afTicker.C:
 			// Let's go!
 		case <-s.afNowChan:
 			// Do it now
+			prio = PriorityUser
 		case <-s.ctx.Done():
 			return nil
 		}
 
-		err := s.autoFocus()
+		if prio == PriorityBackground && s.continuousAF() {
+			log.LV.Debug("workerAF: skipping AF in continuous AF")
+			continue
+		}
+		if prio == PriorityBackground && s.seq.running() {
+			// AF would move the focus between the steps of a stack.
+			log.LV.Debug("workerAF: skipping AF during a capture sequence")
+			continue
+		}
+
+		err := s.autoFocus(prio)
 		if err != nil {
 			log.LV.Warningf("workerAF: %s", err)
 		}
+
+		ev := AFEvent{Trigger: "periodic", OK: err == nil}
+		if prio == PriorityUser {
+			ev.Trigger = "user"
+		}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		s.events.publish(EventAF, ev)
 	}
 }
 
@@ -399,7 +705,9 @@ func (s *LVServer) frameCaptorSakura() error {
 
 		lv, err := s.getLiveViewImg()
 		if err != nil {
-			if err.Error() == "failed to obtain an image: live view is not activated" {
+			if s.ctx.Err() != nil {
+				return nil
+			} else if err == errLiveViewInactive {
 				time.Sleep(time.Second)
 				continue
 			} else {
@@ -408,13 +716,13 @@ func (s *LVServer) frameCaptorSakura() error {
 				continue
 			}
 		}
-		_, currentISO, err := s.getISOs()
+		_, currentISO, err := s.getISOs(PriorityFrame)
 		if err != nil {
 			log.LV.Warningf("frameCaptor: failed to get current ISO: %s", err)
 			currentISO = 0
 		}
 
-		_, currentFN, err := s.getFNs()
+		_, currentFN, err := s.getFNs(PriorityFrame)
 		if err != nil {
 			log.LV.Warningf("frameCaptor: failed to get current f-number: %s", err)
 			currentFN = "0"
@@ -474,6 +782,7 @@ func (s *LVServer) workerBroadcastFrame() error {
 
 func (s *LVServer) workerBroadcastInfo() error {
 	tick := time.NewTicker(time.Second)
+	var prev *InfoPayload
 
 	broadcast := func() {
 		s.controlLock.Lock()
@@ -483,9 +792,25 @@ func (s *LVServer) workerBroadcastInfo() error {
 
 		s.info.Frame = s.copyFrame()
 		s.info.FPS = int(s.fpsRate.Rate())
+		s.info.Preset = s.preset.Load()
+		s.info.Presets = s.presets.Names()
+		s.info.Queue = s.sched.Stats()
+
+		if prev != nil {
+			for _, ev := range propertyChanges(prev, &s.info) {
+				s.events.publish(EventProperty, ev)
+			}
+		}
+		s.events.publish(EventState, StateData{InfoPayload: s.info})
+		info := s.info
+		prev = &info
 
-		for c := range s.controlClients {
-			j, err := json.Marshal(s.info)
+		for c, version := range s.controlClients {
+			var v interface{} = s.info
+			if version != ProtocolV1 {
+				v = EventMessage{Type: MessageEvent, Event: EventState, Data: StateData{InfoPayload: s.info}}
+			}
+			j, err := json.Marshal(v)
 			if err != nil {
 				log.LV.Errorf("workerBroadcastInfo: failed to marshal payload: %s", err)
 				continue
@@ -512,282 +837,111 @@ func (s *LVServer) workerBroadcastInfo() error {
 // Thread-safe MTP communication
 
 func (s *LVServer) startLiveView() error {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+	s.sched.Lock(PriorityBackground)
+	defer s.sched.Unlock()
 
-	err := s.dev.RunTransactionWithNoParams(OC_NIKON_DeviceReady)
-	if err != nil {
-		return fmt.Errorf("failed to start live view: the camera is not ready")
-	}
-
-	if s.model.QuirkSwitchMedia {
-		err = s.switchRecordMedia()
-		if err != nil {
-			return fmt.Errorf("failed to switch recording media: %s", err)
-		}
-	}
-
-	if s.maxResolution {
-		err = s.changeResolution()
-		if err != nil {
-			log.LV.Warningf("failed to change the image resolution (%s); if it affects capturing frames, consider disabling `-max-resolution`", err)
-		}
-	}
-
-	err = s.dev.RunTransactionWithNoParams(OC_NIKON_StartLiveView)
-	if err != nil {
-		if casted, ok := err.(RCError); ok && uint16(casted) == RC_NIKON_InvalidStatus {
-			log.LV.Error("failed to start live view (InvalidStatus). Investigating the reason...")
-			reason, err := s.readLiveViewProhibitCondition()
-			if err != nil {
-				return fmt.Errorf("failed to start live view and failed to investigate the reason: %s", err)
-			}
-			return fmt.Errorf("failed to start live view, reason: %s", reason)
-		}
-		return fmt.Errorf("failed to start live view: %s", err)
-	}
-	return nil
+	return s.driver.StartLiveView(s.ctx)
 }
 
-func (s *LVServer) switchRecordMedia() error {
-	desc := DevicePropDesc{}
-	err := s.dev.GetDevicePropDesc(DPC_NIKON_RecordingMedia, &desc)
-	if err != nil {
-		return fmt.Errorf("failed to get recording media: %s", err)
-	}
-
-	if currentMedia, ok := desc.CurrentValue.(int8); ok {
-		if currentMedia == int8(RecordingMediaCard) {
-			log.LV.Debug("current recording media: card")
-			log.LV.Debug("the recording media is the card. Switching it to the SDRAM.")
-			payload := struct {
-				Media RecordingMedia
-			}{
-				Media: RecordingMediaSDRAM,
-			}
-			err = s.dev.SetDevicePropValue(DPC_NIKON_RecordingMedia, &payload)
-			if err != nil {
-				return fmt.Errorf("failed to SetDevicePropValue: %s", err)
-			}
-		} else {
-			log.LV.Debug("current recording media: SDRAM")
-		}
-	} else {
-		log.LV.Warning("unexpected format of the RecordingMedia property")
-	}
-	return nil
+// LiveViewState tells whether live view is running, and why not if it isn't.
+type LiveViewState struct {
+	Active   bool             `json:"active"`
+	Error    string           `json:"error,omitempty"`
+	Prohibit []ProhibitReason `json:"prohibit,omitempty"`
 }
 
-func (s *LVServer) changeResolution() error {
-	log.LV.Infof("getting available resolutions")
-	desc := DevicePropDesc{}
-	err := s.dev.GetDevicePropDesc(DPC_NIKON_Resolution, &desc)
-	if err != nil {
-		return fmt.Errorf("failed to get recording media: %s", err)
-	}
+// prohibitReporter is implemented by drivers which tell why the camera
+// refuses to start live view.
+type prohibitReporter interface {
+	LiveViewProhibitReasons(ctx context.Context) ([]ProhibitReason, error)
+}
 
-	values, ok := desc.Form.(*PropDescEnumForm)
-	if !ok {
-		return fmt.Errorf("failed to assert returned value (DPC_NIKON_Resolution)")
-	}
+// setLiveView records the state of live view and reports whether it changed.
+func (s *LVServer) setLiveView(st LiveViewState) bool {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
 
-	var choices []uint64
-	for _, iface := range values.Values {
-		v, ok := iface.(uint64)
-		if !ok {
-			return fmt.Errorf("failed to assert a value in the array as uint64")
-		}
-		choices = append(choices, v)
+	if reflect.DeepEqual(s.info.LV, st) {
+		return false
 	}
+	s.info.LV = st
+	s.events.publish(EventLiveView, st)
+	return true
+}
 
-	log.LV.Infof("available resolutions (higher is larger): %v", choices)
-	log.LV.Infof("automatically use the largest choice: %d", choices[len(choices)-1])
-
-	switch s.model.ResolutionType {
-	case ResolutionType64:
-		payload := struct {
-			Resolution Resolution64
-		}{
-			Resolution: Resolution64(choices[len(choices)-1]),
-		}
+// diagnoseLiveView records why live view failed to start. The prohibit
+// condition is read again since it may change after the failure, or be hidden
+// behind errors other than InvalidStatus.
+func (s *LVServer) diagnoseLiveView(startErr error) {
+	st := LiveViewState{Error: startErr.Error()}
 
-		err = s.dev.SetDevicePropValue(DPC_NIKON_Resolution, &payload)
+	if r, ok := s.driver.(prohibitReporter); ok {
+		s.sched.Lock(PriorityBackground)
+		reasons, err := r.LiveViewProhibitReasons(s.ctx)
+		s.sched.Unlock()
 		if err != nil {
-			return fmt.Errorf("failed to SetDevicePropValue: %s", err)
-		}
-	case ResolutionType8:
-		payload := struct {
-			Resolution Resolution8
-		}{
-			Resolution: Resolution8(choices[len(choices)-1]),
+			log.LV.Debugf("workerLV: %s", err)
 		}
+		st.Prohibit = reasons
+	}
 
-		err = s.dev.SetDevicePropValue(DPC_NIKON_Resolution, &payload)
-		if err != nil {
-			return fmt.Errorf("failed to SetDevicePropValue: %s", err)
+	// Repeating the same failure every second tells nothing new.
+	if !s.setLiveView(st) {
+		return
+	}
+	log.LV.Warningf("workerLV: %s", startErr)
+	for _, r := range st.Prohibit {
+		if r.Hint != "" {
+			log.LV.Warningf("workerLV: live view is prohibited: %s, hint: %s", r.Reason, r.Hint)
+		} else {
+			log.LV.Warningf("workerLV: live view is prohibited: %s", r.Reason)
 		}
 	}
-
-	return nil
-}
-
-func (s *LVServer) readLiveViewProhibitCondition() (string, error) {
-	// mtpLock must be locked by caller
-	var reasonRaw Uint32Value
-	err := s.dev.GetDevicePropValue(DPC_NIKON_LiveViewProhibitCondition, &reasonRaw)
-	if err != nil {
-		return "", fmt.Errorf("failed to read LiveViewProhibitCondition: %s", err)
-	}
-
-	switch s.bitScan(reasonRaw.Value) {
-	case -1:
-		return "(empty)", nil
-	case 0:
-		return "recording destination is the card", nil
-	case 2:
-		return "sequence error", nil
-	case 4:
-		return "button is fully pressed", nil
-	case 5:
-		return "aperture value is set by the lens", nil
-	case 6:
-		return "bulb error", nil
-	case 7:
-		return "during cleaning", nil
-	case 8:
-		return "insufficient battery", nil
-	case 9:
-		return "TTL error", nil
-	case 11:
-		return "non-CPU lens is mounted and the mode is not M", nil
-	case 12:
-		return "there are images which are recorded in SDRAM", nil
-	case 13:
-		return "the release mode is mirror-up", nil
-	case 14:
-		return "no card inserted", nil
-	case 15:
-		return "shot command is being processed", nil
-	case 16:
-		return "shooting in progress", nil
-	case 17:
-		return "overheated", nil
-	case 18:
-		return "card is protected", nil
-	case 19:
-		return "card error", nil
-	case 20:
-		return "card is not formatted", nil
-	case 21:
-		return "bulb error", nil
-	case 22:
-		return "the release mode is mirror-up and it is being processed", nil
-	case 24:
-		return "the lens is not extended", nil
-	default:
-		return "unknown reason", nil
-	}
-
-}
-
-func (*LVServer) bitScan(val uint32) int {
-	for i := 0; i < 64; i++ {
-		if val&(1<<i) > 0 {
-			return i
-		}
-	}
-	return -1
 }
 
 func (s *LVServer) endLiveView() error {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+	s.sched.Lock(PriorityUser)
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return nil
 	}
 
-	err := s.dev.RunTransactionWithNoParams(OC_NIKON_EndLiveView)
-	if err != nil {
-		return fmt.Errorf("failed to end live view: %s", err)
-	}
-	return nil
+	// Run calls this after s.ctx is done, so don't abort it with s.ctx.
+	return s.driver.EndLiveView(context.Background())
 }
 
 func (s *LVServer) getLiveViewStatus() (bool, error) {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+	s.sched.Lock(PriorityBackground)
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return true, nil
 	}
 
-	err, status := s.getLiveViewStatusInner()
-	if err != nil {
-		return false, fmt.Errorf("failed to get live view status: %s", err)
-	}
-	return status, nil
-}
-
-func (s *LVServer) getLiveViewStatusInner() (error, bool) {
-	val := StringValue{}
-	err := s.dev.GetDevicePropValue(DPC_NIKON_LiveViewStatus, &val)
-
-	if err != nil && err != io.EOF {
-		return err, false
-	}
-
-	return nil, err == io.EOF
+	return s.driver.LiveViewStatus(s.ctx)
 }
 
-func (s *LVServer) autoFocus() error {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+func (s *LVServer) autoFocus(prio Priority) error {
+	s.sched.Lock(prio)
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return nil
 	}
 
-	err := s.dev.RunTransactionWithNoParams(OC_NIKON_AfDrive)
-	if err != nil {
-		return fmt.Errorf("failed to do auto focus: %s", err)
-	}
-	return nil
+	return s.driver.AutoFocus(s.ctx)
 }
 
 func (s *LVServer) getLiveViewImg() (LiveView, error) {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+	s.sched.Lock(PriorityFrame)
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return LiveView{}, nil
 	}
 
-	lv, err := s.getLiveViewImgInner()
-	if err != nil {
-		return LiveView{}, err
-	}
-	return lv, nil
-}
-
-type liveViewRaw struct {
-	LVWidth             int16
-	LVHeight            int16
-	Width               int16
-	Height              int16
-	Dummy1              [8]byte
-	FocusFrameWidth     int16
-	FocusFrameHeight    int16
-	FocusX              int16
-	FocusY              int16
-	Dummy2              [5]byte
-	Rotation            int8
-	Dummy3              [10]byte
-	AutoFocus           int8
-	Dummy4              [15]byte
-	MovieTimeRemainInt  int16
-	MovieTimeRemainFrac int16
-	Recording           int8
+	return s.driver.LiveViewImg(s.ctx)
 }
 
 type LiveView struct {
@@ -806,192 +960,56 @@ type LiveView struct {
 	JPEG []byte
 }
 
-func (s *LVServer) getLiveViewImgInner() (LiveView, error) {
-	var req, rep Container
-	buf := bytes.NewBuffer([]byte{})
-
-	hs := s.model.HeaderSize
-
-	req.Code = OC_NIKON_GetLiveViewImg
-	req.Param = []uint32{}
-	err := s.dev.RunTransaction(&req, &rep, buf, nil, 0)
-	if err != nil {
-		if casted, ok := err.(RCError); ok && uint16(casted) == RC_NIKON_NotLiveView {
-			return LiveView{}, fmt.Errorf("failed to obtain an image: live view is not activated")
-		}
-		return LiveView{}, fmt.Errorf("failed to obtain an image: %s", err)
-	} else if buf.Len() <= hs {
-		return LiveView{}, fmt.Errorf("failed to obtain an image: the data has insufficient length")
-	}
-
-	raw := buf.Bytes()
-
-	lvr := liveViewRaw{}
-	err = binary.Read(bytes.NewReader(raw[8:hs]), binary.BigEndian, &lvr)
-	if err != nil {
-		return LiveView{}, fmt.Errorf("failed to decode header")
-	}
-
-	rot := Rotation0
-	if lvr.Rotation == 1 {
-		rot = RotationMinus90
-	} else if lvr.Rotation == 2 {
-		rot = Rotation90
-	} else if lvr.Rotation == 3 {
-		rot = Rotation180
-	}
-
-	af := AFNotActive
-	if lvr.AutoFocus == 1 {
-		af = AFFail
-	} else if lvr.AutoFocus == 2 {
-		af = AFSuccess
-	}
-
-	return LiveView{
-		LVWidth:          lvr.LVWidth,
-		LVHeight:         lvr.LVHeight,
-		Width:            lvr.Width,
-		Height:           lvr.Height,
-		FocusFrameWidth:  lvr.FocusFrameWidth,
-		FocusFrameHeight: lvr.FocusFrameHeight,
-		FocusX:           lvr.FocusX,
-		FocusY:           lvr.FocusY,
-		Rotation:         rot,
-		AutoFocus:        af,
-		Recording:        lvr.Recording == 1,
-		JPEG:             raw[hs:],
-	}, nil
-}
-
-func (s *LVServer) getISOs() ([]int, int, error) {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+func (s *LVServer) getISOs(prio Priority) ([]int, int, error) {
+	s.sched.Lock(prio)
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return []int{100, 1000, 10000}, 100, nil
 	}
 
-	isoi := make([]int, 0)
-
-	val := DevicePropDesc{}
-	err := s.dev.GetDevicePropDesc(DPC_ExposureIndex, &val)
-
-	if err != nil && err != io.EOF {
-		return isoi, 0, err
-	}
-
-	asserted, ok := val.Form.(*PropDescEnumForm)
-	if !ok {
-		return isoi, 0, fmt.Errorf("unexpedted type: could not assert that returned prop is enum form")
-	}
-
-	for _, raw := range asserted.Values {
-		iso, ok := raw.(uint64)
-		if !ok {
-			return isoi, 0, fmt.Errorf("unexpedted type: could not assert that form value is uint64")
-		}
-		isoi = append(isoi, int(iso))
-	}
-
-	currentISO, ok := val.CurrentValue.(uint16)
-	if !ok {
-		return isoi, 0, fmt.Errorf("unexpedted type: could not assert that current value is uint16")
-	}
-
-	return isoi, int(currentISO), nil
+	return s.driver.ISOs(s.ctx)
 }
 
-func (s *LVServer) setISO(iso int) error {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+// setISO sets the ISO when t is granted. It returns errSuperseded if a newer
+// request superseded t.
+func (s *LVServer) setISO(t *Ticket, iso int) error {
+	if !t.Wait() {
+		log.LV.Debugf("setISO: ISO %d is superseded", iso)
+		return errSuperseded
+	}
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return nil
 	}
 
-	err := s.dev.SetDevicePropValue(DPC_ExposureIndex, &struct {
-		ISO uint16
-	}{
-		ISO: uint16(iso),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to set ISO: %s", err)
-	}
-	return nil
+	return s.driver.SetISO(s.ctx, iso)
 }
 
-func (s *LVServer) getFNs() ([]string, string, error) {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+func (s *LVServer) getFNs(prio Priority) ([]string, string, error) {
+	s.sched.Lock(prio)
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return []string{"3.5", "10", "22"}, "3.5", nil
 	}
 
-	fns := make([]string, 0)
-
-	val := DevicePropDesc{}
-	err := s.dev.GetDevicePropDesc(DPC_FNumber, &val)
-
-	if err != nil && err != io.EOF {
-		return fns, "", err
-	}
-
-	asserted, ok := val.Form.(*PropDescEnumForm)
-	if !ok {
-		return fns, "", fmt.Errorf("unexpedted type: could not assert that returned prop is enum form")
-	}
-
-	for _, raw := range asserted.Values {
-		fn, ok := raw.(uint64)
-		if !ok {
-			return fns, "", fmt.Errorf("unexpedted type: could not assert that form value is uint64")
-		}
-		fns = append(fns, strconv.FormatFloat(float64(fn)/100, 'f', -1, 64))
-	}
-
-	current, ok := val.CurrentValue.(uint16)
-	if !ok {
-		return fns, "", fmt.Errorf("unexpedted type: could not assert that current value is uint16")
-	}
-
-	return fns, strconv.FormatFloat(float64(current)/100, 'f', -1, 64), nil
+	return s.driver.FNs(s.ctx)
 }
 
-func (s *LVServer) setFN(fn string) error {
-	s.mtpLock.Lock()
-	defer s.mtpLock.Unlock()
+// setFN sets the f-number when t is granted. It returns errSuperseded if a
+// newer request superseded t.
+func (s *LVServer) setFN(t *Ticket, fn string) error {
+	if !t.Wait() {
+		log.LV.Debugf("setFN: f-number %s is superseded", fn)
+		return errSuperseded
+	}
+	defer s.sched.Unlock()
 
 	if s.dummy {
 		return nil
 	}
 
-	fnf, err := strconv.ParseFloat(fn, 64)
-	if err != nil {
-		return fmt.Errorf("failed to parse f-number: %s", err)
-	}
-
-	err = s.dev.RunTransactionWithNoParams(OC_NIKON_EndLiveView)
-	if err != nil {
-		return fmt.Errorf("failed to set f-number: failed to stop live view: %s", err)
-	}
-
-	err = s.dev.SetDevicePropValue(DPC_FNumber, &struct {
-		FN uint16
-	}{
-		FN: uint16(fnf * 100),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to set f-number: %s", err)
-	}
-
-	err = s.dev.RunTransactionWithNoParams(OC_NIKON_StartLiveView)
-	if err != nil {
-		if casted, ok := err.(RCError); ok && uint16(casted) == RC_NIKON_InvalidStatus {
-			return fmt.Errorf("failed to set f-number: failed to start live view: InvalidStatus (battery level is low?)")
-		}
-		return fmt.Errorf("failed to set f-number: start live view: %s", err)
-	}
-	return nil
+	return s.driver.SetFN(s.ctx, fn)
 }
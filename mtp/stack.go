@@ -0,0 +1,274 @@
+package mtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Directions of OC_NIKON_MfDrive.
+const (
+	mfDriveClosest  = 1
+	mfDriveInfinity = 2
+)
+
+const (
+	// mfDriveMax is the largest amount of a single OC_NIKON_MfDrive.
+	mfDriveMax = 32767
+	// defaultStackSettle is the time to wait after the lens stops.
+	defaultStackSettle = 300 * time.Millisecond
+)
+
+// Ways to capture each step of a focus stack.
+const (
+	StackCaptureStill    = "still"
+	StackCaptureLiveView = "liveview"
+)
+
+// StackRequest starts a focus stack. Near and Far are the focus positions in
+// MfDrive steps relative to the current one, negative toward the closest
+// distance. Steps frames are taken from Near toward Far in fixed increments.
+type StackRequest struct {
+	Near    int    `json:"near"`
+	Far     int    `json:"far"`
+	Steps   int    `json:"steps"`
+	Capture string `json:"capture,omitempty"`
+	// SettleMS is the time to wait after the lens stops, default 300ms.
+	SettleMS int `json:"settle_ms,omitempty"`
+}
+
+// StackFrame is a step of a focus stack.
+type StackFrame struct {
+	Index    int       `json:"index"`
+	Position int       `json:"position"`
+	Files    []string  `json:"files"`
+	Captured time.Time `json:"captured"`
+}
+
+// StackSet is saved as stack.json next to the frames.
+type StackSet struct {
+	Camera    string       `json:"camera"`
+	Request   StackRequest `json:"request"`
+	Increment int          `json:"increment"`
+	Started   time.Time    `json:"started"`
+	Finished  *time.Time   `json:"finished,omitempty"`
+	Frames    []StackFrame `json:"frames"`
+}
+
+// StackProgress is the progress of the running or the last focus stack.
+type StackProgress struct {
+	// State is one of running, done, failed and canceled.
+	State    string `json:"state"`
+	Step     int    `json:"step"`
+	Steps    int    `json:"steps"`
+	Position int    `json:"position"`
+	Dir      string `json:"dir,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SetStackDir sets the directory to save focus stacks into.
+func (s *LVServer) SetStackDir(dir string) {
+	s.stackDir = dir
+}
+
+// plan returns the focus position of each step.
+func (r *StackRequest) plan() ([]int, error) {
+	if r.Capture == "" {
+		r.Capture = StackCaptureStill
+	}
+	if r.Capture != StackCaptureStill && r.Capture != StackCaptureLiveView {
+		return nil, fmt.Errorf("unknown capture %q, must be %s or %s", r.Capture, StackCaptureStill, StackCaptureLiveView)
+	}
+	if r.Steps < 2 {
+		return nil, fmt.Errorf("at least 2 steps are required")
+	}
+	if r.Far <= r.Near {
+		return nil, fmt.Errorf("the far limit must be larger than the near limit")
+	}
+
+	inc := (r.Far - r.Near) / (r.Steps - 1)
+	if inc < 1 {
+		return nil, fmt.Errorf("%d steps don't fit between %d and %d", r.Steps, r.Near, r.Far)
+	}
+
+	positions := make([]int, r.Steps)
+	for i := range positions {
+		positions[i] = r.Near + i*inc
+	}
+	return positions, nil
+}
+
+// stackDriver returns the driver if the camera drives the focus manually.
+func (s *LVServer) stackDriver() (*nikonDriver, bool) {
+	n, ok := s.driver.(*nikonDriver)
+	return n, ok && s.caps.op(OC_NIKON_MfDrive)
+}
+
+// mfDrive moves the focus by steps, toward infinity if positive and toward
+// the closest distance if negative, and waits until the lens stops.
+func (n *nikonDriver) mfDrive(ctx context.Context, steps int) error {
+	for steps != 0 {
+		dir, amount := uint32(mfDriveInfinity), steps
+		if steps < 0 {
+			dir, amount = mfDriveClosest, -steps
+		}
+		if amount > mfDriveMax {
+			amount = mfDriveMax
+		}
+
+		var req, rep Container
+		req.Code = OC_NIKON_MfDrive
+		req.Param = []uint32{dir, uint32(amount)}
+		err := n.dev.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
+		if err == nil {
+			err = n.waitReady(ctx)
+		}
+		switch err {
+		case nil:
+		case RCError(RC_NIKON_MfDriveStepEnd):
+			return fmt.Errorf("the lens reached the end of the focus range")
+		case RCError(RC_NIKON_MfDriveStepInsufficiency):
+			return fmt.Errorf("the lens can't move by %d steps", amount)
+		default:
+			return fmt.Errorf("failed to drive the focus: %s", err)
+		}
+
+		if steps > 0 {
+			steps -= amount
+		} else {
+			steps += amount
+		}
+	}
+	return nil
+}
+
+func (s *LVServer) setStack(p StackProgress) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.info.Stack = &p
+}
+
+// startStack starts a focus stack in the background.
+func (s *LVServer) startStack(req StackRequest) error {
+	n, ok := s.stackDriver()
+	if !ok {
+		return errors.New("the camera doesn't support driving the focus")
+	}
+	positions, err := req.plan()
+	if err != nil {
+		return err
+	}
+	if req.Capture == StackCaptureStill && !s.caps.op(OC_NIKON_InitiateCaptureRecInMedia) {
+		return errors.New("the camera doesn't support capturing without AF, use the live view capture instead")
+	}
+
+	ctx, err := s.seq.begin(s.ctx, seqStack)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Join(s.stackDir, time.Now().Format("stack-20060102-150405"))
+	s.setStack(StackProgress{State: "running", Steps: req.Steps, Dir: dir})
+	go func() {
+		defer s.seq.end()
+		err := s.runStack(ctx, n, req, positions, dir)
+
+		s.infoLock.Lock()
+		p := *s.info.Stack
+		s.infoLock.Unlock()
+		if ctx.Err() != nil {
+			p.State = "canceled"
+		} else if err != nil {
+			p.State, p.Error = "failed", err.Error()
+			log.LV.Errorf("focus stack: %s", err)
+		} else {
+			p.State = "done"
+			log.LV.Infof("focus stack: saved %d frames to %s", req.Steps, dir)
+		}
+		s.setStack(p)
+	}()
+	return nil
+}
+
+func (s *LVServer) runStack(ctx context.Context, n *nikonDriver, req StackRequest, positions []int, dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	settle := defaultStackSettle
+	if req.SettleMS > 0 {
+		settle = time.Duration(req.SettleMS) * time.Millisecond
+	}
+
+	set := StackSet{
+		Camera:    n.Name(),
+		Request:   req,
+		Increment: positions[1] - positions[0],
+		Started:   time.Now(),
+		Frames:    []StackFrame{},
+	}
+
+	pos := 0
+	for i, target := range positions {
+		err = s.withDevice(PriorityUser, func() error {
+			return n.mfDrive(ctx, target-pos)
+		})
+		if err != nil {
+			return err
+		}
+		pos = target
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(settle):
+		}
+
+		frame := StackFrame{Index: i + 1, Position: pos, Captured: time.Now()}
+		if req.Capture == StackCaptureLiveView {
+			frame.Files, err = s.stackLiveView(ctx, n, dir, frame.Index)
+		} else {
+			frame.Files, err = s.captureStill(ctx, n, dir, fmt.Sprintf("%04d_", frame.Index))
+		}
+		if err != nil {
+			return err
+		}
+
+		// Keep the metadata of the frames taken so far in case of failures.
+		set.Frames = append(set.Frames, frame)
+		err = writeSetJSON(dir, "stack.json", set)
+		if err != nil {
+			return err
+		}
+		s.setStack(StackProgress{State: "running", Step: i + 1, Steps: len(positions), Position: pos, Dir: dir})
+	}
+
+	finished := time.Now()
+	set.Finished = &finished
+	return writeSetJSON(dir, "stack.json", set)
+}
+
+// stackLiveView saves a live view frame.
+func (s *LVServer) stackLiveView(ctx context.Context, n *nikonDriver, dir string, index int) ([]string, error) {
+	var lv LiveView
+	err := s.withDevice(PriorityUser, func() (err error) {
+		lv, err = n.LiveViewImg(ctx)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%04d.jpg", index)
+	err = ioutil.WriteFile(filepath.Join(dir, name), lv.JPEG, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.events.publish(EventCapture, CaptureEvent{Source: "liveview", Dir: dir, Files: []string{name}})
+	return []string{name}, nil
+}
@@ -0,0 +1,136 @@
+package mtp
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestStackPlan(t *testing.T) {
+	r := StackRequest{Near: -100, Far: 100, Steps: 5}
+	positions, err := r.plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{-100, -50, 0, 50, 100}; !reflect.DeepEqual(positions, expected) {
+		t.Errorf("got %v, expected %v", positions, expected)
+	}
+	if r.Capture != StackCaptureStill {
+		t.Errorf("got capture %q", r.Capture)
+	}
+
+	// The increment is fixed, so the last step may fall short of Far.
+	r = StackRequest{Near: 0, Far: 10, Steps: 4, Capture: StackCaptureLiveView}
+	positions, err = r.plan()
+	if expected := []int{0, 3, 6, 9}; err != nil || !reflect.DeepEqual(positions, expected) {
+		t.Errorf("got %v, %v, expected %v", positions, err, expected)
+	}
+
+	for _, r := range []StackRequest{
+		{Near: 0, Far: 10, Steps: 1},
+		{Near: 10, Far: 0, Steps: 3},
+		{Near: 0, Far: 2, Steps: 5},
+		{Near: 0, Far: 10, Steps: 3, Capture: "video"},
+	} {
+		if _, err := r.plan(); err == nil {
+			t.Errorf("%+v should be rejected", r)
+		}
+	}
+}
+
+// mfDriveDevice records MfDrive requests and is busy once after each.
+type mfDriveDevice struct {
+	Device
+	drives [][]uint32
+	busy   bool
+	end    bool
+}
+
+func (d *mfDriveDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	switch req.Code {
+	case OC_NIKON_MfDrive:
+		d.drives = append(d.drives, req.Param)
+		d.busy = true
+	case OC_NIKON_DeviceReady:
+		if d.busy {
+			d.busy = false
+			return RCError(RC_DeviceBusy)
+		}
+		if d.end {
+			return RCError(RC_NIKON_MfDriveStepEnd)
+		}
+	default:
+		return RCError(RC_OperationNotSupported)
+	}
+	return nil
+}
+
+func (d *mfDriveDevice) RunTransactionWithNoParamsContext(ctx context.Context, code uint16) error {
+	return d.RunTransactionContext(ctx, &Container{Code: code}, &Container{}, nil, nil, 0)
+}
+
+func TestMfDrive(t *testing.T) {
+	dev := &mfDriveDevice{}
+	n := &nikonDriver{dev: dev}
+
+	err := n.mfDrive(context.Background(), -40000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]uint32{{mfDriveClosest, mfDriveMax}, {mfDriveClosest, 40000 - mfDriveMax}}
+	if !reflect.DeepEqual(dev.drives, expected) {
+		t.Errorf("got %v, expected %v", dev.drives, expected)
+	}
+
+	dev.drives = nil
+	err = n.mfDrive(context.Background(), 0)
+	if err != nil || dev.drives != nil {
+		t.Errorf("driving 0 steps should do nothing: %v, %v", dev.drives, err)
+	}
+
+	dev.end = true
+	err = n.mfDrive(context.Background(), 100)
+	if err == nil || !reflect.DeepEqual(dev.drives, [][]uint32{{mfDriveInfinity, 100}}) {
+		t.Errorf("got %v, %v", dev.drives, err)
+	}
+}
+
+func TestSequence(t *testing.T) {
+	var q sequence
+	if q.running() {
+		t.Error("running before begin")
+	}
+
+	ctx, err := q.begin(context.Background(), seqStack)
+	if err != nil || !q.running() {
+		t.Fatalf("not running: %v", err)
+	}
+	if _, err = q.begin(context.Background(), seqBracket); err == nil {
+		t.Error("began two sequences")
+	}
+
+	q.claim([]uint32{1, 2})
+
+	q.stop(seqBracket)
+	if ctx.Err() != nil {
+		t.Error("stopped a sequence of another kind")
+	}
+	q.end()
+	if q.running() || ctx.Err() == nil {
+		t.Error("running after end")
+	}
+
+	// The shots of the last sequence stay claimed until ingest releases them.
+	_, _ = q.begin(context.Background(), seqBracket)
+	q.claim([]uint32{3})
+	q.end()
+	for h, expected := range map[uint32]bool{1: true, 2: true, 3: true, 4: false} {
+		if q.release(h) != expected {
+			t.Errorf("object %d: expected %v", h, expected)
+		}
+	}
+	if q.release(2) {
+		t.Error("released objects should be forgotten")
+	}
+}
@@ -0,0 +1,459 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage operations over any Device. DeviceDirect has its own variants, but
+// the other backends only implement RunTransaction.
+
+// objectRoot is the parent handle of the objects in the root of a storage.
+const objectRoot = 0xFFFFFFFF
+
+// allStorages selects objects in all storages.
+const allStorages = 0xFFFFFFFF
+
+func getDataContext(ctx context.Context, dev Device, code uint16, info interface{}, params ...uint32) error {
+	var buf bytes.Buffer
+	var req, rep Container
+	req.Code = code
+	req.Param = params
+	err := dev.RunTransactionContext(ctx, &req, &rep, &buf, nil, 0)
+	if err != nil {
+		return err
+	}
+	return Decode(&buf, info)
+}
+
+func getStorageIDs(ctx context.Context, dev Device) ([]uint32, error) {
+	ids := Uint32Array{}
+	err := getDataContext(ctx, dev, OC_GetStorageIDs, &ids)
+	return ids.Values, err
+}
+
+func getStorageInfo(ctx context.Context, dev Device, id uint32) (StorageInfo, error) {
+	info := StorageInfo{}
+	err := getDataContext(ctx, dev, OC_GetStorageInfo, &info, id)
+	return info, err
+}
+
+func getObjectHandles(ctx context.Context, dev Device, storageID, parent uint32) ([]uint32, error) {
+	handles := Uint32Array{}
+	err := getDataContext(ctx, dev, OC_GetObjectHandles, &handles, storageID, 0, parent)
+	return handles.Values, err
+}
+
+func getObjectInfo(ctx context.Context, dev Device, handle uint32) (ObjectInfo, error) {
+	info := ObjectInfo{}
+	err := getDataContext(ctx, dev, OC_GetObjectInfo, &info, handle)
+	return info, err
+}
+
+// getObject streams an object to w. code is OC_GetObject, OC_GetThumb or
+// OC_NIKON_GetLargeThumb.
+func getObject(ctx context.Context, dev Device, code uint16, handle uint32, w io.Writer) error {
+	var req, rep Container
+	req.Code = code
+	req.Param = []uint32{handle}
+	return dev.RunTransactionContext(ctx, &req, &rep, w, nil, 0)
+}
+
+func deleteObject(ctx context.Context, dev Device, handle uint32) error {
+	var req, rep Container
+	req.Code = OC_DeleteObject
+	req.Param = []uint32{handle, 0}
+	return dev.RunTransactionContext(ctx, &req, &rep, nil, nil, 0)
+}
+
+// StorageEntry is a storage in the response of /api/storage.
+type StorageEntry struct {
+	ID          uint32 `json:"id"`
+	Description string `json:"description"`
+	Label       string `json:"label"`
+	Capacity    uint64 `json:"capacity"`
+	Free        uint64 `json:"free"`
+	FreeImages  uint32 `json:"free_images"`
+	Removable   bool   `json:"removable"`
+	ReadOnly    bool   `json:"read_only"`
+}
+
+func newStorageEntry(id uint32, info StorageInfo) StorageEntry {
+	return StorageEntry{
+		ID:          id,
+		Description: info.StorageDescription,
+		Label:       info.VolumeLabel,
+		Capacity:    info.MaxCapability,
+		Free:        info.FreeSpaceInBytes,
+		FreeImages:  info.FreeSpaceInImages,
+		Removable:   info.IsRemovable(),
+		ReadOnly:    info.AccessCapability != AC_ReadWrite,
+	}
+}
+
+// ObjectEntry is a file or a folder in the response of /api/objects.
+type ObjectEntry struct {
+	Handle   uint32     `json:"handle"`
+	Storage  uint32     `json:"storage"`
+	Parent   uint32     `json:"parent"`
+	Name     string     `json:"name"`
+	Folder   bool       `json:"folder"`
+	Format   string     `json:"format"`
+	Size     uint32     `json:"size"`
+	Width    uint32     `json:"width,omitempty"`
+	Height   uint32     `json:"height,omitempty"`
+	Captured *time.Time `json:"captured,omitempty"`
+	Thumb    string     `json:"thumb,omitempty"`
+}
+
+func newObjectEntry(handle uint32, info ObjectInfo) ObjectEntry {
+	e := ObjectEntry{
+		Handle:  handle,
+		Storage: info.StorageID,
+		Parent:  info.ParentObject,
+		Name:    info.Filename,
+		Folder:  info.ObjectFormat == OFC_Association,
+		Format:  getName(OFC_names, int(info.ObjectFormat)),
+		Size:    info.CompressedSize,
+		Width:   info.ImagePixWidth,
+		Height:  info.ImagePixHeight,
+	}
+	if !info.CaptureDate.IsZero() {
+		captured := info.CaptureDate
+		e.Captured = &captured
+	}
+	if !e.Folder && info.ThumbFormat != 0 && info.ThumbCompressedSize > 0 {
+		e.Thumb = fmt.Sprintf("/api/objects/%d/thumb", handle)
+	}
+	return e
+}
+
+// parseObjectPath splits "/api/objects/{handle}[/thumb]".
+func parseObjectPath(p string) (handle uint32, thumb bool, err error) {
+	rest := strings.TrimPrefix(p, "/api/objects/")
+	if strings.HasSuffix(rest, "/thumb") {
+		rest, thumb = strings.TrimSuffix(rest, "/thumb"), true
+	}
+	h, err := strconv.ParseUint(rest, 10, 32)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid object handle %q", rest)
+	}
+	return uint32(h), thumb, nil
+}
+
+// parseHandleParam parses an optional handle in a query, which can be decimal
+// or hexadecimal with 0x prefix.
+func parseHandleParam(r *http.Request, name string, def uint32) (uint32, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	h, err := strconv.ParseUint(v, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q", name, v)
+	}
+	return uint32(h), nil
+}
+
+// storageStatus maps an error from the device into an HTTP status code.
+func storageStatus(err error) int {
+	var rc RCError
+	if !errors.As(err, &rc) {
+		return http.StatusBadGateway
+	}
+	switch rc {
+	case RC_InvalidObjectHandle, RC_InvalidStorageId, RC_InvalidParentObject:
+		return http.StatusNotFound
+	case RC_ObjectWriteProtected, RC_StoreReadOnly, RC_AccessDenied:
+		return http.StatusForbidden
+	case RC_StoreFull:
+		return http.StatusInsufficientStorage
+	case RC_OperationNotSupported:
+		return http.StatusNotImplemented
+	}
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.LV.Errorf("failed to write a response: %s", err)
+	}
+}
+
+// withDevice runs f with the device granted at the priority.
+func (s *LVServer) withDevice(prio Priority, f func() error) error {
+	s.sched.Lock(prio)
+	defer s.sched.Unlock()
+	return f()
+}
+
+// HandleStorage lists the storages with their free space.
+func (s *LVServer) HandleStorage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	entries := []StorageEntry{}
+	if s.dummy {
+		writeJSON(w, entries)
+		return
+	}
+
+	var ids []uint32
+	err := s.withDevice(PriorityUser, func() (err error) {
+		ids, err = getStorageIDs(r.Context(), s.dev)
+		return
+	})
+	if err != nil {
+		log.LV.Errorf("HandleStorage: failed to get storage IDs: %s", err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+
+	for _, id := range ids {
+		// Empty card slots are reported with the lower 16 bits cleared.
+		if id&0xFFFF == 0 {
+			continue
+		}
+
+		var info StorageInfo
+		err = s.withDevice(PriorityUser, func() (err error) {
+			info, err = getStorageInfo(r.Context(), s.dev, id)
+			return
+		})
+		if err != nil {
+			log.LV.Warningf("HandleStorage: failed to get storage info of 0x%08x: %s", id, err)
+			continue
+		}
+		entries = append(entries, newStorageEntry(id, info))
+	}
+
+	writeJSON(w, entries)
+}
+
+// HandleObjects lists the objects in a folder (GET), or uploads a file into it
+// (POST, see uploadObject). The storage and parent queries default to all
+// storages, or the one the camera chooses for uploads, and the root folder.
+func (s *LVServer) HandleObjects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	defStorage := uint32(allStorages)
+	if r.Method == http.MethodPost {
+		defStorage = 0
+	}
+
+	storage, err := parseHandleParam(r, "storage", defStorage)
+	if err == nil {
+		var parent uint32
+		parent, err = parseHandleParam(r, "parent", objectRoot)
+		if err == nil && r.Method == http.MethodPost {
+			s.uploadObject(w, r, storage, parent)
+			return
+		} else if err == nil {
+			s.listObjects(w, r, storage, parent)
+			return
+		}
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+func (s *LVServer) listObjects(w http.ResponseWriter, r *http.Request, storage, parent uint32) {
+	entries := []ObjectEntry{}
+	if s.dummy {
+		writeJSON(w, entries)
+		return
+	}
+
+	var handles []uint32
+	err := s.withDevice(PriorityUser, func() (err error) {
+		handles, err = getObjectHandles(r.Context(), s.dev, storage, parent)
+		return
+	})
+	if err != nil {
+		log.LV.Errorf("HandleObjects: failed to get object handles: %s", err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+
+	for _, h := range handles {
+		var info ObjectInfo
+		err = s.withDevice(PriorityUser, func() (err error) {
+			info, err = getObjectInfo(r.Context(), s.dev, h)
+			return
+		})
+		if err != nil {
+			log.LV.Warningf("HandleObjects: failed to get object info of 0x%08x: %s", h, err)
+			continue
+		}
+		entries = append(entries, newObjectEntry(h, info))
+	}
+
+	writeJSON(w, entries)
+}
+
+// HandleObject downloads (GET and HEAD, with Range if the device supports
+// GetPartialObject) or deletes (DELETE) an object, or downloads its thumbnail
+// with GET /api/objects/{handle}/thumb. "?size=large" asks for the large
+// thumbnail of Nikon cameras.
+func (s *LVServer) HandleObject(w http.ResponseWriter, r *http.Request) {
+	handle, thumb, err := parseObjectPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && thumb:
+		s.downloadThumb(w, r, handle)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		s.downloadObject(w, r, handle)
+	case r.Method == http.MethodDelete && !thumb:
+		s.deleteObject(w, r, handle)
+	default:
+		if thumb {
+			w.Header().Set("Allow", "GET")
+		} else {
+			w.Header().Set("Allow", "GET, HEAD, DELETE")
+		}
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *LVServer) downloadObject(w http.ResponseWriter, r *http.Request, handle uint32) {
+	if s.dummy {
+		http.NotFound(w, r)
+		return
+	}
+
+	var info ObjectInfo
+	err := s.withDevice(PriorityUser, func() (err error) {
+		info, err = getObjectInfo(r.Context(), s.dev, handle)
+		return
+	})
+	if err == nil && info.ObjectFormat == OFC_Association {
+		err = RCError(RC_InvalidObjectHandle)
+	}
+	if err != nil {
+		log.LV.Errorf("HandleObject: failed to get object info of 0x%08x: %s", handle, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+
+	ct := mime.TypeByExtension(path.Ext(info.Filename))
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": info.Filename}))
+
+	modtime := info.ModificationDate
+	if modtime.IsZero() {
+		modtime = info.CaptureDate
+	}
+
+	// Read the object in chunks if possible, which serves Range requests and
+	// survives a failed transfer of a chunk.
+	size, ok := s.objectSize(r.Context(), handle, info)
+	if code := s.partialObjectCode(size); ok && code != 0 {
+		or := &objectReader{ctx: r.Context(), s: s, code: code, handle: handle, size: int64(size)}
+		http.ServeContent(w, r, info.Filename, modtime, or)
+		return
+	}
+
+	if r.Method == http.MethodHead {
+		if ok {
+			w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+		}
+		return
+	}
+
+	// MTP can't interleave other transactions with a transfer, so spool the
+	// object to a file rather than keeping the device locked for a slow
+	// client.
+	f, err := ioutil.TempFile("", "mtplvcap-object-*")
+	if err != nil {
+		log.LV.Errorf("HandleObject: failed to create a temporary file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = s.withDevice(PriorityUser, func() error {
+		return getObject(r.Context(), s.dev, OC_GetObject, handle, f)
+	})
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.LV.Errorf("HandleObject: failed to download 0x%08x: %s", handle, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+	http.ServeContent(w, r, info.Filename, modtime, f)
+}
+
+func (s *LVServer) downloadThumb(w http.ResponseWriter, r *http.Request, handle uint32) {
+	if s.dummy {
+		http.NotFound(w, r)
+		return
+	}
+
+	code := uint16(OC_GetThumb)
+	if r.URL.Query().Get("size") == "large" && s.caps.op(OC_NIKON_GetLargeThumb) {
+		code = OC_NIKON_GetLargeThumb
+	}
+
+	var buf bytes.Buffer
+	err := s.withDevice(PriorityUser, func() error {
+		return getObject(r.Context(), s.dev, code, handle, &buf)
+	})
+	if err != nil {
+		log.LV.Errorf("HandleObject: failed to get the thumbnail of 0x%08x: %s", handle, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(buf.Bytes())
+}
+
+func (s *LVServer) deleteObject(w http.ResponseWriter, r *http.Request, handle uint32) {
+	if s.dummy {
+		http.NotFound(w, r)
+		return
+	}
+
+	err := s.withDevice(PriorityUser, func() error {
+		return deleteObject(r.Context(), s.dev, handle)
+	})
+	if err != nil {
+		log.LV.Errorf("HandleObject: failed to delete 0x%08x: %s", handle, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+
+	log.LV.Infof("deleted object 0x%08x", handle)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,153 @@
+package mtp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseObjectPath(t *testing.T) {
+	cases := []struct {
+		path   string
+		handle uint32
+		thumb  bool
+		ok     bool
+	}{
+		{"/api/objects/123", 123, false, true},
+		{"/api/objects/123/thumb", 123, true, true},
+		{"/api/objects/", 0, false, false},
+		{"/api/objects/abc", 0, false, false},
+		{"/api/objects/123/other", 0, false, false},
+	}
+
+	for _, c := range cases {
+		handle, thumb, err := parseObjectPath(c.path)
+		if (err == nil) != c.ok || handle != c.handle || thumb != c.thumb {
+			t.Errorf("%s: got %d, %v, %v", c.path, handle, thumb, err)
+		}
+	}
+}
+
+func TestObjectsHandlerParams(t *testing.T) {
+	s := &LVServer{dummy: true}
+
+	for url, code := range map[string]int{
+		"/api/objects": http.StatusOK,
+		"/api/objects?storage=0x00010001&parent=1234":       http.StatusOK,
+		"/api/objects?storage=card":                         http.StatusBadRequest,
+		"/api/objects?storage=0x00010001&parent=-1":         http.StatusBadRequest,
+		"/api/objects?storage=0x00010001&parent=4294967296": http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		s.HandleObjects(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		if rec.Code != code {
+			t.Errorf("%s: got %d, want %d", url, rec.Code, code)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	s.HandleObjects(rec, httptest.NewRequest(http.MethodDelete, "/api/objects", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE: got %d", rec.Code)
+	}
+}
+
+func TestNewObjectEntry(t *testing.T) {
+	captured := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	e := newObjectEntry(5, ObjectInfo{
+		StorageID:           0x00010001,
+		ObjectFormat:        OFC_EXIF_JPEG,
+		CompressedSize:      1024,
+		ThumbFormat:         OFC_EXIF_JPEG,
+		ThumbCompressedSize: 100,
+		ParentObject:        2,
+		Filename:            "DSC_0001.JPG",
+		CaptureDate:         captured,
+	})
+	if e.Folder || e.Thumb != "/api/objects/5/thumb" || e.Captured == nil || !e.Captured.Equal(captured) {
+		t.Errorf("got %+v", e)
+	}
+
+	e = newObjectEntry(2, ObjectInfo{ObjectFormat: OFC_Association, Filename: "DCIM"})
+	if !e.Folder || e.Thumb != "" || e.Captured != nil {
+		t.Errorf("got %+v", e)
+	}
+}
+
+func TestStorageStatus(t *testing.T) {
+	if c := storageStatus(RCError(RC_InvalidObjectHandle)); c != http.StatusNotFound {
+		t.Errorf("got %d", c)
+	}
+	if c := storageStatus(RCError(RC_ObjectWriteProtected)); c != http.StatusForbidden {
+		t.Errorf("got %d", c)
+	}
+	if c := storageStatus(RCError(RC_GeneralError)); c != http.StatusBadGateway {
+		t.Errorf("got %d", c)
+	}
+	if c := storageStatus(fmt.Errorf("failed to set: %w", RCError(RC_AccessDenied))); c != http.StatusForbidden {
+		t.Errorf("wrapped errors should be mapped too: got %d", c)
+	}
+}
+
+// objectDevice serves an object without GetPartialObject.
+type objectDevice struct {
+	Device
+	data []byte
+}
+
+func (d *objectDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	switch req.Code {
+	case OC_GetObjectInfo:
+		return Encode(dest, &ObjectInfo{ObjectFormat: OFC_EXIF_JPEG, CompressedSize: uint32(len(d.data)), Filename: "DSC_0001.JPG"})
+	case OC_GetObject:
+		_, err := dest.Write(d.data)
+		return err
+	}
+	return RCError(RC_OperationNotSupported)
+}
+
+// checkUnlocked fails the test if the device is locked for a second.
+func checkUnlocked(t *testing.T, sched *Scheduler) {
+	locked := make(chan bool)
+	go func() {
+		sched.Lock(PriorityUser)
+		sched.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Error("the device is locked while talking to the client")
+	}
+}
+
+// lockCheckingWriter checks the device is free while the response is
+// written.
+type lockCheckingWriter struct {
+	*httptest.ResponseRecorder
+	t     *testing.T
+	sched *Scheduler
+}
+
+func (w lockCheckingWriter) Write(p []byte) (int, error) {
+	checkUnlocked(w.t, w.sched)
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestDownloadObject(t *testing.T) {
+	dev := &objectDevice{data: []byte("JPEG data")}
+	s := &LVServer{dev: dev, sched: NewScheduler(), ctx: context.Background()}
+
+	rec := httptest.NewRecorder()
+	s.downloadObject(lockCheckingWriter{rec, t, s.sched}, httptest.NewRequest(http.MethodGet, "/api/objects/1", nil), 1)
+	if rec.Code != http.StatusOK || rec.Body.String() != "JPEG data" {
+		t.Errorf("got %d, %q", rec.Code, rec.Body.String())
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != "9" {
+		t.Errorf("got Content-Length %q", cl)
+	}
+}
@@ -0,0 +1,170 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// UploadProgress reports the last upload in InfoPayload.
+type UploadProgress struct {
+	Name  string `json:"name"`
+	Sent  int64  `json:"sent"`
+	Size  int64  `json:"size"`
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// sendObjectInfo announces an object to send with sendObject, which must be
+// the next transaction. It returns the handle of the new object.
+func sendObjectInfo(ctx context.Context, dev Device, storageID, parent uint32, info *ObjectInfo) (uint32, error) {
+	var buf bytes.Buffer
+	err := Encode(&buf, info)
+	if err != nil {
+		return 0, err
+	}
+
+	var req, rep Container
+	req.Code = OC_SendObjectInfo
+	req.Param = []uint32{storageID, parent}
+	err = dev.RunTransactionContext(ctx, &req, &rep, nil, &buf, int64(buf.Len()))
+	if err != nil {
+		return 0, err
+	}
+	if len(rep.Param) < 3 {
+		return 0, fmt.Errorf("sendObjectInfo: got %v, need 3 response parameters", rep.Param)
+	}
+
+	info.StorageID, info.ParentObject = rep.Param[0], rep.Param[1]
+	return rep.Param[2], nil
+}
+
+func sendObject(ctx context.Context, dev Device, r io.Reader, size int64) error {
+	var req, rep Container
+	req.Code = OC_SendObject
+	req.Param = []uint32{}
+	return dev.RunTransactionContext(ctx, &req, &rep, nil, r, size)
+}
+
+// objectFormat guesses the format code of a file to upload.
+func objectFormat(name string) uint16 {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg":
+		return OFC_EXIF_JPEG
+	case ".txt":
+		return OFC_Text
+	}
+	return OFC_Undefined
+}
+
+// progressReader updates the upload progress as the file is sent.
+type progressReader struct {
+	r      io.Reader
+	s      *LVServer
+	upload UploadProgress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.upload.Sent += int64(n)
+	p.s.setUpload(p.upload)
+	return n, err
+}
+
+func (s *LVServer) setUpload(p UploadProgress) {
+	s.infoLock.Lock()
+	defer s.infoLock.Unlock()
+	s.info.Upload = &p
+}
+
+// uploadObject stores the request body as a file named by the "name" query
+// in the storage and the folder.
+func (s *LVServer) uploadObject(w http.ResponseWriter, r *http.Request, storage, parent uint32) {
+	name := r.URL.Query().Get("name")
+	if name == "" || strings.ContainsAny(name, "/\\") {
+		http.Error(w, "a file name without a path is required", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, http.StatusText(http.StatusLengthRequired), http.StatusLengthRequired)
+		return
+	}
+	if r.ContentLength >= 0xFFFFFFFF {
+		http.Error(w, "files of 4GiB or more can't be uploaded", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if s.dummy {
+		http.Error(w, "no camera is connected", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Receive the whole body first, so that a slow client doesn't hold the
+	// device during SendObject.
+	f, err := ioutil.TempFile("", "mtplvcap-upload-*")
+	if err != nil {
+		log.LV.Errorf("HandleObjects: failed to create a temporary file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := io.Copy(f, r.Body)
+	if err == nil && n != r.ContentLength {
+		err = fmt.Errorf("received %d bytes of %d", n, r.ContentLength)
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		log.LV.Errorf("HandleObjects: failed to receive %s: %s", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info := ObjectInfo{
+		ObjectFormat:   objectFormat(name),
+		CompressedSize: uint32(r.ContentLength),
+		Filename:       name,
+	}
+	pr := &progressReader{
+		r:      f,
+		s:      s,
+		upload: UploadProgress{Name: name, Size: r.ContentLength},
+	}
+	s.setUpload(pr.upload)
+
+	// SendObject must follow SendObjectInfo without other transactions.
+	var handle uint32
+	err = s.withDevice(PriorityUser, func() (err error) {
+		handle, err = sendObjectInfo(r.Context(), s.dev, storage, parent, &info)
+		if err != nil {
+			return err
+		}
+		return sendObject(r.Context(), s.dev, pr, r.ContentLength)
+	})
+
+	pr.upload.Done = true
+	if err != nil {
+		pr.upload.Error = err.Error()
+	}
+	s.setUpload(pr.upload)
+
+	if err != nil {
+		log.LV.Errorf("HandleObjects: failed to upload %s: %s", name, err)
+		http.Error(w, err.Error(), storageStatus(err))
+		return
+	}
+
+	log.LV.Infof("uploaded %s as object 0x%08x", name, handle)
+	w.Header().Set("Location", fmt.Sprintf("/api/objects/%d", handle))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, newObjectEntry(handle, info))
+}
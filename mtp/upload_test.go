@@ -0,0 +1,93 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// uploadDevice accepts SendObjectInfo and SendObject.
+type uploadDevice struct {
+	Device
+	info ObjectInfo
+	data []byte
+}
+
+func (d *uploadDevice) RunTransactionContext(ctx context.Context, req *Container, rep *Container, dest io.Writer, src io.Reader, writeSize int64) error {
+	switch req.Code {
+	case OC_SendObjectInfo:
+		err := Decode(src, &d.info)
+		if err != nil {
+			return err
+		}
+		rep.Param = []uint32{0x00010001, req.Param[1], 42}
+	case OC_SendObject:
+		data, err := ioutil.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		d.data = data
+	default:
+		return RCError(RC_OperationNotSupported)
+	}
+	return nil
+}
+
+// lockCheckingReader checks the device is free while the request is read.
+type lockCheckingReader struct {
+	io.Reader
+	t     *testing.T
+	sched *Scheduler
+}
+
+func (r lockCheckingReader) Read(p []byte) (int, error) {
+	checkUnlocked(r.t, r.sched)
+	return r.Reader.Read(p)
+}
+
+func TestUploadObject(t *testing.T) {
+	dev := &uploadDevice{}
+	s := &LVServer{dev: dev, sched: NewScheduler()}
+
+	body := "firmware image"
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api/objects?parent=7&name=D850_0130.bin", lockCheckingReader{strings.NewReader(body), t, s.sched})
+	req.ContentLength = int64(len(body))
+	s.HandleObjects(rec, req)
+
+	if rec.Code != http.StatusCreated || rec.Header().Get("Location") != "/api/objects/42" {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body.String())
+	}
+	var e ObjectEntry
+	err := json.NewDecoder(rec.Body).Decode(&e)
+	if err != nil || e.Handle != 42 || e.Storage != 0x00010001 || e.Parent != 7 || e.Name != "D850_0130.bin" {
+		t.Errorf("got %+v, %v", e, err)
+	}
+
+	if dev.info.Filename != "D850_0130.bin" || dev.info.CompressedSize != uint32(len(body)) || !bytes.Equal(dev.data, []byte(body)) {
+		t.Errorf("got %+v, %q", dev.info, dev.data)
+	}
+	if u := s.info.Upload; u == nil || !u.Done || u.Sent != int64(len(body)) {
+		t.Errorf("got progress %+v", u)
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/api/objects?name=D850_0131.bin", strings.NewReader(body))
+	req.ContentLength++
+	s.HandleObjects(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("a short body should be rejected: got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.HandleObjects(rec, httptest.NewRequest(http.MethodPost, "/api/objects?name=../x.bin", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("paths in the name should be rejected: got %d", rec.Code)
+	}
+}
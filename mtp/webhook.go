@@ -0,0 +1,34 @@
+package mtp
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"time"
+)
+
+// webhookTimeout bounds a webhook call.
+const webhookTimeout = 10 * time.Second
+
+// postWebhook POSTs a JSON payload to url, logging failures.
+func (s *LVServer) postWebhook(url string, payload []byte) {
+	ctx, cancel := context.WithTimeout(s.ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		log.LV.Errorf("postWebhook: failed to create a request: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.LV.Warningf("postWebhook: failed to call %s: %s", url, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.LV.Warningf("postWebhook: %s responded %s", url, res.Status)
+	}
+}
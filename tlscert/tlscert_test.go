@@ -0,0 +1,50 @@
+package tlscert
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureSelfSigned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlscert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	generated, err := EnsureSelfSigned(certPath, keyPath, []string{"localhost", "192.168.0.10"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !generated {
+		t.Fatal("expected a certificate to be generated")
+	}
+
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.VerifyHostname("localhost"); err != nil {
+		t.Error(err)
+	}
+	if err = cert.VerifyHostname("192.168.0.10"); err != nil {
+		t.Error(err)
+	}
+
+	generated, err = EnsureSelfSigned(certPath, keyPath, []string{"localhost"})
+	if err != nil {
+		t.Fatal(err)
+	} else if generated {
+		t.Error("existing certificate should be reused")
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/puhitaku/mtplvcap/mtp"
+)
+
+// uploadClient talks to the storage API of a running mtplvcap.
+type uploadClient struct {
+	base  string
+	token string
+}
+
+func (c *uploadClient) do(req *http.Request, v interface{}) error {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// resolveFolder finds the handle of a folder path like "DCIM/100NIKON".
+func (c *uploadClient) resolveFolder(storage, folder string) (string, string, error) {
+	parent := ""
+	for _, name := range strings.Split(strings.Trim(filepath.ToSlash(folder), "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		q := url.Values{}
+		if storage != "" {
+			q.Set("storage", storage)
+		}
+		if parent != "" {
+			q.Set("parent", parent)
+		}
+		req, err := http.NewRequest(http.MethodGet, c.base+"/api/objects?"+q.Encode(), nil)
+		if err != nil {
+			return "", "", err
+		}
+
+		var objects []mtp.ObjectEntry
+		err = c.do(req, &objects)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to list %s: %s", folder, err)
+		}
+
+		found := false
+		for _, o := range objects {
+			if o.Folder && strings.EqualFold(o.Name, name) {
+				parent, storage, found = fmt.Sprint(o.Handle), fmt.Sprint(o.Storage), true
+				break
+			}
+		}
+		if !found {
+			return "", "", fmt.Errorf("folder %s is not found", folder)
+		}
+	}
+	return storage, parent, nil
+}
+
+// uploadProgress prints the progress of a file to stderr.
+type uploadProgress struct {
+	r    io.Reader
+	name string
+	sent int64
+	size int64
+	last int64
+}
+
+func (p *uploadProgress) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.sent += int64(n)
+	if pct := p.sent * 100 / p.size; pct != p.last || err == io.EOF {
+		p.last = pct
+		fmt.Fprintf(os.Stderr, "\r%s: %3d%% (%d/%d bytes)", p.name, pct, p.sent, p.size)
+	}
+	return n, err
+}
+
+func (c *uploadClient) upload(storage, parent, path string) (mtp.ObjectEntry, error) {
+	var entry mtp.ObjectEntry
+
+	f, err := os.Open(path)
+	if err != nil {
+		return entry, err
+	}
+	defer f.Close()
+
+	st, err := f.Stat()
+	if err != nil {
+		return entry, err
+	}
+
+	name := filepath.Base(path)
+	q := url.Values{"name": {name}}
+	if storage != "" {
+		q.Set("storage", storage)
+	}
+	if parent != "" {
+		q.Set("parent", parent)
+	}
+
+	var body io.Reader = f
+	if st.Size() > 0 {
+		body = &uploadProgress{r: f, name: name, size: st.Size(), last: -1}
+	}
+	req, err := http.NewRequest(http.MethodPost, c.base+"/api/objects?"+q.Encode(), body)
+	if err != nil {
+		return entry, err
+	}
+	req.ContentLength = st.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	err = c.do(req, &entry)
+	fmt.Fprintln(os.Stderr)
+	return entry, err
+}
+
+// runUpload implements "mtplvcap upload", which sends files to the camera
+// connected to a running mtplvcap.
+func runUpload(args []string) error {
+	fs := flag.NewFlagSet("upload", flag.ExitOnError)
+	server := fs.String("url", "http://localhost:42839", "URL of the running mtplvcap")
+	token := fs.String("token", "", "bearer token that grants the controller role")
+	storage := fs.String("storage", "", "storage ID to upload to (e.g. 0x00010001), default = chosen by the camera")
+	folder := fs.String("folder", "", "folder to upload to (e.g. DCIM/100NIKON), default = the root folder")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s upload [flags] file...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c := &uploadClient{base: strings.TrimSuffix(*server, "/"), token: *token}
+	st, parent, err := c.resolveFolder(*storage, *folder)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range fs.Args() {
+		entry, err := c.upload(st, parent, path)
+		if err != nil {
+			return fmt.Errorf("failed to upload %s: %s", path, err)
+		}
+		fmt.Printf("%s: uploaded as object %d\n", path, entry.Handle)
+	}
+	return nil
+}